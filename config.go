@@ -3,14 +3,33 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"reflect"
+	"strings"
 
 	"github.com/aktau/gomig/db/common"
 	"launchpad.net/goyaml"
 )
 
+/* the driver selects the backend from the registry, the connection
+ * parameters are the same for all backends, anything driver-specific goes
+ * into the options map of the connection parameters */
+type SourceConfig struct {
+	Driver        string `yaml:"driver,omitempty"`
+	common.Config `yaml:",inline"`
+}
+
 type DestinationConfig struct {
-	File     string         `yaml:"file,omitempty"`
+	Driver        string `yaml:"driver,omitempty"`
+	File          string `yaml:"file,omitempty"`
+	FilePerTable  string `yaml:"file_per_table,omitempty"`
+	FileSuffix    string `yaml:"file_suffix,omitempty"`
+	common.Config `yaml:",inline"`
+
+	/* py-mysql2pgsql style connection sections, these are folded into the
+	 * fields above when loading the config */
 	Postgres *common.Config `yaml:"postgres,omitempty"`
+	Mysql    *common.Config `yaml:"mysql,omitempty"`
+	Sqlite   *common.Config `yaml:"sqlite,omitempty"`
 }
 
 type ProjectionConfig struct {
@@ -21,18 +40,51 @@ type ProjectionConfig struct {
 	Engine     string            `yaml:"engine,omitempty"`
 }
 
+/* per table options, by source table name */
+type TableConfig struct {
+	Incremental *IncrementalConfig `yaml:"incremental,omitempty"`
+
+	/* the columns the rows are merged on, instead of the primary key (or
+	 * the unique key, for a table without primary key) */
+	MergeKey []string `yaml:"merge_key,omitempty"`
+
+	/* when merging, the destination rows that are no longer in the source
+	 * are deleted, or marked as deleted if soft_delete is set */
+	DeleteMissing bool              `yaml:"delete_missing,omitempty"`
+	SoftDelete    *SoftDeleteConfig `yaml:"soft_delete,omitempty"`
+}
+
+/* the column that marks a row as deleted and the value (an SQL expression)
+ * it's set to */
+type SoftDeleteConfig struct {
+	Column string `yaml:"column"`
+	Value  string `yaml:"value"`
+}
+
+/* only the rows whose column is beyond the value it had at the last sync
+ * are merged */
+type IncrementalConfig struct {
+	Column string `yaml:"column"`
+}
+
 type Config struct {
-	Mysql        *common.Config               `yaml:"mysql,omitempty"`
-	Destination  *DestinationConfig           `yaml:"destination,omitempty"`
-	Views        map[string]string            `yaml:"views,omitempty"`
-	Projections  map[string]ProjectionConfig  `yaml:"projections,omitempty"`
-	Tables       map[string]map[string]string `yaml:"tables,omitempty"`
-	TableMap     map[string]string            `yaml:"table_map,omitempty"`
-	SuppressData bool                         `yaml:"supress_data"`
-	SuppressDdl  bool                         `yaml:"supress_ddl"`
-	Truncate     bool                         `yaml:"force_truncate"`
-	Merge        bool                         `yaml:"merge"`
-	Timezone     bool                         `yaml:"timezone"`
+	Source           *SourceConfig               `yaml:"source,omitempty"`
+	Destination      *DestinationConfig          `yaml:"destination,omitempty"`
+	Views            map[string]string           `yaml:"views,omitempty"`
+	Projections      map[string]ProjectionConfig `yaml:"projections,omitempty"`
+	Tables           map[string]TableConfig      `yaml:"tables,omitempty"`
+	TableMap         map[string]string           `yaml:"table_map,omitempty"`
+	SuppressData     bool                        `yaml:"supress_data"`
+	SuppressDdl      bool                        `yaml:"supress_ddl"`
+	Truncate         bool                        `yaml:"force_truncate"`
+	Merge            bool                        `yaml:"merge"`
+	Timezone         bool                        `yaml:"timezone"`
+	Parallelism      int                         `yaml:"parallelism,omitempty"`
+	ChunkSize        int                         `yaml:"chunk_size,omitempty"`
+	StateFile        string                      `yaml:"state_file,omitempty"`
+	MergeStrategy    string                      `yaml:"merge_strategy,omitempty"`
+	ReloadWithoutKey bool                        `yaml:"reload_without_key"`
+	AutoEvolve       bool                        `yaml:"auto_evolve"`
 
 	/* the included and excluded tables as both a map and a list, depending
 	 * on what's most convenient. Note that the map version have last the
@@ -42,6 +94,12 @@ type Config struct {
 
 	ExcludeTables     map[string]bool `yaml:"-"`
 	ExcludeTablesList []string        `yaml:"exclude_tables,omitempty"`
+
+	/* py-mysql2pgsql style source sections, these are folded into the
+	 * source section when loading the config */
+	Mysql    *common.Config `yaml:"mysql,omitempty"`
+	Postgres *common.Config `yaml:"postgres,omitempty"`
+	Sqlite   *common.Config `yaml:"sqlite,omitempty"`
 }
 
 func LoadConfig(file string) (*Config, error) {
@@ -56,6 +114,11 @@ func LoadConfig(file string) (*Config, error) {
 		return nil, err
 	}
 
+	err = c.foldLegacySections()
+	if err != nil {
+		return nil, err
+	}
+
 	err = c.Validate()
 	if err != nil {
 		return nil, err
@@ -75,19 +138,159 @@ func stringSliceToSet(sl []string) map[string]bool {
 	return set
 }
 
+/* the old (py-mysql2pgsql) layout has the connection parameters in a
+ * section named after the driver, both at the top level (source) and in
+ * the destination section. These are moved into the generic source and
+ * destination sections. */
+func (c *Config) foldLegacySections() error {
+	if c.Source == nil {
+		c.Source = &SourceConfig{}
+	}
+
+	driver, conf, err := legacySection(c.Source.Driver, map[string]*common.Config{
+		"mysql":    c.Mysql,
+		"postgres": c.Postgres,
+		"sqlite":   c.Sqlite,
+	})
+	if err != nil {
+		return fmt.Errorf("source: %v", err)
+	}
+	if conf != nil {
+		if !isEmpty(&c.Source.Config) {
+			return fmt.Errorf("source: connection parameters are specified both in "+
+				"the source and in the %v section", driver)
+		}
+		c.Source.Driver, c.Source.Config = driver, *conf
+	}
+
+	if c.Destination == nil {
+		return nil
+	}
+
+	dst := c.Destination
+	driver, conf, err = legacySection(dst.Driver, map[string]*common.Config{
+		"mysql":    dst.Mysql,
+		"postgres": dst.Postgres,
+		"sqlite":   dst.Sqlite,
+	})
+	if err != nil {
+		return fmt.Errorf("destination: %v", err)
+	}
+	if conf != nil {
+		if !isEmpty(&dst.Config) {
+			return fmt.Errorf("destination: connection parameters are specified "+
+				"both in the destination and in the %v section", driver)
+		}
+		dst.Driver, dst.Config = driver, *conf
+	}
+
+	return nil
+}
+
+/* finds the legacy section that belongs to driver, or the only one that is
+ * present if no driver was given */
+func legacySection(driver string, sections map[string]*common.Config) (string, *common.Config, error) {
+	if driver != "" {
+		return driver, sections[driver], nil
+	}
+
+	var conf *common.Config
+	for name, section := range sections {
+		if section == nil {
+			continue
+		}
+		if conf != nil {
+			return "", nil, fmt.Errorf("multiple connection sections present, " +
+				"choose one with the driver field")
+		}
+		driver, conf = name, section
+	}
+
+	return driver, conf, nil
+}
+
+func isEmpty(conf *common.Config) bool {
+	return reflect.DeepEqual(*conf, common.Config{})
+}
+
 func (c *Config) Validate() error {
-	if c.Mysql == nil {
-		return fmt.Errorf("mysql section of config not present")
+	if c.Source == nil || c.Source.Driver == "" {
+		return fmt.Errorf("source section of config not present or it lacks a driver")
 	}
 
 	if c.Destination == nil {
 		return fmt.Errorf("destination section of config not present or complete, %v", c)
 	}
 
-	if c.Destination.File == "" && c.Destination.Postgres == nil {
-		return fmt.Errorf("either file or postgres has to be specified in "+
+	if !c.Destination.IsFile() && c.Destination.Driver == "" {
+		return fmt.Errorf("either file or driver has to be specified in "+
 			"the destination field of the config file: %v", c)
 	}
 
+	if c.Destination.File != "" && c.Destination.FilePerTable != "" {
+		return fmt.Errorf("the destination can't have both a file and file_per_table")
+	}
+	if c.Destination.FilePerTable == "-" {
+		return fmt.Errorf("file_per_table has to be a directory, not the standard output")
+	}
+	if suffix := c.Destination.FileSuffix; suffix != "" &&
+		(c.Destination.FilePerTable == "" || strings.ContainsAny(suffix, `/\`)) {
+		return fmt.Errorf("file_suffix %q is only for file_per_table, and can't contain a path", suffix)
+	}
+
+	if _, err := common.ParseMergeStrategy(c.MergeStrategy); err != nil {
+		return err
+	}
+
+	for name, table := range c.Tables {
+		if table.Incremental != nil && table.Incremental.Column == "" {
+			return fmt.Errorf("the incremental option of table %v lacks a column", name)
+		}
+		if sd := table.SoftDelete; sd != nil && (sd.Column == "" || sd.Value == "") {
+			return fmt.Errorf("the soft_delete option of table %v needs both a column and a value", name)
+		}
+		if table.Incremental != nil && (table.DeleteMissing || table.SoftDelete != nil) {
+			return fmt.Errorf("table %v is synced incrementally, the rows that are "+
+				"missing from the source can't be told apart from the unchanged ones", name)
+		}
+	}
+
 	return nil
 }
+
+/* returns the driver name and connection parameters of the source
+ * database */
+func (c *Config) SourceDatabase() (string, *common.Config) {
+	return c.Source.Driver, &c.Source.Config
+}
+
+/* returns the driver name and connection parameters of the destination
+ * database */
+func (d *DestinationConfig) Database() (string, *common.Config) {
+	return d.Driver, &d.Config
+}
+
+/* whether the output goes to a file (or a file per table) instead of a
+ * database */
+func (d *DestinationConfig) IsFile() bool {
+	return d.File != "" || d.FilePerTable != ""
+}
+
+/* the dialect a destination file is written in, postgres unless a driver
+ * is given */
+func (d *DestinationConfig) FileDriver() string {
+	if d.Driver != "" {
+		return d.Driver
+	}
+
+	return "postgres"
+}
+
+/* where the progress of a migration is recorded */
+func (c *Config) StatePath() string {
+	if c.StateFile != "" {
+		return c.StateFile
+	}
+
+	return PATH_STATE_DEFAULT
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"fmt"
+	"github.com/aktau/gomig/db"
 	"github.com/aktau/gomig/db/common"
 	"log"
+	"strings"
+	"sync"
 )
 
 var (
@@ -69,7 +73,11 @@ func (t *tempEntities) Erase() {
 	}
 }
 
-func Convert(r common.ReadCloser, w common.WriteCloser, options *Config, verbosity int) error {
+/* migrates the tables from r to w. If open is not nil and the parallelism
+ * option asks for it, extra connections are opened with it to migrate
+ * multiple tables at the same time. If st is not nil, the completed steps
+ * are recorded in it and the steps it already has are skipped. */
+func Convert(r common.ReadCloser, w common.WriteCloser, open Connector, st *State, options *Config, verbosity int) error {
 	tempViews := createTempEntities(r, options.Views, options.Projections)
 	defer tempViews.Erase()
 
@@ -80,7 +88,128 @@ func Convert(r common.ReadCloser, w common.WriteCloser, options *Config, verbosi
 	 * ordering among the tables. */
 	OrderTableByNamesList(tables, options.OnlyTablesList)
 
-	/* override types if specified in the options */
+	/* referenced tables have to be loaded before the tables that reference
+	 * them. Tables in a reference cycle can't be ordered like that, for a
+	 * regular migration that's not a problem because the constraints are
+	 * only added once all the data is loaded. When merging, the MySQL and
+	 * SQLite writers turn off the foreign key checks, but a postgres
+	 * destination checks its foreign keys as every table is merged (in a
+	 * transaction of its own). */
+	cycles := OrderTablesByDependencies(tables)
+	for _, cycle := range cycles {
+		log.Printf("converter: tables %v reference each other in a cycle, "+
+			"they can't be ordered by their foreign keys\n", cycle)
+		switch {
+		case !options.Merge:
+			log.Println("converter: their foreign keys are added after all the data is loaded")
+		case options.Destination.Driver == "postgres":
+			log.Println("converter: merging these tables fails if new rows " +
+				"reference each other across the cycle, drop the foreign keys " +
+				"of the destination for the merge in that case")
+		}
+	}
+	if VERBOSE {
+		names := make([]string, 0, len(tables))
+		for _, table := range tables {
+			names = append(names, table.Name)
+		}
+		log.Println("converter: table order", names)
+	}
+
+	overrideTypes(tables, options)
+
+	/* views and projections only exist on the main connection (they might
+	 * be temporary), so those tables can't be handed to the others */
+	pinned := make(map[string]bool)
+	for name := range options.Views {
+		pinned[name] = true
+	}
+	for name := range options.Projections {
+		pinned[name] = true
+	}
+
+	p := newPool(r, w, open, options.Parallelism)
+	defer p.Close()
+
+	if VERBOSE && len(p.conns) > 1 {
+		log.Printf("converter: migrating with %v connections\n", len(p.conns))
+	}
+
+	if options.Merge {
+		/* the destination tables are expected to exist already when
+		 * merging, so no DDL is emitted, unless they're evolved along
+		 * with the source */
+		if options.AutoEvolve {
+			if err := autoEvolve(tables, w, options); err != nil {
+				return err
+			}
+		}
+		if options.Truncate {
+			if err := truncateTables(tables, w, st, options); err != nil {
+				return err
+			}
+		}
+		if options.SuppressData {
+			return nil
+		}
+
+		reload, err := mergeKeys(tables, options)
+		if err != nil {
+			return err
+		}
+
+		setWatermarks(tables, r, st, options)
+		return mergeData(chunkTables(tables, r, st, options), p, pinned, reload, st, options)
+	}
+
+	if len(options.Tables) > 0 {
+		log.Println("converter: not merging, the incremental options are ignored")
+	}
+
+	/* a regular one-shot migration: create the tables, load them and only
+	 * then add the indices and constraints, which is a lot faster than
+	 * maintaining them during the load. The DDL is done on the main
+	 * connection, as all the other steps depend on it. */
+	if !options.SuppressDdl {
+		if err := createTables(tables, w, st, options); err != nil {
+			return err
+		}
+	}
+
+	/* freshly created tables are empty, no need to truncate those */
+	if options.Truncate && options.SuppressDdl {
+		if err := truncateTables(tables, w, st, options); err != nil {
+			return err
+		}
+	}
+
+	/* a table that fails doesn't stop the others, the errors of all steps
+	 * are reported at the end */
+	errors := make(TableErrors)
+
+	if !options.SuppressData {
+		if err := writeData(chunkTables(tables, r, st, options), p, pinned, st, options); err != nil {
+			errors.merge(err.(TableErrors))
+		}
+	}
+
+	if !options.SuppressDdl {
+		if err := createIndices(tableTasks(tables), p, pinned, st, options); err != nil {
+			errors.merge(err.(TableErrors))
+		}
+		if err := createConstraints(tables, p, pinned, st, options); err != nil {
+			errors.merge(err.(TableErrors))
+		}
+	}
+
+	if len(errors) > 0 {
+		return errors
+	}
+	return nil
+}
+
+/* override types if specified in the options */
+func overrideTypes(tables []*common.Table, options *Config) {
 	for _, table := range tables {
 		/* is this table a projection? */
 		meta, ok := options.Projections[table.Name]
@@ -100,71 +229,443 @@ func Convert(r common.ReadCloser, w common.WriteCloser, options *Config, verbosi
 			col.RawType = newtype
 		}
 	}
+}
 
-	if !options.SuppressDdl {
-		createTables(tables, w)
+func strmap(srcname string, m map[string]string) string {
+	if m == nil {
+		return srcname
 	}
-	if options.Truncate {
-		truncateTables(tables, w)
+	mapped, ok := m[srcname]
+	if !ok {
+		return srcname
 	}
-	if !options.SuppressData {
-		if options.Merge {
-			for _, srcTable := range tables {
-				/* is this table a projection? */
-				var extraDstCond string
-				if meta, ok := options.Projections[srcTable.Name]; ok {
-					extraDstCond = meta.Conditions
-				}
 
-				if VERBOSE {
-					log.Println("converter: merging table", srcTable.Name)
-				}
+	return mapped
+}
 
-				dstTableName := strmap(srcTable.Name, options.TableMap)
-				err := w.MergeTable(srcTable, dstTableName, extraDstCond, r)
-				if err != nil {
-					return err
-				}
+/* the foreign keys of a table refer to the source names of the tables they
+ * reference, the writers need the destination names. Foreign keys to tables
+ * that are not part of the migration are left out, they might not exist in
+ * the destination. */
+func withDestinationKeys(tables []*common.Table, options *Config) []*common.Table {
+	migrated := make(map[string]bool)
+	for _, table := range tables {
+		migrated[table.Name] = true
+	}
+
+	mapped := make([]*common.Table, 0, len(tables))
+	for _, table := range tables {
+		if len(table.ForeignKeys) == 0 {
+			mapped = append(mapped, table)
+			continue
+		}
+
+		copied := *table
+		copied.ForeignKeys = make([]*common.ForeignKey, 0, len(table.ForeignKeys))
+		for _, fk := range table.ForeignKeys {
+			if !migrated[fk.RefTable] {
+				log.Printf("converter: skipping foreign key %v of table %v, "+
+					"table %v is not migrated\n", fk.Name, table.Name, fk.RefTable)
+				continue
 			}
-		} else {
-			writeData(tables, w)
+
+			fkCopy := *fk
+			fkCopy.RefTable = strmap(fk.RefTable, options.TableMap)
+			copied.ForeignKeys = append(copied.ForeignKeys, &fkCopy)
 		}
+		mapped = append(mapped, &copied)
+	}
+
+	return mapped
+}
+
+/* skips work that an earlier (interrupted) run has already committed */
+func isTaskDone(st *State, step string, t task) bool {
+	if st.IsDone(t.table.Name, step) {
+		return true
 	}
+	return t.chunk != nil && st.IsChunkDone(t.table.Name, t.chunk)
+}
+
+func markTaskDone(st *State, step string, t task) {
+	if t.chunk == nil {
+		st.MarkDone(t.table.Name, step)
+	} else {
+		st.MarkChunkDone(t.table.Name, t.chunk, step)
+	}
+}
 
-	createIndices(tables, w)
-	createConstraints(tables, w)
+func createTables(tables []*common.Table, w common.Writer, st *State, options *Config) error {
+	for _, table := range withDestinationKeys(tables, options) {
+		/* recreating a table would throw away the data loaded into it */
+		if st.IsDone(table.Name, stepCreate) {
+			continue
+		}
+
+		if VERBOSE {
+			log.Println("converter: creating table", table.Name)
+		}
+
+		if err := w.CreateTable(table, strmap(table.Name, options.TableMap)); err != nil {
+			return err
+		}
+		st.MarkDone(table.Name, stepCreate)
+	}
 
 	return nil
 }
 
-func strmap(srcname string, m map[string]string) string {
-	if m == nil {
-		return srcname
+/* adds the columns the source tables gained to the destination tables
+ * before merging, and changes the ones that differ. Columns the source lost
+ * are left alone, the merge doesn't touch them. */
+func autoEvolve(tables []*common.Table, w common.Writer, options *Config) error {
+	if options.Destination.IsFile() {
+		log.Println("converter: the destination is a file, its schema can't be evolved")
+		return nil
 	}
-	mapped, ok := m[srcname]
-	if !ok {
-		return srcname
+
+	dr, err := db.OpenReader(options.Destination.Database())
+	if err != nil {
+		return fmt.Errorf("converter: could not read the destination schema, %v", err)
 	}
+	defer dr.Close()
 
-	return mapped
+	_, err = evolveTables(tables, w, dr, false, options)
+	return err
 }
 
-func createTables(tables []*common.Table, w common.Writer) error {
-	return nil
+/* brings the destination tables (as read by dr) in line with the source
+ * tables: the missing tables are created, and the columns of the others
+ * are evolved. Returns the number of tables that differed. */
+func evolveTables(tables []*common.Table, w common.Writer, dr common.Reader, drop bool, options *Config) (int, error) {
+	dstNames := make(map[string]bool, len(tables))
+	for _, table := range tables {
+		dstNames[strmap(table.Name, options.TableMap)] = true
+	}
+	dstTables := make(map[string]*common.Table, len(tables))
+	for _, table := range dr.FilteredTables(dstNames, nil) {
+		dstTables[table.Name] = table
+	}
+
+	differ := 0
+	for _, table := range withDestinationKeys(tables, options) {
+		dstName := strmap(table.Name, options.TableMap)
+
+		dst, ok := dstTables[dstName]
+		if !ok {
+			log.Println("converter: table", dstName, "is missing from the destination, creating it")
+			differ++
+
+			if err := w.CreateTable(table, dstName); err != nil {
+				return differ, err
+			}
+			if err := w.CreateIndices(table, dstName); err != nil {
+				return differ, err
+			}
+			if err := w.CreateConstraints(table, dstName); err != nil {
+				return differ, err
+			}
+			continue
+		}
+
+		d, err := w.EvolveTable(table, dst, dstName, drop)
+		if err != nil {
+			return differ, err
+		}
+		if d.Empty() {
+			continue
+		}
+		differ++
+
+		log.Printf("converter: table %v differs from the source, %v\n", dstName, d)
+	}
+
+	return differ, nil
 }
 
-func truncateTables(tables []*common.Table, w common.Writer) error {
+func truncateTables(tables []*common.Table, w common.Writer, st *State, options *Config) error {
+	for _, table := range tables {
+		if st.IsDone(table.Name, stepTruncate) {
+			continue
+		}
+
+		if VERBOSE {
+			log.Println("converter: truncating table", table.Name)
+		}
+
+		if err := w.Truncate(strmap(table.Name, options.TableMap)); err != nil {
+			return err
+		}
+		st.MarkDone(table.Name, stepTruncate)
+	}
+
 	return nil
 }
 
-func writeData(tables []*common.Table, w common.Writer) error {
-	return nil
+/* makes the tables merge on their merge_key if they have one, or else on
+ * their primary key or a unique key. The tables that have none of those
+ * can only be truncated and loaded again, if that's allowed, these are
+ * returned. */
+func mergeKeys(tables []*common.Table, options *Config) (map[string]bool, error) {
+	reload := make(map[string]bool)
+	for idx, table := range tables {
+		conf := options.Tables[table.Name]
+
+		key := conf.MergeKey
+		if len(key) == 0 {
+			key = table.MergeKey()
+		}
+		if len(key) > 0 {
+			keyed, err := table.WithKey(key)
+			if err != nil {
+				return nil, fmt.Errorf("converter: invalid merge_key, %v", err)
+			}
+			if VERBOSE {
+				log.Printf("converter: merging table %v on %v\n", table.Name, key)
+			}
+			tables[idx] = keyed
+			continue
+		}
+
+		if !options.ReloadWithoutKey {
+			return nil, fmt.Errorf("converter: table %v has no primary key or unique key "+
+				"(without NULLs) to merge on, give it a merge_key or set reload_without_key", table.Name)
+		}
+		if conf.Incremental != nil || conf.DeleteMissing || conf.SoftDelete != nil {
+			return nil, fmt.Errorf("converter: table %v has no key to merge on, it can't "+
+				"be synced incrementally or have its missing rows deleted", table.Name)
+		}
+		if meta, ok := options.Projections[table.Name]; ok && strings.TrimSpace(meta.Conditions) != "" {
+			return nil, fmt.Errorf("converter: projection %v has no key to merge on, reloading "+
+				"it would delete the destination rows outside of its destination_conditions", table.Name)
+		}
+
+		log.Println("converter: table", table.Name, "has no key to merge on, it will be truncated and loaded again")
+		reload[table.Name] = true
+	}
+
+	return reload, nil
 }
 
-func createIndices(tables []*common.Table, w common.Writer) error {
-	return nil
+/* restricts the tables that are synced incrementally to the rows that
+ * changed since the last sync, up to the current maximum of their watermark
+ * column. A resumed migration syncs up to the same maximum as the run it
+ * resumes. */
+func setWatermarks(tables []*common.Table, r common.Reader, st *State, options *Config) {
+	for _, table := range tables {
+		conf, ok := options.Tables[table.Name]
+		if !ok || conf.Incremental == nil {
+			continue
+		}
+
+		wm := &common.Watermark{
+			Column: conf.Incremental.Column,
+			From:   st.Watermark(table.Name),
+			To:     st.TargetWatermark(table.Name),
+		}
+
+		/* the destination was emptied, so everything has to be synced */
+		if options.Truncate {
+			wm.From = ""
+		}
+
+		if wm.To == "" {
+			max, err := r.Max(table, wm.Column)
+			if err != nil {
+				log.Println("converter: could not determine the watermark of table",
+					table.Name, "syncing all rows, error:", err)
+				continue
+			}
+			if max == "" {
+				/* an empty table, there's nothing to restrict */
+				continue
+			}
+			wm.To = max
+			st.SetTargetWatermark(table.Name, max)
+		}
+
+		if st == nil {
+			log.Println("converter: there's no state to keep the watermark of table",
+				table.Name, "in, syncing all rows up to", wm.To)
+		}
+
+		if VERBOSE {
+			log.Printf("converter: syncing table %v from %v = '%v' up to '%v'\n",
+				table.Name, wm.Column, wm.From, wm.To)
+		}
+		table.Watermark = wm
+	}
 }
 
-func createConstraints(tables []*common.Table, w common.Writer) error {
-	return nil
+/* splits the tables into chunks if a chunk size was given, tables that
+ * can't be split become a single task. A resumed migration reuses the
+ * chunks of the earlier run. */
+func chunkTables(tables []*common.Table, r common.Reader, st *State, options *Config) []task {
+	tasks := make([]task, 0, len(tables))
+	for _, table := range tables {
+		chunks := st.Chunks(table.Name)
+		if chunks == nil && options.ChunkSize > 0 {
+			var err error
+			chunks, err = r.Chunks(table, options.ChunkSize)
+			if err != nil {
+				log.Println("converter: could not split table", table.Name,
+					"into chunks, reading it whole, error:", err)
+			}
+			if len(chunks) > 0 {
+				st.SetChunks(table.Name, chunks)
+			}
+		}
+
+		if len(chunks) == 0 {
+			tasks = append(tasks, task{table, nil})
+			continue
+		}
+
+		if VERBOSE {
+			log.Printf("converter: split table %v into %v chunks\n", table.Name, len(chunks))
+		}
+		for _, chunk := range chunks {
+			tasks = append(tasks, task{table, chunk})
+		}
+	}
+
+	return tasks
+}
+
+/* the destination enforces its foreign keys while merging (unless the
+ * writer turns them off), so referenced tables go first. What the merge
+ * did is reported per table, summed over the chunks. The tables in reload
+ * are emptied and written instead, they can't be chunked as they have no
+ * key. */
+func mergeData(tasks []task, p *pool, pinned, reload map[string]bool, st *State, options *Config) error {
+	var mu sync.Mutex
+	stats := make(map[string]*common.MergeStats)
+
+	err := p.Run(tasks, pinned, true, func(c *conn, t task) error {
+		if isTaskDone(st, stepMerge, t) {
+			return nil
+		}
+
+		if reload[t.table.Name] {
+			dstName := strmap(t.table.Name, options.TableMap)
+			if VERBOSE {
+				log.Println("converter: reloading table", t)
+			}
+			if err := c.w.Truncate(dstName); err != nil {
+				return err
+			}
+			if err := c.w.WriteTable(t.table, dstName, c.r, nil); err != nil {
+				return err
+			}
+			markTaskDone(st, stepMerge, t)
+			return nil
+		}
+
+		/* is this table a projection? */
+		strategy, _ := common.ParseMergeStrategy(options.MergeStrategy)
+		opts := &common.MergeOptions{Strategy: strategy}
+		if meta, ok := options.Projections[t.table.Name]; ok {
+			opts.DstCondition = meta.Conditions
+		}
+		if tc, ok := options.Tables[t.table.Name]; ok {
+			opts.DeleteMissing = tc.DeleteMissing || tc.SoftDelete != nil
+			if tc.SoftDelete != nil {
+				opts.SoftDelete = &common.SoftDelete{
+					Column: tc.SoftDelete.Column,
+					Value:  tc.SoftDelete.Value,
+				}
+			}
+		}
+
+		if VERBOSE {
+			log.Println("converter: merging table", t)
+		}
+
+		s, err := c.w.MergeTable(t.table, strmap(t.table.Name, options.TableMap), opts, c.r, t.chunk)
+		if err == nil {
+			markTaskDone(st, stepMerge, t)
+		}
+		if s != nil {
+			mu.Lock()
+			if stats[t.table.Name] == nil {
+				stats[t.table.Name] = &common.MergeStats{}
+			}
+			stats[t.table.Name].Add(s)
+			mu.Unlock()
+		}
+		return err
+	})
+
+	for _, t := range tasks {
+		if s, ok := stats[t.table.Name]; ok {
+			log.Printf("converter: merged table %v, %v\n", t.table.Name, s)
+			delete(stats, t.table.Name)
+		}
+	}
+
+	return err
+}
+
+/* the constraints are only added after the load, so the tables can be
+ * loaded in any order */
+func writeData(tasks []task, p *pool, pinned map[string]bool, st *State, options *Config) error {
+	return p.Run(tasks, pinned, false, func(c *conn, t task) error {
+		if isTaskDone(st, stepData, t) {
+			return nil
+		}
+
+		if VERBOSE {
+			log.Println("converter: writing table", t)
+		}
+
+		err := c.w.WriteTable(t.table, strmap(t.table.Name, options.TableMap), c.r, t.chunk)
+		if err == nil {
+			markTaskDone(st, stepData, t)
+		}
+		return err
+	})
+}
+
+func createIndices(tasks []task, p *pool, pinned map[string]bool, st *State, options *Config) error {
+	return p.Run(tasks, pinned, false, func(c *conn, t task) error {
+		if isTaskDone(st, stepIndices, t) {
+			return nil
+		}
+
+		if VERBOSE {
+			log.Println("converter: creating indices of table", t)
+		}
+
+		err := c.w.CreateIndices(t.table, strmap(t.table.Name, options.TableMap))
+		if err == nil {
+			markTaskDone(st, stepIndices, t)
+		}
+		return err
+	})
+}
+
+/* a foreign key needs the key it references to be there, so the tables are
+ * scheduled after the tables they reference. The original tables are used
+ * for scheduling, as those refer to each other by their source names. */
+func createConstraints(tables []*common.Table, p *pool, pinned map[string]bool, st *State, options *Config) error {
+	mapped := make(map[*common.Table]*common.Table)
+	for idx, table := range withDestinationKeys(tables, options) {
+		mapped[tables[idx]] = table
+	}
+
+	return p.Run(tableTasks(tables), pinned, true, func(c *conn, t task) error {
+		if isTaskDone(st, stepConstraints, t) {
+			return nil
+		}
+
+		if VERBOSE {
+			log.Println("converter: creating constraints of table", t)
+		}
+
+		err := c.w.CreateConstraints(mapped[t.table], strmap(t.table.Name, options.TableMap))
+		if err == nil {
+			markTaskDone(st, stepConstraints, t)
+		}
+		return err
+	})
 }
@@ -0,0 +1,110 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+type ChangeKind int
+
+const (
+	ChangeInsert ChangeKind = iota
+	ChangeUpdate
+	ChangeDelete
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeInsert:
+		return "insert"
+	case ChangeUpdate:
+		return "update"
+	default:
+		return "delete"
+	}
+}
+
+/* a change to a row of a source table, as captured from the change log of
+ * the source. Before is the row before the change (updates and deletes),
+ * After the row after it (inserts and updates). They have a value per
+ * column of the table, in the format the reader would have returned it in,
+ * nil for NULL. */
+type Change struct {
+	Kind    ChangeKind
+	Table   *Table
+	DstName string
+	Before  [][]byte
+	After   [][]byte
+}
+
+func (c *Change) String() string {
+	return fmt.Sprintf("%v of a row of table %v", c.Kind, c.Table.Name)
+}
+
+/* the indices of the columns that identify a row: the primary key, or all
+ * columns if there is none */
+func (c *Change) KeyColumns() []int {
+	key := make([]int, 0, 2)
+	for idx, col := range c.Table.Columns {
+		if col.PrimaryKey {
+			key = append(key, idx)
+		}
+	}
+	if len(key) > 0 {
+		return key
+	}
+
+	for idx := range c.Table.Columns {
+		key = append(key, idx)
+	}
+	return key
+}
+
+/* whether an update moved the row to another key */
+func (c *Change) KeyChanged() bool {
+	if c.Kind != ChangeUpdate {
+		return false
+	}
+	for _, idx := range c.KeyColumns() {
+		before, after := c.Before[idx], c.After[idx]
+		if (before == nil) != (after == nil) || string(before) != string(after) {
+			return true
+		}
+	}
+	return false
+}
+
+/* turns a value into an SQL literal, like RawToPostgres() */
+type Literal func(val []byte, t *Type) (string, error)
+
+/* the literals of all values of a row */
+func RowLiterals(table *Table, vals [][]byte, literal Literal) ([]string, error) {
+	lits := make([]string, 0, len(vals))
+	for idx, val := range vals {
+		lit, err := literal(val, table.Columns[idx].Type)
+		if err != nil {
+			return nil, err
+		}
+		lits = append(lits, lit)
+	}
+	return lits, nil
+}
+
+/* the WHERE condition that selects the row with the key columns of vals */
+func RowCondition(c *Change, vals [][]byte, quote func(name string) string, literal Literal) (string, error) {
+	conds := make([]string, 0, 2)
+	for _, idx := range c.KeyColumns() {
+		col := c.Table.Columns[idx]
+		if vals[idx] == nil {
+			conds = append(conds, quote(col.Name)+" IS NULL")
+			continue
+		}
+
+		lit, err := literal(vals[idx], col.Type)
+		if err != nil {
+			return "", err
+		}
+		conds = append(conds, fmt.Sprintf("%v = %v", quote(col.Name), lit))
+	}
+	return strings.Join(conds, " AND "), nil
+}
@@ -0,0 +1,155 @@
+package common
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* a checksum of a set of rows that doesn't depend on their order, the sum
+ * of the hashes of the rows. The values are normalized first, so the rows
+ * of different kinds of databases can be compared. */
+type Checksum struct {
+	Rows int64
+	Sum  uint64
+}
+
+func (c Checksum) Equal(o Checksum) bool {
+	return c.Rows == o.Rows && c.Sum == o.Sum
+}
+
+/* computes the checksum of rows, with the columns of table in the order of
+ * the table. The rows can have their columns in any order and have other
+ * columns as well, these are ignored. */
+func ChecksumRows(rows *sql.Rows, table *Table) (Checksum, error) {
+	var sum Checksum
+
+	names, err := rows.Columns()
+	if err != nil {
+		return sum, err
+	}
+	position := make(map[string]int, len(names))
+	for idx, name := range names {
+		position[name] = idx
+	}
+
+	order := make([]int, 0, len(table.Columns))
+	for _, col := range table.Columns {
+		idx, ok := position[col.Name]
+		if !ok {
+			return sum, fmt.Errorf("column %v is missing", col.Name)
+		}
+		order = append(order, idx)
+	}
+
+	pointers := make([]interface{}, len(names))
+	containers := make([]sql.RawBytes, len(names))
+	for i := range pointers {
+		pointers[i] = &containers[i]
+	}
+
+	h := fnv.New64a()
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return sum, err
+		}
+
+		h.Reset()
+		for idx, col := range table.Columns {
+			val := containers[order[idx]]
+			if val == nil {
+				h.Write([]byte{0})
+				continue
+			}
+			h.Write([]byte{1})
+			h.Write([]byte(NormalizeValue(val, col.Type)))
+			h.Write([]byte{0})
+		}
+
+		sum.Rows++
+		sum.Sum += h.Sum64()
+	}
+
+	return sum, rows.Err()
+}
+
+var timestampLayouts = []string{
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z07",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+}
+
+/* the text of a (non-NULL) value as it would look in any database, e.g.
+ * booleans as 0 and 1, numbers without superfluous zeroes, bits as a bit
+ * string and timestamps in UTC. Values that can't be interpreted are left
+ * alone. */
+func NormalizeValue(val []byte, t *Type) string {
+	str := string(val)
+
+	switch t.Name {
+	case TypeBool:
+		switch strings.ToLower(str) {
+		case "1", "t", "true":
+			return "1"
+		case "0", "f", "false":
+			return "0"
+		}
+	case TypeInteger:
+		return strings.TrimPrefix(strings.TrimSpace(str), "+")
+	case TypeNumeric:
+		str = strings.TrimPrefix(strings.TrimSpace(str), "+")
+		if strings.Contains(str, ".") {
+			str = strings.TrimRight(strings.TrimRight(str, "0"), ".")
+		}
+		if str == "-0" || str == "" {
+			return "0"
+		}
+		return str
+	case TypeFloat, TypeDouble:
+		/* the databases round trip floats with different precisions */
+		f, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+		if err != nil {
+			return str
+		}
+		if t.Name == TypeFloat {
+			return strconv.FormatFloat(f, 'g', 6, 64)
+		}
+		return strconv.FormatFloat(f, 'g', 15, 64)
+	case TypeChar:
+		return strings.TrimRight(str, " ")
+	case TypeBit:
+		return BitString(val, t.Max)
+	case TypeDate:
+		if len(str) >= 10 {
+			return str[:10]
+		}
+	case TypeTime:
+		if strings.Contains(str, ".") {
+			return strings.TrimRight(strings.TrimRight(str, "0"), ".")
+		}
+	case TypeTimeStamp:
+		for _, layout := range timestampLayouts {
+			if ts, err := time.Parse(layout, str); err == nil {
+				return ts.UTC().Format("2006-01-02 15:04:05.999999")
+			}
+		}
+	case TypeJson:
+		/* MySQL stores objects with their keys sorted, and neither
+		 * keeps the whitespace */
+		var v interface{}
+		if err := json.Unmarshal(val, &v); err != nil {
+			return str
+		}
+		if b, err := json.Marshal(v); err == nil {
+			return string(b)
+		}
+	}
+
+	return str
+}
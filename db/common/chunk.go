@@ -0,0 +1,222 @@
+package common
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+/* a range of rows of a table, along its primary key. The bounds are the
+ * values of the primary key columns, in string form, Lower is exclusive and
+ * Upper inclusive. The first chunk of a table has no Lower bound and the
+ * last one no Upper bound. */
+type Chunk struct {
+	Index int      `json:"index"`
+	Lower []string `json:"lower"`
+	Upper []string `json:"upper"`
+}
+
+func (c *Chunk) String() string {
+	bound := func(key []string) string {
+		if key == nil {
+			return "..."
+		}
+		return strings.Join(key, "/")
+	}
+	return fmt.Sprintf("chunk %v (%v, %v]", c.Index, bound(c.Lower), bound(c.Upper))
+}
+
+/* the columns a table can be chunked on: an integer primary key or a
+ * composite one. Returns nil if the table can't be chunked. */
+func ChunkKey(table *Table) []string {
+	key := make([]string, 0, 2)
+	var single *Column
+	for _, col := range table.Columns {
+		if col.PrimaryKey {
+			key = append(key, col.Name)
+			single = col
+		}
+	}
+
+	switch {
+	case len(key) == 0:
+		return nil
+	case len(key) == 1 && single.Type.Name != TypeInteger:
+		return nil
+	}
+	return key
+}
+
+/* reads the whole table if c is nil, only the rows of the chunk otherwise */
+func ReadRows(r Reader, table *Table, c *Chunk) (*sql.Rows, error) {
+	if c == nil {
+		return r.Read(table)
+	}
+	return r.ReadChunk(table, c)
+}
+
+/* how a backend writes its SQL, used to build the chunking queries */
+type Dialect struct {
+	/* quotes an identifier */
+	Quote func(name string) string
+
+	/* the placeholder for the n'th (starting at 1) argument */
+	Placeholder func(n int) string
+}
+
+/* splits the table into chunks of (at most) size rows, by walking the
+ * primary key index: the upper bound of a chunk is the size'th key after
+ * the upper bound of the previous one. Only the rows between the watermarks
+ * of the table count. Returns nil if the table can't be chunked. */
+func ChunkTable(q Queryer, d Dialect, table *Table, size int) ([]*Chunk, error) {
+	key := ChunkKey(table)
+	if key == nil || size <= 0 {
+		return nil, nil
+	}
+
+	quoted := make([]string, 0, len(key))
+	for _, col := range key {
+		quoted = append(quoted, d.Quote(col))
+	}
+	cols := strings.Join(quoted, ", ")
+
+	chunks := make([]*Chunk, 0, 8)
+	var lower []string
+	for {
+		conds := make([]string, 0, 2)
+		args := make([]interface{}, 0, 4)
+		if lower != nil {
+			cond, condArgs := KeysetCondition(d, key, lower, ">", 0)
+			conds = append(conds, cond)
+			args = append(args, condArgs...)
+		}
+		if table.Watermark != nil {
+			cond, condArgs := WatermarkCondition(d, table.Watermark, len(args))
+			conds = append(conds, cond)
+			args = append(args, condArgs...)
+		}
+
+		query := fmt.Sprintf("SELECT %v FROM %v", cols, d.Quote(table.Name))
+		if len(conds) > 0 {
+			query += " WHERE " + strings.Join(conds, " AND ")
+		}
+		query += fmt.Sprintf(" ORDER BY %v LIMIT 1 OFFSET %v;", cols, size-1)
+
+		upper, err := scanKey(q, query, args, len(key))
+		if err != nil {
+			return nil, err
+		}
+
+		chunks = append(chunks, &Chunk{Index: len(chunks), Lower: lower, Upper: upper})
+		if upper == nil {
+			break
+		}
+		lower = upper
+	}
+
+	return chunks, nil
+}
+
+/* returns nil if the query returns no row */
+func scanKey(q Queryer, query string, args []interface{}, n int) ([]string, error) {
+	vals := make([]sql.NullString, n)
+	ptrs := make([]interface{}, n)
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+
+	err := q.QueryRow(query, args...).Scan(ptrs...)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	key := make([]string, 0, n)
+	for _, val := range vals {
+		key = append(key, val.String)
+	}
+	return key, nil
+}
+
+/* the WHERE condition that selects the rows of a chunk, and its arguments.
+ * Returns an empty condition if the chunk has no bounds. */
+func ChunkCondition(d Dialect, table *Table, c *Chunk) (string, []interface{}) {
+	args := make([]interface{}, 0, 2*len(ChunkKey(table)))
+	cond := chunkCondition(d.Quote, table, c, func(col, val string) string {
+		args = append(args, val)
+		return d.Placeholder(len(args))
+	})
+	return cond, args
+}
+
+/* like ChunkCondition(), but with the bounds as literals, for the writers,
+ * which submit their statements as text */
+func ChunkLiteralCondition(quote func(name string) string, table *Table, c *Chunk, literal Literal) (string, error) {
+	types := make(map[string]*Type)
+	for _, col := range table.Columns {
+		types[col.Name] = col.Type
+	}
+
+	var err error
+	cond := chunkCondition(quote, table, c, func(col, val string) string {
+		lit, litErr := literal([]byte(val), types[col])
+		if err == nil {
+			err = litErr
+		}
+		return lit
+	})
+	return cond, err
+}
+
+func chunkCondition(quote func(name string) string, table *Table, c *Chunk, arg func(col, val string) string) string {
+	key := ChunkKey(table)
+	conds := make([]string, 0, 2)
+
+	if c.Lower != nil {
+		conds = append(conds, keysetCondition(quote, key, c.Lower, ">", arg))
+	}
+	if c.Upper != nil {
+		conds = append(conds, keysetCondition(quote, key, c.Upper, "<=", arg))
+	}
+
+	return strings.Join(conds, " AND ")
+}
+
+/* compares the key columns to vals in lexicographic order, op is one of
+ * >, >=, < or <=. Row values like (a, b) > (1, 2) would be shorter, but
+ * not every database uses an index for them, so the comparison is spelled
+ * out: a > 1 OR (a = 1 AND b > 2). The placeholders are numbered after
+ * offset. */
+func KeysetCondition(d Dialect, key, vals []string, op string, offset int) (string, []interface{}) {
+	args := make([]interface{}, 0, len(key)*(len(key)+1)/2)
+	cond := keysetCondition(d.Quote, key, vals, op, func(col, val string) string {
+		args = append(args, val)
+		return d.Placeholder(offset + len(args))
+	})
+	return cond, args
+}
+
+/* arg returns what to compare a column with */
+func keysetCondition(quote func(name string) string, key, vals []string, op string, arg func(col, val string) string) string {
+	strict := strings.TrimSuffix(op, "=")
+
+	terms := make([]string, 0, len(key))
+	for i := range key {
+		parts := make([]string, 0, i+1)
+		for j := 0; j < i; j++ {
+			parts = append(parts, fmt.Sprintf("%v = %v", quote(key[j]), arg(key[j], vals[j])))
+		}
+
+		cmp := strict
+		if i == len(key)-1 {
+			cmp = op
+		}
+		parts = append(parts, fmt.Sprintf("%v %v %v", quote(key[i]), cmp, arg(key[i], vals[i])))
+
+		terms = append(terms, "("+strings.Join(parts, " AND ")+")")
+	}
+
+	return "(" + strings.Join(terms, " OR ") + ")"
+}
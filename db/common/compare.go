@@ -0,0 +1,101 @@
+package common
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+)
+
+/* scans rows into values that can be compared across databases. Like
+ * NewTypedSlice, the SQL driver converts the values to the Go type of
+ * their generic type (so a MySQL tinyint(1) and a postgres boolean both
+ * become a bool), but any value can be NULL as the databases might not
+ * agree on that. The types that have no Go equivalent are normalized with
+ * NormalizeValue. */
+type RowScanner struct {
+	table *Table
+
+	/* for every column of the table, its position in the rows */
+	order []int
+	dest  []interface{}
+}
+
+/* the rows can have their columns in any order and have other columns as
+ * well, the values are returned in the order of the columns of table */
+func NewRowScanner(rows *sql.Rows, table *Table) (*RowScanner, error) {
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	position := make(map[string]int, len(names))
+	for idx, name := range names {
+		position[name] = idx
+	}
+
+	s := &RowScanner{table: table, dest: make([]interface{}, len(names))}
+	for i := range s.dest {
+		s.dest[i] = new(sql.RawBytes)
+	}
+	for _, col := range table.Columns {
+		idx, ok := position[col.Name]
+		if !ok {
+			return nil, fmt.Errorf("column %v is missing", col.Name)
+		}
+		s.order = append(s.order, idx)
+
+		switch col.Type.Name {
+		case TypeBool:
+			s.dest[idx] = new(sql.NullBool)
+		case TypeInteger:
+			/* a bigint unsigned doesn't fit an int64, those are
+			 * compared as strings (see NormalizeValue) */
+			if col.Type.Modifier == TypeHuge {
+				s.dest[idx] = new(sql.NullString)
+			} else {
+				s.dest[idx] = new(sql.NullInt64)
+			}
+		case TypeFloat, TypeDouble:
+			s.dest[idx] = new(sql.NullFloat64)
+		case TypeBlob:
+			s.dest[idx] = new([]byte)
+		default:
+			s.dest[idx] = new(sql.NullString)
+		}
+	}
+
+	return s, nil
+}
+
+/* scans the current row, the values are nil (NULL), bool, int64, float64
+ * or string. Binary values are hex encoded, prefixed with \x, bits are a
+ * bit string like verify compares them. */
+func (s *RowScanner) Scan(rows *sql.Rows) ([]interface{}, error) {
+	if err := rows.Scan(s.dest...); err != nil {
+		return nil, err
+	}
+
+	vals := make([]interface{}, 0, len(s.order))
+	for i, col := range s.table.Columns {
+		switch v := s.dest[s.order[i]].(type) {
+		case *sql.NullBool:
+			vals = append(vals, nullable(v.Valid, v.Bool))
+		case *sql.NullInt64:
+			vals = append(vals, nullable(v.Valid, v.Int64))
+		case *sql.NullFloat64:
+			vals = append(vals, nullable(v.Valid, v.Float64))
+		case *[]byte:
+			vals = append(vals, nullable(*v != nil, `\x`+hex.EncodeToString(*v)))
+		case *sql.NullString:
+			vals = append(vals, nullable(v.Valid, NormalizeValue([]byte(v.String), col.Type)))
+		}
+	}
+
+	return vals, nil
+}
+
+func nullable(valid bool, v interface{}) interface{} {
+	if !valid {
+		return nil
+	}
+	return v
+}
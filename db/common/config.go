@@ -1,5 +1,9 @@
 package common
 
+import (
+	"sort"
+)
+
 type Config struct {
 	Hostname string `yaml:"hostname,omitempty"`
 	Socket   string `yaml:"socket,omitempty"`
@@ -8,4 +12,19 @@ type Config struct {
 	Password string `yaml:"password,omitempty"`
 	Database string `yaml:"database,omitempty"`
 	Compress bool   `yaml:"compress,omitempty"`
+
+	/* driver-specific connection options, these are passed on to the
+	 * underlying database driver as-is (e.g. sslmode for postgres) */
+	Options map[string]string `yaml:"options,omitempty"`
+}
+
+/* the keys of the driver-specific options, sorted so that connection
+ * strings are deterministic */
+func (c *Config) OptionKeys() []string {
+	keys := make([]string, 0, len(c.Options))
+	for key := range c.Options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
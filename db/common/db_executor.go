@@ -68,25 +68,26 @@ func (e *DbExecutor) Rollback() error {
 	return rerr
 }
 
-func (e *DbExecutor) submitSimple(stmt string) error {
-	if _, err := e.db.Exec(stmt); err != nil {
+func (e *DbExecutor) submitSimple(stmt string) (sql.Result, error) {
+	res, err := e.db.Exec(stmt)
+	if err != nil {
 		err = e.err(err)
-		return fmt.Errorf("'%v' while executing statement\n'%v'", err, stmt)
+		return nil, fmt.Errorf("'%v' while executing statement\n'%v'", err, stmt)
 	}
-	return nil
+	return res, nil
 }
 
-func (e *DbExecutor) submitTransactional(stmt string) error {
-	_, err := e.tx.Exec(stmt)
+func (e *DbExecutor) submitTransactional(stmt string) (sql.Result, error) {
+	res, err := e.tx.Exec(stmt)
 	if err != nil {
 		err = e.err(err)
 		e.Rollback()
-		return fmt.Errorf("'%v' while executing statement\n%v in transaction", err, stmt)
+		return nil, fmt.Errorf("'%v' while executing statement\n%v in transaction", err, stmt)
 	}
-	return nil
+	return res, nil
 }
 
-func (e *DbExecutor) Submit(stmt string) error {
+func (e *DbExecutor) submit(stmt string) (sql.Result, error) {
 	if DBEXEC_VERBOSE {
 		log.Println(stmt)
 	}
@@ -98,6 +99,42 @@ func (e *DbExecutor) Submit(stmt string) error {
 	}
 }
 
+func (e *DbExecutor) Submit(stmt string) error {
+	_, err := e.submit(stmt)
+	return err
+}
+
+func (e *DbExecutor) SubmitCount(stmt string) (int64, error) {
+	res, err := e.submit(stmt)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, e.err(err)
+	}
+	return n, nil
+}
+
+/* like Submit, an error rolls back the transaction in progress */
+func (e *DbExecutor) QueryRow(query string, dest ...interface{}) error {
+	if DBEXEC_VERBOSE {
+		log.Println(query)
+	}
+
+	var err error
+	if e.tx == nil {
+		err = e.db.QueryRow(query).Scan(dest...)
+	} else if err = e.tx.QueryRow(query).Scan(dest...); err != nil {
+		e.Rollback()
+	}
+	if err != nil {
+		return fmt.Errorf("'%v' while executing query\n%v", e.err(err), query)
+	}
+	return nil
+}
+
 func (e *DbExecutor) Multiple(name string, statements []string) []error {
 	errors := make([]error, 0, len(statements))
 
@@ -153,7 +190,7 @@ func (e *DbExecutor) BulkFinish() error {
 
 func (e *DbExecutor) HasCapability(capability int) bool {
 	/* return capability == CapBulkTransfer */
-	return false
+	return capability == CapResults
 }
 
 func (e *DbExecutor) GetDb() *sql.DB {
@@ -0,0 +1,103 @@
+package common
+
+import (
+	"strings"
+)
+
+/* how the columns of a destination table differ from those of the source
+ * table it's migrated from */
+type SchemaDiff struct {
+	/* the source columns the destination lacks */
+	Added []*Column
+
+	/* the destination columns the source lacks */
+	Dropped []*Column
+
+	/* the source columns whose type or nullability differs in the
+	 * destination */
+	Changed []*ColumnChange
+}
+
+/* a column that is in both tables, but differs */
+type ColumnChange struct {
+	/* the column as it is in the source */
+	Column *Column
+
+	Type bool
+	Null bool
+}
+
+func (d *SchemaDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Dropped) == 0 && len(d.Changed) == 0
+}
+
+/* compares the columns of two tables by name. The types are compared as
+ * the destination declares them, typeName maps a generic type to a type of
+ * the destination, so types it doesn't tell apart don't count as a change.
+ * The nullability of primary key columns isn't compared, as some databases
+ * make them NOT NULL regardless. */
+func DiffColumns(src, dst *Table, typeName func(t *Type) string) *SchemaDiff {
+	dstCols := make(map[string]*Column, len(dst.Columns))
+	for _, col := range dst.Columns {
+		dstCols[col.Name] = col
+	}
+	srcCols := make(map[string]bool, len(src.Columns))
+
+	d := &SchemaDiff{}
+	for _, col := range src.Columns {
+		srcCols[col.Name] = true
+
+		other, ok := dstCols[col.Name]
+		if !ok {
+			d.Added = append(d.Added, col)
+			continue
+		}
+
+		change := &ColumnChange{
+			Column: col,
+			Type:   typeName(col.Type) != typeName(other.Type),
+			Null:   !col.PrimaryKey && !other.PrimaryKey && col.Null != other.Null,
+		}
+		if change.Type || change.Null {
+			d.Changed = append(d.Changed, change)
+		}
+	}
+
+	for _, col := range dst.Columns {
+		if !srcCols[col.Name] {
+			d.Dropped = append(d.Dropped, col)
+		}
+	}
+
+	return d
+}
+
+/* the names of the columns, per kind of change */
+func (d *SchemaDiff) String() string {
+	parts := make([]string, 0, 3)
+	if len(d.Added) > 0 {
+		parts = append(parts, "added: "+columnNames(d.Added))
+	}
+	if len(d.Changed) > 0 {
+		cols := make([]*Column, 0, len(d.Changed))
+		for _, c := range d.Changed {
+			cols = append(cols, c.Column)
+		}
+		parts = append(parts, "changed: "+columnNames(cols))
+	}
+	if len(d.Dropped) > 0 {
+		parts = append(parts, "not in the source: "+columnNames(d.Dropped))
+	}
+	if len(parts) == 0 {
+		return "no differences"
+	}
+	return strings.Join(parts, "; ")
+}
+
+func columnNames(cols []*Column) string {
+	names := make([]string, 0, len(cols))
+	for _, col := range cols {
+		names = append(names, col.Name)
+	}
+	return strings.Join(names, ", ")
+}
@@ -8,6 +8,10 @@ import (
 
 const (
 	CapBulkTransfer = iota
+
+	/* the executor can tell how many rows a statement affected, and run
+	 * queries (a file can't) */
+	CapResults
 )
 
 var (
@@ -24,10 +28,23 @@ type Executor interface {
 	Begin(name string) error
 	Commit() error
 
+	/* abort the transaction in progress, after which it is no longer in
+	 * progress */
+	Rollback() error
+
 	/* if the statement provokes an error, will automatically rollback,
 	 * after which the transaction is no longer in progress */
 	Submit(stmt string) error
 
+	/* like Submit, but also returns the number of rows the statement
+	 * affected, or -1 without CapResults */
+	SubmitCount(stmt string) (int64, error)
+
+	/* run a query that returns a single row and scan it into dest, in the
+	 * transaction that is in progress (if any). Without CapResults it
+	 * returns ErrCapNotSupported and nothing is submitted. */
+	QueryRow(query string, dest ...interface{}) error
+
 	/* bulk statements for copying large amounts of data, the underlying
 	 * implementation will try to use the most efficient way of achieving this,
 	 * for example postgres' COPY FROM semantics. */
@@ -4,7 +4,7 @@ import (
 	"bufio"
 	"database/sql"
 	"fmt"
-	"os"
+	"io"
 )
 
 const (
@@ -13,20 +13,17 @@ const (
 	SRollback = "ROLLBACK"
 )
 
+/* writes the statements to an io.Writer instead of executing them */
 type FileExecutor struct {
-	f *os.File
-	w *bufio.Writer
+	out io.Writer
+	w   *bufio.Writer
 
 	txInProgress bool
 }
 
-func NewFileExecutor(filename string) (*FileExecutor, error) {
-	fo, err := os.Create(filename)
-	if err != nil {
-		return nil, err
-	}
-
-	return &FileExecutor{fo, bufio.NewWriter(fo), false}, nil
+/* if out is an io.Closer, it's closed together with the executor */
+func NewFileExecutor(out io.Writer) *FileExecutor {
+	return &FileExecutor{out, bufio.NewWriter(out), false}
 }
 
 func (e *FileExecutor) Begin(name string) error {
@@ -57,11 +54,30 @@ func (e *FileExecutor) Commit() error {
 	return err
 }
 
+func (e *FileExecutor) Rollback() error {
+	if !e.txInProgress {
+		return ErrNoTxInProgress
+	}
+	e.txInProgress = false
+
+	/* abort transaction */
+	_, err := e.w.WriteString(SRollback + ";\n\n")
+	return err
+}
+
 func (e *FileExecutor) Submit(stmt string) error {
 	_, err := e.w.WriteString(stmt + "\n")
 	return err
 }
 
+func (e *FileExecutor) SubmitCount(stmt string) (int64, error) {
+	return -1, e.Submit(stmt)
+}
+
+func (e *FileExecutor) QueryRow(query string, dest ...interface{}) error {
+	return ErrCapNotSupported
+}
+
 func (e *FileExecutor) Transaction(name string, statements []string) error {
 	err := e.Begin(name)
 	if err != nil {
@@ -141,10 +157,11 @@ func (e *FileExecutor) GetTx() *sql.Tx {
 
 func (e *FileExecutor) Close() error {
 	err := e.w.Flush()
-	if err != nil {
-		defer e.f.Close()
-		return err
-	}
 
-	return e.f.Close()
+	if c, ok := e.out.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
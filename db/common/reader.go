@@ -20,7 +20,24 @@ type Reader interface {
 	Tables() []*Table
 	FilteredTables(incl, excl map[string]bool) []*Table
 
+	/* reads the rows of a table, only the ones between its watermarks
+	 * if it has them */
 	Read(table *Table) (*sql.Rows, error)
+
+	/* split a table into chunks of (at most) size rows along its primary
+	 * key, so it can be read piece by piece with ReadChunk(). Returns nil
+	 * if the table can't be split. */
+	Chunks(table *Table, size int) ([]*Chunk, error)
+	ReadChunk(table *Table, c *Chunk) (*sql.Rows, error)
+
+	/* the current maximum of a column, as a string (empty if the table
+	 * is empty), used for the watermarks of incremental syncs */
+	Max(table *Table, column string) (string, error)
+
+	/* the number of rows of a table, taken from the statistics of the
+	 * database if it keeps them, so it can be off */
+	EstimateRows(table *Table) (int64, error)
+
 	CreateView(name string, body string) error
 	DropView(name string) error
 
@@ -32,3 +49,33 @@ type ReadCloser interface {
 	io.Closer
 	Reader
 }
+
+/* sets the comments of a table and its columns from the rows of a query
+ * that returns the column name (empty for the table itself) and the
+ * comment */
+func ReadComments(q Queryer, table *Table, query string, args ...interface{}) error {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var name, comment string
+	for rows.Next() {
+		if err := rows.Scan(&name, &comment); err != nil {
+			return err
+		}
+
+		if name == "" {
+			table.Comment = comment
+			continue
+		}
+		for _, col := range table.Columns {
+			if col.Name == name {
+				col.Comment = comment
+			}
+		}
+	}
+
+	return rows.Err()
+}
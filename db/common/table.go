@@ -1,9 +1,27 @@
 package common
 
+import (
+	"fmt"
+	"strings"
+)
+
 type Table struct {
-	Name    string
-	DbType  string /* mysql, postgres, sqlite, ... */
-	Columns []*Column
+	Name        string
+	DbType      string /* mysql, postgres, sqlite, ... */
+	Columns     []*Column
+	Indices     []*Index
+	UniqueKeys  []*UniqueKey
+	ForeignKeys []*ForeignKey
+
+	/* if set, only the rows between the watermarks are read */
+	Watermark *Watermark
+
+	/* if set, only the rows that satisfy this condition (in the SQL of
+	 * the database the table is in, on the row aliased dst) are read */
+	Filter string
+
+	/* the comment on the table, empty if it has none */
+	Comment string
 }
 
 type Column struct {
@@ -20,4 +38,119 @@ type Column struct {
 
 	/* how to select the column */
 	Select string
+
+	/* the comment on the column, empty if it has none */
+	Comment string
+}
+
+/* a secondary index, the primary key is described by the columns */
+type Index struct {
+	Name    string
+	Columns []string
+}
+
+/* a unique constraint, or a unique index (which amounts to the same) */
+type UniqueKey struct {
+	Name    string
+	Columns []string
+}
+
+/* a foreign key of a table, the referenced table is named as it is in the
+ * source database */
+type ForeignKey struct {
+	Name       string
+	Columns    []string
+	RefTable   string
+	RefColumns []string
+
+	/* the referential actions, in SQL syntax: NO ACTION, RESTRICT,
+	 * CASCADE, SET NULL or SET DEFAULT */
+	OnDelete string
+	OnUpdate string
+}
+
+/* the names of the primary key columns, empty if there is no primary key */
+func (t *Table) PrimaryKey() []string {
+	cols := make([]string, 0, 2)
+	for _, col := range t.Columns {
+		if col.PrimaryKey {
+			cols = append(cols, col.Name)
+		}
+	}
+	return cols
+}
+
+/* the key the rows of the table can be merged on: the primary key, or else
+ * the first unique key whose columns can't be NULL (NULLs never match).
+ * Empty if there is none. */
+func (t *Table) MergeKey() []string {
+	if pk := t.PrimaryKey(); len(pk) > 0 {
+		return pk
+	}
+
+	nullable := make(map[string]bool, len(t.Columns))
+	for _, col := range t.Columns {
+		nullable[col.Name] = col.Null
+	}
+
+nextKey:
+	for _, uk := range t.UniqueKeys {
+		for _, name := range uk.Columns {
+			if null, ok := nullable[name]; !ok || null {
+				continue nextKey
+			}
+		}
+		return uk.Columns
+	}
+
+	return nil
+}
+
+/* a copy of the table with another primary key, so the writers merge on
+ * those columns. The columns are copied as well, the rest is shared. */
+func (t *Table) WithKey(key []string) (*Table, error) {
+	inKey := make(map[string]bool, len(key))
+	for _, name := range key {
+		inKey[name] = true
+	}
+
+	keyed := *t
+	keyed.Columns = make([]*Column, 0, len(t.Columns))
+	for _, col := range t.Columns {
+		c := *col
+		c.PrimaryKey = inKey[col.Name]
+		delete(inKey, col.Name)
+		keyed.Columns = append(keyed.Columns, &c)
+	}
+
+	for name := range inKey {
+		return nil, fmt.Errorf("table %v has no column %v", t.Name, name)
+	}
+	return &keyed, nil
+}
+
+/* the names of the tables this table references (excluding itself) */
+func (t *Table) Dependencies() []string {
+	deps := make([]string, 0, len(t.ForeignKeys))
+	seen := make(map[string]bool)
+	for _, fk := range t.ForeignKeys {
+		if fk.RefTable == t.Name || seen[fk.RefTable] {
+			continue
+		}
+		seen[fk.RefTable] = true
+		deps = append(deps, fk.RefTable)
+	}
+	return deps
+}
+
+/* normalizes a referential action of a foreign key, anything unknown is
+ * taken to be the default (NO ACTION) */
+func ReferentialAction(action string) string {
+	action = strings.ToUpper(strings.TrimSpace(action))
+	switch action {
+	case "RESTRICT", "CASCADE", "SET NULL", "SET DEFAULT":
+		return action
+	default:
+		return "NO ACTION"
+	}
 }
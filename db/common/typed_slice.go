@@ -0,0 +1,46 @@
+package common
+
+import (
+	"database/sql"
+)
+
+/* creates a slice of pointers to scan a row of src into, with types that
+ * correspond to the generic types of the columns so the SQL driver takes
+ * care of the conversion */
+func NewTypedSlice(src *Table) []interface{} {
+	vals := make([]interface{}, len(src.Columns))
+	for i, col := range src.Columns {
+		switch col.Type.Name {
+		case TypeBool:
+			if col.Null {
+				vals[i] = new(sql.NullBool)
+			} else {
+				vals[i] = new(bool)
+			}
+		case TypeNumeric, TypeFloat, TypeDouble:
+			if col.Null {
+				vals[i] = new(sql.NullFloat64)
+			} else {
+				vals[i] = new(float64)
+			}
+		case TypeInteger:
+			if col.Null {
+				vals[i] = new(sql.NullInt64)
+			} else {
+				vals[i] = new(int64)
+			}
+		case TypeBlob:
+			/* do we have a suitable NullBlob or NullByte somewhere? I bet
+			 * this gives problems somehow with NULLable blob fields... */
+			vals[i] = new([]byte)
+		default:
+			if col.Null {
+				vals[i] = new(sql.NullString)
+			} else {
+				vals[i] = new(string)
+			}
+		}
+	}
+
+	return vals
+}
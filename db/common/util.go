@@ -1,5 +1,11 @@
 package common
 
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
 func FilterInclExcl(list []string, incl map[string]bool, excl map[string]bool) []string {
 	filtered := make([]string, 0, len(list)/4)
 
@@ -17,3 +23,47 @@ func FilterInclExcl(list []string, incl map[string]bool, excl map[string]bool) [
 
 	return filtered
 }
+
+/* names an index or key of table. Some databases want these names to be
+ * unique in the whole schema, while the source might only have required
+ * them to be unique per table, so the table name is prepended (if it's not
+ * there already). Nameless ones are named after their columns. */
+func KeyName(table, name string, columns []string, suffix string) string {
+	if name == "" {
+		return table + "_" + strings.Join(columns, "_") + "_" + suffix
+	}
+	if strings.HasPrefix(name, table+"_") {
+		return name
+	}
+	return table + "_" + name
+}
+
+/* whether the value of a bit column is a bit string as postgres hands it
+ * out ("0101"), rather than the bytes that hold the bits, as MySQL does.
+ * Those take exactly (max+7)/8 bytes, which tells them apart from a text of
+ * a wider column that happens to consist of "0" and "1" bytes. */
+func IsBitText(val []byte, max uint) bool {
+	if len(val) == 0 || strings.Trim(string(val), "01") != "" {
+		return false
+	}
+	return max == 0 || uint(len(val)) != (max+7)/8 || max <= uint(len(val))
+}
+
+/* a bit string is read as text from postgres ("0101"), but as the bytes
+ * that hold the bits from MySQL, which are turned into text here. Those are
+ * padded to whole bytes, so only the last max bits count. */
+func BitString(val []byte, max uint) string {
+	if len(val) == 0 || IsBitText(val, max) {
+		return string(val)
+	}
+
+	var bits bytes.Buffer
+	for _, b := range val {
+		fmt.Fprintf(&bits, "%08b", b)
+	}
+	s := bits.String()
+	if max > 0 && uint(len(s)) > max {
+		s = s[uint(len(s))-max:]
+	}
+	return s
+}
@@ -0,0 +1,75 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+/* restricts the rows of a table to the ones that changed since the last
+ * sync, going by a column that increases whenever a row changes (like an
+ * updated_at timestamp). From is empty on the first sync. Both are
+ * inclusive: rows can still get the value of From after the last sync read
+ * it (e.g. a timestamp with a coarse resolution), merging the rows that
+ * have it again is harmless. */
+type Watermark struct {
+	Column string
+	From   string
+	To     string
+}
+
+/* the WHERE condition that selects the rows between the watermarks, the
+ * placeholders are numbered after offset */
+func WatermarkCondition(d Dialect, wm *Watermark, offset int) (string, []interface{}) {
+	col := d.Quote(wm.Column)
+	if wm.From == "" {
+		return fmt.Sprintf("%v <= %v", col, d.Placeholder(offset+1)), []interface{}{wm.To}
+	}
+
+	return fmt.Sprintf("%v >= %v AND %v <= %v", col, d.Placeholder(offset+1),
+		col, d.Placeholder(offset+2)), []interface{}{wm.From, wm.To}
+}
+
+/* the current maximum of a column, which becomes the next watermark. It's
+ * selected as an expression, so the drivers return it as the database
+ * formats it. Returns an empty string if the table is empty. */
+func ColumnMax(q Queryer, d Dialect, table *Table, column string) (string, error) {
+	query := fmt.Sprintf("SELECT MAX(%v) FROM %v;", d.Quote(column), d.Quote(table.Name))
+	max, err := scanKey(q, query, nil, 1)
+	if err != nil || max == nil {
+		return "", err
+	}
+	return max[0], nil
+}
+
+/* selects the rows of a table, restricted to the chunk c (if not nil), to
+ * the watermarks of the table (if it has them) and to its filter. The table
+ * is aliased dst for the filter, like it is when merging. */
+func SelectQuery(d Dialect, table *Table, c *Chunk) (string, []interface{}) {
+	conds := make([]string, 0, 2)
+	args := make([]interface{}, 0, 4)
+
+	if c != nil {
+		if cond, condArgs := ChunkCondition(d, table, c); cond != "" {
+			conds = append(conds, cond)
+			args = append(args, condArgs...)
+		}
+	}
+	if table.Watermark != nil {
+		cond, condArgs := WatermarkCondition(d, table.Watermark, len(args))
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+	if table.Filter != "" {
+		conds = append(conds, "("+table.Filter+")")
+	}
+
+	query := fmt.Sprintf("SELECT * FROM %v", d.Quote(table.Name))
+	if table.Filter != "" {
+		query += " AS dst"
+	}
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+
+	return query + ";", args
+}
@@ -1,25 +1,138 @@
 package common
 
 import (
+	"fmt"
 	"io"
+	"regexp"
+	"strings"
 )
 
+/* all table operations take the source table description and the name
+ * of the table in the destination, which can differ (see table_map) */
 type Writer interface {
-	/*
-		CreateTable(t *Table) error
-		Truncate(t *Table) error
-	*/
+	/* (re)create the destination table, leaving out the indices and
+	 * constraints so the data can be loaded without maintaining them */
+	CreateTable(src *Table, dstName string) error
 
-	/* merge the contents of table */
-	MergeTable(src *Table, dstName, extraDstCond string, r Reader) error
+	/* remove all rows from the destination table */
+	Truncate(dstName string) error
 
-	/* (over)write the contents of table */
-	/* WriteTable(t *Table) error */
+	/* (over)write the contents of the table, the destination table is
+	 * expected to be empty. If c is not nil, only the rows of that chunk
+	 * are written. */
+	WriteTable(src *Table, dstName string, r Reader, c *Chunk) error
 
-	/*
-		CreateIndices(t *Table) error
-		CreateConstraints(t *Table) error
-	*/
+	/* merge the contents of table, or only the rows of chunk c if it's not
+	 * nil */
+	MergeTable(src *Table, dstName string, opts *MergeOptions, r Reader, c *Chunk) (*MergeStats, error)
+
+	/* bring the columns of the existing destination table dst in line
+	 * with src: add the columns it lacks and change the ones whose type or
+	 * nullability differ. If drop is set, the columns the source doesn't
+	 * have are dropped. Returns what was (or would have been) changed. */
+	EvolveTable(src, dst *Table, dstName string, drop bool) (*SchemaDiff, error)
+
+	/* add the indices (including the primary key) and constraints, this is
+	 * done after the data has been written */
+	CreateIndices(src *Table, dstName string) error
+	CreateConstraints(src *Table, dstName string) error
+
+	/* apply changes captured from the source, in one transaction. A
+	 * change can be applied more than once without ill effect, so a
+	 * follower can restart from an earlier position. */
+	ApplyChanges(changes []*Change) error
+}
+
+/* what a merge did to the destination rows, unchanged rows are the
+ * source rows that were neither inserted nor updated. Only a writer whose
+ * executor has CapResults can count them. */
+type MergeStats struct {
+	Inserted  int64
+	Updated   int64
+	Unchanged int64
+	Deleted   int64
+}
+
+func (s *MergeStats) Add(o *MergeStats) {
+	s.Inserted += o.Inserted
+	s.Updated += o.Updated
+	s.Unchanged += o.Unchanged
+	s.Deleted += o.Deleted
+}
+
+func (s *MergeStats) String() string {
+	return fmt.Sprintf("%v inserted, %v updated, %v unchanged, %v deleted",
+		s.Inserted, s.Updated, s.Unchanged, s.Deleted)
+}
+
+/* the way a writer merges rows, for backends that have more than one */
+type MergeStrategy string
+
+const (
+	/* the best one the destination supports */
+	MergeAuto MergeStrategy = "auto"
+
+	/* separate UPDATE and INSERT statements, works everywhere */
+	MergeLegacy MergeStrategy = "legacy"
+
+	/* a single INSERT ... ON CONFLICT DO UPDATE */
+	MergeUpsert MergeStrategy = "upsert"
+
+	/* a single MERGE statement */
+	MergeStatement MergeStrategy = "merge"
+)
+
+/* the empty string stands for MergeAuto */
+func ParseMergeStrategy(s string) (MergeStrategy, error) {
+	switch strategy := MergeStrategy(strings.ToLower(strings.TrimSpace(s))); strategy {
+	case "":
+		return MergeAuto, nil
+	case MergeAuto, MergeLegacy, MergeUpsert, MergeStatement:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown merge strategy %q, expected one of auto, legacy, upsert or merge", s)
+	}
+}
+
+/* how the rows of a table are merged */
+type MergeOptions struct {
+	Strategy MergeStrategy
+
+	/* an extra condition on the destination rows, for when only a part of
+	 * the destination table corresponds to the source (e.g. for a
+	 * projection). It refers to the row as dst, the merge only inserts,
+	 * updates and deletes the rows that satisfy it. */
+	DstCondition string
+
+	/* delete the destination rows (that satisfy DstCondition) whose
+	 * primary key isn't in the source anymore, or mark them as deleted if
+	 * SoftDelete is set. When merging a chunk, only the rows in its range
+	 * are considered. */
+	DeleteMissing bool
+	SoftDelete    *SoftDelete
+}
+
+var leadingConnective = regexp.MustCompile(`(?i)^(and|or)\b`)
+
+/* the condition the merged rows are scoped by, the destination condition
+ * without the AND it might start with (empty if there is none). It is on a
+ * row aliased dst, of the destination table or of the rows to merge into
+ * it. A condition that starts with OR can't scope anything. */
+func (o *MergeOptions) Scope() (string, error) {
+	cond := strings.TrimSpace(o.DstCondition)
+	m := leadingConnective.FindString(cond)
+	if strings.EqualFold(m, "or") {
+		return "", fmt.Errorf("the destination condition %q starts with OR, "+
+			"it can't limit which rows are merged", cond)
+	}
+	return strings.TrimSpace(cond[len(m):]), nil
+}
+
+/* marks a row as deleted by setting a column to a value, which is an SQL
+ * expression (e.g. true or now()) */
+type SoftDelete struct {
+	Column string
+	Value  string
 }
 
 type WriteCloser interface {
@@ -0,0 +1,148 @@
+package binlog
+
+import (
+	"fmt"
+)
+
+/* this package reads the binary log of MySQL, either from a file or as a
+ * replication client (a replica that asks the server to stream the log to
+ * it). Only row based logging is understood, as that's the only format
+ * that says exactly which rows were changed. The format is described at
+ * https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_replication.html */
+
+type EventType byte
+
+const (
+	UNKNOWN_EVENT            EventType = 0
+	QUERY_EVENT              EventType = 2
+	STOP_EVENT               EventType = 3
+	ROTATE_EVENT             EventType = 4
+	FORMAT_DESCRIPTION_EVENT EventType = 15
+	XID_EVENT                EventType = 16
+	TABLE_MAP_EVENT          EventType = 19
+	WRITE_ROWS_EVENTv1       EventType = 23
+	UPDATE_ROWS_EVENTv1      EventType = 24
+	DELETE_ROWS_EVENTv1      EventType = 25
+	HEARTBEAT_EVENT          EventType = 27
+	WRITE_ROWS_EVENTv2       EventType = 30
+	UPDATE_ROWS_EVENTv2      EventType = 31
+	DELETE_ROWS_EVENTv2      EventType = 32
+	PARTIAL_UPDATE_ROWS      EventType = 39
+	TRANSACTION_PAYLOAD      EventType = 40
+)
+
+const (
+	/* every binlog file starts with these bytes */
+	magic = "\xfebin"
+
+	headerLen = 19
+
+	/* the length of the CRC32 checksum at the end of every event, if the
+	 * server has binlog_checksum enabled */
+	checksumLen = 4
+
+	/* the flag of events that are made up by the server while streaming
+	 * (like the rotate event at the start), which aren't in any file */
+	artificialFlag = 0x20
+)
+
+/* a position in the binary log: the file and the offset of the next event
+ * in that file */
+type Position struct {
+	File string `json:"file"`
+	Pos  uint32 `json:"pos"`
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%v:%v", p.File, p.Pos)
+}
+
+type Header struct {
+	Timestamp uint32
+	Type      EventType
+	ServerId  uint32
+	Size      uint32
+
+	/* the offset of the next event, 0 for artificial events */
+	NextPos uint32
+	Flags   uint16
+}
+
+/* the kind of change a rows event describes */
+type RowsKind int
+
+const (
+	RowsInsert RowsKind = iota
+	RowsUpdate
+	RowsDelete
+)
+
+func (k RowsKind) String() string {
+	switch k {
+	case RowsInsert:
+		return "insert"
+	case RowsUpdate:
+		return "update"
+	default:
+		return "delete"
+	}
+}
+
+/* the table a rows event refers to by id, which is only valid until the
+ * next statement */
+type TableMap struct {
+	Id     uint64
+	Schema string
+	Table  string
+
+	/* the type and metadata (length, precision, ...) of every column,
+	 * the names are not logged */
+	Types []byte
+	Meta  []uint16
+}
+
+/* a row image is a value per column, in the format the MySQL text
+ * protocol uses (as database/sql hands them out as RawBytes), nil for NULL.
+ * Before is empty for inserts and After for deletes. */
+type Row struct {
+	Before [][]byte
+	After  [][]byte
+}
+
+type RowsEvent struct {
+	Kind  RowsKind
+	Table *TableMap
+
+	/* nil if the table was skipped */
+	Rows []Row
+}
+
+/* a decoded event, only the fields for its type are set. Events gomig has
+ * no use for only have a header. */
+type Event struct {
+	Header
+
+	/* the position after this event */
+	Position Position
+
+	/* the log continues at this position (ROTATE_EVENT) */
+	Rotate *Position
+
+	TableMap *TableMap
+	Rows     *RowsEvent
+
+	/* the statement of a QUERY_EVENT, for row based logging that's BEGIN,
+	 * COMMIT (for non-transactional tables) or DDL */
+	Query string
+
+	/* a transaction was committed (XID_EVENT) */
+	Commit bool
+}
+
+/* the source of the events, a file or a server */
+type Streamer interface {
+	/* blocks until the next event is there, returns io.EOF at the end of
+	 * a file */
+	Next() (*Event, error)
+	Close() error
+}
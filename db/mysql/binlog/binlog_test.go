@@ -0,0 +1,218 @@
+package binlog
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+/* testdata/mysql-bin.000001 is a binlog file in the format MySQL 8.0 writes
+ * it (with binlog_checksum = CRC32), of three transactions on
+ *
+ *   CREATE TABLE test.t (
+ *     id int, name varchar(100) NULL, amount decimal(10,2),
+ *     at datetime, flag tinyint, size enum('small','medium','large'),
+ *     doc json, big bigint unsigned
+ *   )
+ *
+ * which insert two rows, update one of them and delete the other, with an
+ * ALTER TABLE statement of another table before the last one. */
+const fixture = "testdata/mysql-bin.000001"
+
+var fixtureColumns = []ColumnInfo{
+	{}, {}, {}, {}, {},
+	ParseColumnType("enum('small','medium','large')"),
+	{},
+	ParseColumnType("bigint(20) unsigned"),
+}
+
+const fixtureDoc = `{"a": 1, "b": "x"}`
+
+func row(vals ...interface{}) [][]byte {
+	r := make([][]byte, len(vals))
+	for i, v := range vals {
+		if v != nil {
+			r[i] = []byte(v.(string))
+		}
+	}
+	return r
+}
+
+var (
+	alice  = row("1", "alice", "12.50", "2024-05-17 10:30:15", "1", "medium", fixtureDoc, "18446744073709551615")
+	bob    = row("2", nil, "-3.07", "2024-01-01 00:00:00", "-1", "small", fixtureDoc, "18446744073709551615")
+	alicia = row("1", "alicia", "99.99", "2024-05-18 11:00:00", "0", "small", fixtureDoc, "18446744073709551615")
+)
+
+func openFixture(t *testing.T, pos uint32, columns func(schema, table string) ([]ColumnInfo, bool)) *FileStreamer {
+	p := NewParser()
+	p.Columns = columns
+	s, err := OpenFile(fixture, pos, p)
+	if err != nil {
+		t.Fatalf("could not open %v: %v", fixture, err)
+	}
+	return s
+}
+
+func fixtureTable(schema, table string) ([]ColumnInfo, bool) {
+	if schema != "test" || table != "t" {
+		return nil, false
+	}
+	return fixtureColumns, true
+}
+
+/* reads all events up to the end of the file */
+func readAll(t *testing.T, s Streamer) []*Event {
+	defer s.Close()
+
+	events := make([]*Event, 0, 16)
+	for {
+		ev, err := s.Next()
+		if err == io.EOF {
+			return events
+		}
+		if err != nil {
+			t.Fatalf("after %v events: %v", len(events), err)
+		}
+		events = append(events, ev)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	events := readAll(t, openFixture(t, 0, fixtureTable))
+
+	types := make([]EventType, 0, len(events))
+	for _, ev := range events {
+		types = append(types, ev.Type)
+	}
+	expected := []EventType{
+		FORMAT_DESCRIPTION_EVENT,
+		QUERY_EVENT, TABLE_MAP_EVENT, WRITE_ROWS_EVENTv2, XID_EVENT,
+		QUERY_EVENT, TABLE_MAP_EVENT, UPDATE_ROWS_EVENTv2, XID_EVENT,
+		QUERY_EVENT,
+		QUERY_EVENT, TABLE_MAP_EVENT, DELETE_ROWS_EVENTv2, XID_EVENT,
+	}
+	if !reflect.DeepEqual(types, expected) {
+		t.Fatalf("event types %v, expected %v", types, expected)
+	}
+
+	for _, ev := range events {
+		if ev.Position.File != "mysql-bin.000001" || ev.Position.Pos != ev.NextPos {
+			t.Errorf("%v event at %v, expected mysql-bin.000001:%v", ev.Type, ev.Position, ev.NextPos)
+		}
+	}
+
+	if q := events[1].Query; q != "BEGIN" {
+		t.Errorf("query %q, expected BEGIN", q)
+	}
+	if q := events[9].Query; q != "ALTER TABLE other ADD x int" {
+		t.Errorf("query %q, expected the ALTER TABLE statement", q)
+	}
+
+	tm := events[2].TableMap
+	if tm.Schema != "test" || tm.Table != "t" || len(tm.Types) != len(fixtureColumns) {
+		t.Errorf("table map of %v.%v with %v columns, expected test.t with %v",
+			tm.Schema, tm.Table, len(tm.Types), len(fixtureColumns))
+	}
+
+	for _, idx := range []int{4, 8, 13} {
+		if !events[idx].Commit {
+			t.Errorf("event %v (%v) isn't a commit", idx, events[idx].Type)
+		}
+	}
+
+	rows := []struct {
+		idx  int
+		kind RowsKind
+		rows []Row
+	}{
+		{3, RowsInsert, []Row{{After: alice}, {After: bob}}},
+		{7, RowsUpdate, []Row{{Before: alice, After: alicia}}},
+		{12, RowsDelete, []Row{{Before: bob}}},
+	}
+	for _, r := range rows {
+		ev := events[r.idx].Rows
+		if ev.Kind != r.kind || ev.Table != events[r.idx-1].TableMap {
+			t.Errorf("event %v is an %v of %v.%v, expected an %v of the preceding table map",
+				r.idx, ev.Kind, ev.Table.Schema, ev.Table.Table, r.kind)
+		}
+		if !reflect.DeepEqual(ev.Rows, r.rows) {
+			t.Errorf("%v rows\n%q\nexpected\n%q", r.kind, ev.Rows, r.rows)
+		}
+	}
+}
+
+/* without the column info, signedness and the members of an enum are
+ * unknown */
+func TestReadFileWithoutColumns(t *testing.T) {
+	events := readAll(t, openFixture(t, 0, nil))
+
+	got := events[3].Rows.Rows[0].After
+	if size, big := string(got[5]), string(got[7]); size != "2" || big != "-1" {
+		t.Errorf("enum %q and bigint %q, expected the index 2 and -1", size, big)
+	}
+}
+
+func TestReadFileSkipsTables(t *testing.T) {
+	skip := func(schema, table string) ([]ColumnInfo, bool) { return nil, false }
+	events := readAll(t, openFixture(t, 0, skip))
+
+	for _, ev := range events {
+		if ev.Rows != nil && ev.Rows.Rows != nil {
+			t.Errorf("%v event of a skipped table has rows", ev.Type)
+		}
+	}
+}
+
+/* the events after the position are read, the format description event at
+ * the start of the file is read first all the same */
+func TestReadFileFromPosition(t *testing.T) {
+	all := readAll(t, openFixture(t, 0, fixtureTable))
+	pos := all[4].Position.Pos
+
+	events := readAll(t, openFixture(t, pos, fixtureTable))
+	if len(events) != len(all)-5 {
+		t.Fatalf("%v events from %v, expected %v", len(events), pos, len(all)-5)
+	}
+	if ev := events[2].Rows; ev == nil || !reflect.DeepEqual(ev.Rows, all[7].Rows.Rows) {
+		t.Errorf("the update read from %v differs from the one read from the start", pos)
+	}
+}
+
+func TestParseColumnType(t *testing.T) {
+	tests := []struct {
+		rawType string
+		info    ColumnInfo
+	}{
+		{"int(10) unsigned", ColumnInfo{Unsigned: true}},
+		{"varchar(20)", ColumnInfo{}},
+		{"enum('a','it''s','c,d')", ColumnInfo{Values: []string{"a", "it's", "c,d"}}},
+		{"set('x','y')", ColumnInfo{Values: []string{"x", "y"}}},
+	}
+	for _, test := range tests {
+		if info := ParseColumnType(test.rawType); !reflect.DeepEqual(info, test.info) {
+			t.Errorf("%v: %+v, expected %+v", test.rawType, info, test.info)
+		}
+	}
+}
+
+func TestDecodeDecimal(t *testing.T) {
+	tests := []struct {
+		data             []byte
+		precision, scale int
+		expected         string
+	}{
+		/* 1234567890.1234 as decimal(14,4): 1 leftover digit, a group
+		 * of 9, and 4 fractional digits in 2 bytes */
+		{[]byte{0x81, 0x0d, 0xfb, 0x38, 0xd2, 0x04, 0xd2}, 14, 4, "1234567890.1234"},
+		{[]byte{0x7e, 0xf2, 0x04, 0xc7, 0x2d, 0xfb, 0x2d}, 14, 4, "-1234567890.1234"},
+		{[]byte{0x80, 0x00, 0x00, 0x00, 0x05}, 10, 2, "0.05"},
+	}
+	for _, test := range tests {
+		got := decodeDecimal(&buf{data: test.data}, test.precision, test.scale)
+		if got != test.expected {
+			t.Errorf("% x as decimal(%v,%v): %v, expected %v",
+				test.data, test.precision, test.scale, got, test.expected)
+		}
+	}
+}
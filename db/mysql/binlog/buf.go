@@ -0,0 +1,101 @@
+package binlog
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errShort = errors.New("binlog: event is shorter than its contents")
+
+/* reads the fields of an event one after the other. Reading past the end
+ * doesn't panic, it sets err (and returns zeroes), so the error only has
+ * to be checked once at the end. */
+type buf struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (b *buf) left() int {
+	return len(b.data) - b.pos
+}
+
+func (b *buf) bytes(n int) []byte {
+	if b.err != nil || n < 0 || n > b.left() {
+		if b.err == nil {
+			b.err = errShort
+		}
+		return make([]byte, n)
+	}
+	p := b.data[b.pos : b.pos+n]
+	b.pos += n
+	return p
+}
+
+func (b *buf) skip(n int) {
+	b.bytes(n)
+}
+
+func (b *buf) uint8() uint8 {
+	return b.bytes(1)[0]
+}
+
+/* little endian integers of n bytes, the usual encoding */
+func (b *buf) uintN(n int) uint64 {
+	p := b.bytes(n)
+	var v uint64
+	for i := n - 1; i >= 0; i-- {
+		v = v<<8 | uint64(p[i])
+	}
+	return v
+}
+
+func (b *buf) uint16() uint16 {
+	return binary.LittleEndian.Uint16(b.bytes(2))
+}
+
+func (b *buf) uint32() uint32 {
+	return binary.LittleEndian.Uint32(b.bytes(4))
+}
+
+func (b *buf) uint64() uint64 {
+	return binary.LittleEndian.Uint64(b.bytes(8))
+}
+
+/* big endian integers of n bytes, used by the newer temporal types */
+func (b *buf) beUintN(n int) uint64 {
+	var v uint64
+	for _, c := range b.bytes(n) {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+/* a length encoded integer */
+func (b *buf) lenenc() uint64 {
+	switch c := b.uint8(); c {
+	case 0xfc:
+		return b.uintN(2)
+	case 0xfd:
+		return b.uintN(3)
+	case 0xfe:
+		return b.uint64()
+	default:
+		return uint64(c)
+	}
+}
+
+/* a bitmap of n bits, one bool per bit */
+func (b *buf) bitmap(n int) []bool {
+	p := b.bytes((n + 7) / 8)
+	bits := make([]bool, n)
+	for i := range bits {
+		bits[i] = p[i/8]&(1<<uint(i%8)) != 0
+	}
+	return bits
+}
+
+/* the rest of the data */
+func (b *buf) rest() []byte {
+	return b.bytes(b.left())
+}
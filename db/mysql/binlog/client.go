@@ -0,0 +1,444 @@
+package binlog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+/* a replication client: it connects to the server like a replica does and
+ * asks it to stream the binlog from a position on. database/sql drivers
+ * don't speak this part of the protocol, so the little of it that's needed
+ * is implemented here, see
+ * https://dev.mysql.com/doc/dev/mysql-server/latest/PAGE_PROTOCOL.html */
+
+const (
+	comQuery         = 0x03
+	comBinlogDump    = 0x12
+	comRegisterSlave = 0x15
+
+	clientLongPassword = 0x00000001
+	clientLongFlag     = 0x00000004
+	clientProtocol41   = 0x00000200
+	clientTransactions = 0x00002000
+	clientSecureConn   = 0x00008000
+	clientPluginAuth   = 0x00080000
+
+	/* utf8_general_ci */
+	charsetUtf8 = 33
+
+	maxPacketSize = 1<<24 - 1
+
+	/* the server sends a heartbeat when there have been no events for this
+	 * long, if nothing arrives for a few of those the connection is dead */
+	heartbeatPeriod = 30 * time.Second
+	readTimeout     = 3 * heartbeatPeriod
+)
+
+type ClientConfig struct {
+	/* tcp or unix */
+	Network  string
+	Address  string
+	Username string
+	Password string
+
+	/* the server id the client registers as, it has to differ from the
+	 * ids of the server and its other replicas */
+	ServerId uint32
+}
+
+type Client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	seq  byte
+	p    *Parser
+	pos  Position
+}
+
+/* connects to the server and starts streaming the binlog from pos */
+func Dial(conf *ClientConfig, pos Position, p *Parser) (*Client, error) {
+	conn, err := net.DialTimeout(conf.Network, conf.Address, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{conn: conn, r: bufio.NewReader(conn), p: p, pos: pos}
+	if err := c.start(conf, pos); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Client) start(conf *ClientConfig, pos Position) error {
+	if err := c.handshake(conf); err != nil {
+		return fmt.Errorf("binlog: could not log in: %v", err)
+	}
+
+	/* the server only sends checksums to a client that says it knows
+	 * about them */
+	rows, err := c.query("SELECT @@global.binlog_checksum")
+	if err == nil && len(rows) == 1 && rows[0] != "NONE" {
+		if _, err := c.query("SET @master_binlog_checksum = @@global.binlog_checksum"); err != nil {
+			return err
+		}
+		c.p.SetChecksum(true)
+	}
+
+	if _, err := c.query(fmt.Sprintf("SET @master_heartbeat_period = %v", heartbeatPeriod.Nanoseconds())); err != nil {
+		return err
+	}
+
+	/* hostname, user, password, port, rank and master id are all only
+	 * informative */
+	reg := make([]byte, 0, 18)
+	reg = append(reg, comRegisterSlave)
+	reg = appendUint32(reg, conf.ServerId)
+	reg = append(reg, 0, 0, 0, 0, 0)
+	reg = appendUint32(reg, 0)
+	reg = appendUint32(reg, 0)
+	if err := c.command(reg); err != nil {
+		return err
+	}
+	if _, err := c.readResult(); err != nil {
+		return fmt.Errorf("binlog: could not register as a replica: %v", err)
+	}
+
+	dump := make([]byte, 0, 11+len(pos.File))
+	dump = append(dump, comBinlogDump)
+	dump = appendUint32(dump, pos.Pos)
+	dump = append(dump, 0, 0) /* flags, 0 means block at the end */
+	dump = appendUint32(dump, conf.ServerId)
+	dump = append(dump, pos.File...)
+	return c.command(dump)
+}
+
+func (c *Client) Next() (*Event, error) {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(readTimeout))
+		pkt, err := c.readPacket()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case len(pkt) == 0:
+			return nil, errShort
+		case pkt[0] == 0xff:
+			return nil, packetError(pkt)
+		case pkt[0] == 0xfe && len(pkt) < 9:
+			return nil, io.EOF
+		}
+
+		ev, err := c.p.Parse(pkt[1:])
+		if err != nil {
+			return nil, fmt.Errorf("%v (after %v)", err, c.pos)
+		}
+
+		switch {
+		case ev.Type == HEARTBEAT_EVENT:
+			continue
+		case ev.Rotate != nil:
+			c.pos = *ev.Rotate
+		case ev.NextPos != 0 && ev.Flags&artificialFlag == 0:
+			c.pos.Pos = ev.NextPos
+		}
+		ev.Position = c.pos
+		return ev, nil
+	}
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+/* packets are at most 16MB, bigger payloads are split up */
+func (c *Client) readPacket() ([]byte, error) {
+	var data []byte
+	head := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(c.r, head); err != nil {
+			return nil, err
+		}
+		n := int(head[0]) | int(head[1])<<8 | int(head[2])<<16
+		c.seq = head[3] + 1
+
+		start := len(data)
+		data = append(data, make([]byte, n)...)
+		if _, err := io.ReadFull(c.r, data[start:]); err != nil {
+			return nil, err
+		}
+
+		if n < maxPacketSize {
+			return data, nil
+		}
+	}
+}
+
+func (c *Client) writePacket(data []byte) error {
+	if len(data) >= maxPacketSize {
+		return errors.New("binlog: packet too large")
+	}
+
+	pkt := make([]byte, 4, 4+len(data))
+	pkt[0], pkt[1], pkt[2], pkt[3] = byte(len(data)), byte(len(data)>>8), byte(len(data)>>16), c.seq
+	c.seq++
+
+	_, err := c.conn.Write(append(pkt, data...))
+	return err
+}
+
+/* every command starts a new sequence */
+func (c *Client) command(data []byte) error {
+	c.seq = 0
+	return c.writePacket(data)
+}
+
+/* reads an OK or error packet */
+func (c *Client) readResult() ([]byte, error) {
+	pkt, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	if len(pkt) > 0 && pkt[0] == 0xff {
+		return nil, packetError(pkt)
+	}
+	return pkt, nil
+}
+
+/* runs a query, returning the first column of the rows it returns (if
+ * any) */
+func (c *Client) query(q string) ([]string, error) {
+	if err := c.command(append([]byte{comQuery}, q...)); err != nil {
+		return nil, err
+	}
+
+	pkt, err := c.readResult()
+	if err != nil || pkt[0] == 0x00 {
+		return nil, err
+	}
+
+	/* a result set: the column count, the column definitions, an EOF
+	 * packet, the rows and another EOF packet */
+	columns := int((&buf{data: pkt}).lenenc())
+	for i := 0; i < columns+1; i++ {
+		if _, err := c.readPacket(); err != nil {
+			return nil, err
+		}
+	}
+
+	rows := make([]string, 0, 1)
+	for {
+		pkt, err := c.readResult()
+		if err != nil {
+			return nil, err
+		}
+		if pkt[0] == 0xfe && len(pkt) < 9 {
+			return rows, nil
+		}
+
+		b := &buf{data: pkt}
+		if pkt[0] == 0xfb {
+			/* NULL */
+			rows = append(rows, "")
+		} else {
+			rows = append(rows, string(b.bytes(int(b.lenenc()))))
+		}
+	}
+}
+
+func (c *Client) handshake(conf *ClientConfig) error {
+	pkt, err := c.readResult()
+	if err != nil {
+		return err
+	}
+
+	b := &buf{data: pkt}
+	if proto := b.uint8(); proto != 10 {
+		return fmt.Errorf("unsupported protocol version %v", proto)
+	}
+	b.skip(bytes.IndexByte(pkt[1:], 0) + 1) /* the server version */
+	b.skip(4)                               /* the connection id */
+	salt := copyBytes(b.bytes(8))
+	b.skip(1)
+	caps := uint32(b.uint16())
+
+	plugin := "mysql_native_password"
+	if b.left() > 0 {
+		b.skip(3) /* character set and status */
+		caps |= uint32(b.uint16()) << 16
+		saltLen := int(b.uint8())
+		b.skip(10)
+		if caps&clientSecureConn != 0 {
+			n := saltLen - 8
+			if n < 13 {
+				n = 13
+			}
+			salt = append(salt, bytes.TrimRight(b.bytes(n), "\x00")...)
+		}
+		if caps&clientPluginAuth != 0 {
+			plugin = string(bytes.TrimRight(b.rest(), "\x00"))
+		}
+	}
+	if b.err != nil {
+		return b.err
+	}
+
+	auth, err := scramble(plugin, salt, conf.Password)
+	if err != nil {
+		return err
+	}
+
+	resp := make([]byte, 0, 64)
+	resp = appendUint32(resp, clientLongPassword|clientLongFlag|clientProtocol41|
+		clientTransactions|clientSecureConn|clientPluginAuth)
+	resp = appendUint32(resp, maxPacketSize)
+	resp = append(resp, charsetUtf8)
+	resp = append(resp, make([]byte, 23)...)
+	resp = append(resp, conf.Username...)
+	resp = append(resp, 0, byte(len(auth)))
+	resp = append(resp, auth...)
+	resp = append(resp, plugin...)
+	resp = append(resp, 0)
+	if err := c.writePacket(resp); err != nil {
+		return err
+	}
+
+	return c.authenticate(conf, plugin, salt)
+}
+
+/* the server either accepts, asks to switch to another plugin or (for
+ * caching_sha2_password) asks for the password itself */
+func (c *Client) authenticate(conf *ClientConfig, plugin string, salt []byte) error {
+	for {
+		pkt, err := c.readResult()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case pkt[0] == 0x00:
+			return nil
+		case pkt[0] == 0xfe:
+			end := bytes.IndexByte(pkt, 0)
+			if end == -1 {
+				return errShort
+			}
+			plugin = string(pkt[1:end])
+			salt = bytes.TrimRight(pkt[end+1:], "\x00")
+
+			auth, err := scramble(plugin, salt, conf.Password)
+			if err != nil {
+				return err
+			}
+			if err := c.writePacket(auth); err != nil {
+				return err
+			}
+		case pkt[0] == 0x01 && len(pkt) == 2 && pkt[1] == 0x03:
+			/* the password was cached, an OK packet follows */
+		case pkt[0] == 0x01 && len(pkt) == 2 && pkt[1] == 0x04:
+			if err := c.fullAuth(conf, salt); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected packet during authentication (0x%x)", pkt[0])
+		}
+	}
+}
+
+/* the password has to be sent to the server, in the clear over a unix
+ * socket and otherwise encrypted with the server's public key */
+func (c *Client) fullAuth(conf *ClientConfig, salt []byte) error {
+	password := append([]byte(conf.Password), 0)
+	if conf.Network == "unix" {
+		return c.writePacket(password)
+	}
+
+	if err := c.writePacket([]byte{0x02}); err != nil {
+		return err
+	}
+	pkt, err := c.readResult()
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(pkt[1:])
+	if block == nil {
+		return errors.New("the server sent no valid public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("the public key of the server is not an RSA key")
+	}
+
+	for i := range password {
+		password[i] ^= salt[i%len(salt)]
+	}
+	enc, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, pub, password, nil)
+	if err != nil {
+		return err
+	}
+	return c.writePacket(enc)
+}
+
+func scramble(plugin string, salt []byte, password string) ([]byte, error) {
+	if password == "" {
+		return nil, nil
+	}
+
+	switch plugin {
+	case "mysql_native_password":
+		/* SHA1(password) XOR SHA1(salt + SHA1(SHA1(password))) */
+		h := sha1.Sum([]byte(password))
+		hh := sha1.Sum(h[:])
+		m := sha1.Sum(append(copyBytes(salt), hh[:]...))
+		for i := range m {
+			m[i] ^= h[i]
+		}
+		return m[:], nil
+	case "caching_sha2_password":
+		/* SHA256(password) XOR SHA256(SHA256(SHA256(password)) + salt) */
+		h := sha256.Sum256([]byte(password))
+		hh := sha256.Sum256(h[:])
+		m := sha256.Sum256(append(hh[:], salt...))
+		for i := range m {
+			m[i] ^= h[i]
+		}
+		return m[:], nil
+	default:
+		return nil, fmt.Errorf("unsupported authentication plugin %v", plugin)
+	}
+}
+
+func packetError(pkt []byte) error {
+	if len(pkt) < 3 {
+		return errors.New("binlog: server error")
+	}
+	code := binary.LittleEndian.Uint16(pkt[1:])
+	msg := pkt[3:]
+	if len(msg) > 6 && msg[0] == '#' {
+		/* the SQL state */
+		msg = msg[6:]
+	}
+	return fmt.Errorf("binlog: server error %v: %s", code, msg)
+}
+
+func appendUint32(p []byte, v uint32) []byte {
+	return append(p, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
@@ -0,0 +1,100 @@
+package binlog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+/* reads the events of a binlog file, e.g. one copied from the server's data
+ * directory. It doesn't follow rotations into the next file. */
+type FileStreamer struct {
+	f      *os.File
+	r      *bufio.Reader
+	p      *Parser
+	name   string
+	offset uint32
+}
+
+/* opens a binlog file, the events start at pos (or at the first event if pos
+ * is 0). The format description event at the start of the file is always
+ * read first, the parser needs it. */
+func OpenFile(path string, pos uint32, p *Parser) (*FileStreamer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FileStreamer{f: f, r: bufio.NewReader(f), p: p, name: filepath.Base(path)}
+
+	head := make([]byte, len(magic))
+	if _, err := io.ReadFull(s.r, head); err != nil || string(head) != magic {
+		f.Close()
+		return nil, fmt.Errorf("binlog: %v is not a binlog file", path)
+	}
+	s.offset = uint32(len(magic))
+
+	if pos <= s.offset {
+		return s, nil
+	}
+
+	ev, err := s.Next()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if ev.Type != FORMAT_DESCRIPTION_EVENT {
+		f.Close()
+		return nil, fmt.Errorf("binlog: %v doesn't start with a format description event", path)
+	}
+
+	if _, err := f.Seek(int64(pos), io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.r.Reset(f)
+	s.offset = pos
+
+	return s, nil
+}
+
+func (s *FileStreamer) Next() (*Event, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(s.r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			/* the server is still writing the event */
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+
+	size := binary.LittleEndian.Uint32(header[9:])
+	if size < headerLen {
+		return nil, fmt.Errorf("binlog: corrupt event at %v:%v", s.name, s.offset)
+	}
+
+	data := make([]byte, size)
+	copy(data, header)
+	if _, err := io.ReadFull(s.r, data[headerLen:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+
+	ev, err := s.p.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v (at %v:%v)", err, s.name, s.offset)
+	}
+
+	s.offset += size
+	ev.Position = Position{File: s.name, Pos: s.offset}
+	return ev, nil
+}
+
+func (s *FileStreamer) Close() error {
+	return s.f.Close()
+}
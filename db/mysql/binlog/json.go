@@ -0,0 +1,216 @@
+package binlog
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+/* JSON columns are logged in MySQL's binary JSON format, see
+ * https://dev.mysql.com/doc/dev/mysql-server/latest/json__binary_8h.html,
+ * which is turned back into text here */
+
+const (
+	jsonSmallObject = 0x00
+	jsonLargeObject = 0x01
+	jsonSmallArray  = 0x02
+	jsonLargeArray  = 0x03
+	jsonLiteral     = 0x04
+	jsonInt16       = 0x05
+	jsonUint16      = 0x06
+	jsonInt32       = 0x07
+	jsonUint32      = 0x08
+	jsonInt64       = 0x09
+	jsonUint64      = 0x0a
+	jsonDouble      = 0x0b
+	jsonString      = 0x0c
+	jsonOpaque      = 0x0f
+
+	jsonNull  = 0x00
+	jsonTrue  = 0x01
+	jsonFalse = 0x02
+)
+
+func decodeJson(data []byte) ([]byte, error) {
+	/* an empty value is what MySQL logs for a JSON null */
+	if len(data) == 0 {
+		return []byte("null"), nil
+	}
+
+	var out bytes.Buffer
+	if err := writeJsonValue(&out, data[0], data[1:]); err != nil {
+		return nil, fmt.Errorf("corrupt JSON value: %v", err)
+	}
+	return out.Bytes(), nil
+}
+
+func writeJsonValue(out *bytes.Buffer, t byte, data []byte) error {
+	b := &buf{data: data}
+
+	switch t {
+	case jsonSmallObject, jsonLargeObject:
+		return writeJsonContainer(out, data, t == jsonLargeObject, true)
+	case jsonSmallArray, jsonLargeArray:
+		return writeJsonContainer(out, data, t == jsonLargeArray, false)
+	case jsonLiteral:
+		switch b.uint8() {
+		case jsonNull:
+			out.WriteString("null")
+		case jsonTrue:
+			out.WriteString("true")
+		case jsonFalse:
+			out.WriteString("false")
+		default:
+			return fmt.Errorf("unknown literal")
+		}
+	case jsonInt16:
+		out.WriteString(strconv.FormatInt(int64(int16(b.uint16())), 10))
+	case jsonUint16:
+		out.WriteString(strconv.FormatUint(uint64(b.uint16()), 10))
+	case jsonInt32:
+		out.WriteString(strconv.FormatInt(int64(int32(b.uint32())), 10))
+	case jsonUint32:
+		out.WriteString(strconv.FormatUint(uint64(b.uint32()), 10))
+	case jsonInt64:
+		out.WriteString(strconv.FormatInt(int64(b.uint64()), 10))
+	case jsonUint64:
+		out.WriteString(strconv.FormatUint(b.uint64(), 10))
+	case jsonDouble:
+		out.WriteString(strconv.FormatFloat(math.Float64frombits(b.uint64()), 'g', -1, 64))
+	case jsonString:
+		writeJsonString(out, string(b.bytes(jsonLength(b))))
+	case jsonOpaque:
+		return writeJsonOpaque(out, b.uint8(), b)
+	default:
+		return fmt.Errorf("unknown type %v", t)
+	}
+
+	return b.err
+}
+
+/* objects and arrays start with their element count and size, followed by
+ * the offsets of the keys (objects only) and values. Small ones use 2 byte
+ * offsets, large ones 4 bytes. Values that fit in an offset are stored
+ * inline. */
+func writeJsonContainer(out *bytes.Buffer, data []byte, large, object bool) error {
+	offsetSize := 2
+	if large {
+		offsetSize = 4
+	}
+
+	b := &buf{data: data}
+	count := int(b.uintN(offsetSize))
+	b.skip(offsetSize) /* the size */
+
+	keys := make([]string, count)
+	if object {
+		for i := range keys {
+			offset := int(b.uintN(offsetSize))
+			length := int(b.uint16())
+			if offset+length > len(data) {
+				return errShort
+			}
+			keys[i] = string(data[offset : offset+length])
+		}
+	}
+
+	open, close := "[", "]"
+	if object {
+		open, close = "{", "}"
+	}
+	out.WriteString(open)
+
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			out.WriteString(", ")
+		}
+		if object {
+			writeJsonString(out, keys[i])
+			out.WriteString(": ")
+		}
+
+		t := b.uint8()
+		if b.err != nil {
+			return b.err
+		}
+
+		inline := t == jsonLiteral || t == jsonInt16 || t == jsonUint16 ||
+			(large && (t == jsonInt32 || t == jsonUint32))
+		if inline {
+			if err := writeJsonValue(out, t, b.bytes(offsetSize)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		offset := int(b.uintN(offsetSize))
+		if offset > len(data) {
+			return errShort
+		}
+		if err := writeJsonValue(out, t, data[offset:]); err != nil {
+			return err
+		}
+	}
+
+	out.WriteString(close)
+	return b.err
+}
+
+/* string lengths use 7 bits per byte, the high bit says more follow */
+func jsonLength(b *buf) int {
+	length := 0
+	for shift := uint(0); shift < 35; shift += 7 {
+		c := b.uint8()
+		length |= int(c&0x7f) << shift
+		if c&0x80 == 0 || b.err != nil {
+			break
+		}
+	}
+	return length
+}
+
+func writeJsonString(out *bytes.Buffer, s string) {
+	quoted, _ := json.Marshal(s)
+	out.Write(quoted)
+}
+
+/* opaque values are MySQL values that have no JSON type, like decimals
+ * and dates. They're shown the way MySQL shows them, as a number or string
+ * (the ones it doesn't know either are shown base64 encoded). */
+func writeJsonOpaque(out *bytes.Buffer, t byte, b *buf) error {
+	data := b.bytes(jsonLength(b))
+	if b.err != nil {
+		return b.err
+	}
+
+	switch t {
+	case TypeNewDecimal:
+		if len(data) < 2 {
+			return errShort
+		}
+		d := &buf{data: data[2:]}
+		out.WriteString(decodeDecimal(d, int(data[0]), int(data[1])))
+		return d.err
+	case TypeDate, TypeDatetime, TypeTimestamp, TypeTime:
+		if len(data) < 8 {
+			return errShort
+		}
+		v := int64(binary.LittleEndian.Uint64(data))
+		switch t {
+		case TypeTime:
+			writeJsonString(out, packedTime(v, 6))
+		case TypeDate:
+			writeJsonString(out, packedDatetime(v >> 24)[:10])
+		default:
+			writeJsonString(out, packedDatetime(v>>24)+formatFraction(v%(1<<24), 6))
+		}
+	default:
+		writeJsonString(out, fmt.Sprintf("base64:type%v:%v", t, base64.StdEncoding.EncodeToString(data)))
+	}
+
+	return nil
+}
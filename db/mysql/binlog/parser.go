@@ -0,0 +1,326 @@
+package binlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* what the parser needs to know about a column beyond what the binlog
+ * says: the binlog doesn't log the signedness of integers, nor the members
+ * of ENUM and SET columns (only their index) */
+type ColumnInfo struct {
+	Unsigned bool
+	Values   []string
+}
+
+/* extracts the column info from a MySQL column type, as SHOW COLUMNS
+ * describes it, e.g. "int(10) unsigned" or "enum('a','b')" */
+func ParseColumnType(rawType string) ColumnInfo {
+	info := ColumnInfo{Unsigned: strings.Contains(rawType, "unsigned")}
+
+	lower := strings.ToLower(rawType)
+	if !strings.HasPrefix(lower, "enum(") && !strings.HasPrefix(lower, "set(") {
+		return info
+	}
+
+	/* the members are quoted, with quotes inside them doubled */
+	list := rawType[strings.Index(rawType, "(")+1 : strings.LastIndex(rawType, ")")]
+	var member bytes.Buffer
+	quoted := false
+	for i := 0; i < len(list); i++ {
+		c := list[i]
+		switch {
+		case c == '\'' && quoted && i+1 < len(list) && list[i+1] == '\'':
+			member.WriteByte(c)
+			i++
+		case c == '\'' && quoted:
+			info.Values = append(info.Values, member.String())
+			member.Reset()
+			quoted = false
+		case c == '\'':
+			quoted = true
+		case quoted:
+			member.WriteByte(c)
+		}
+	}
+
+	return info
+}
+
+/* decodes events, keeping track of what it needs to know across them: the
+ * format of the log and the tables the rows events refer to */
+type Parser struct {
+	/* whether the events end in a checksum, the format description event
+	 * at the start of every binlog file tells */
+	checksum bool
+
+	tables map[uint64]*TableMap
+
+	/* describes the columns of a table, and returns false if the rows of
+	 * the table aren't of interest, in which case they aren't decoded. If
+	 * nil, all rows are decoded without extra column info. */
+	Columns func(schema, table string) ([]ColumnInfo, bool)
+
+	/* the time zone TIMESTAMP columns are shown in, they're logged in UTC.
+	 * This should be the time zone of the session the snapshot was read
+	 * with. */
+	Location *time.Location
+}
+
+func NewParser() *Parser {
+	return &Parser{
+		tables:   make(map[uint64]*TableMap),
+		Location: time.UTC,
+	}
+}
+
+/* tells the parser whether events end in a checksum. Only needed for the
+ * events a server sends before the format description event. */
+func (p *Parser) SetChecksum(checksum bool) {
+	p.checksum = checksum
+}
+
+func parseHeader(data []byte) (Header, error) {
+	if len(data) < headerLen {
+		return Header{}, fmt.Errorf("binlog: event of %v bytes is too short for its header", len(data))
+	}
+
+	le := binary.LittleEndian
+	return Header{
+		Timestamp: le.Uint32(data),
+		Type:      EventType(data[4]),
+		ServerId:  le.Uint32(data[5:]),
+		Size:      le.Uint32(data[9:]),
+		NextPos:   le.Uint32(data[13:]),
+		Flags:     le.Uint16(data[17:]),
+	}, nil
+}
+
+/* decodes an event, including its header. The returned event doesn't
+ * refer to data anymore. */
+func (p *Parser) Parse(data []byte) (*Event, error) {
+	h, err := parseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	body := data[headerLen:]
+
+	if h.Type == FORMAT_DESCRIPTION_EVENT {
+		p.checksum = formatChecksum(body)
+		/* a new format also means a new file, whose table ids mean
+		 * nothing yet */
+		p.tables = make(map[uint64]*TableMap)
+	}
+	if p.checksum {
+		if len(body) < checksumLen {
+			return nil, errShort
+		}
+		body = body[:len(body)-checksumLen]
+	}
+
+	ev := &Event{Header: h}
+	b := &buf{data: body}
+
+	switch h.Type {
+	case ROTATE_EVENT:
+		pos := b.uint64()
+		ev.Rotate = &Position{File: string(b.rest()), Pos: uint32(pos)}
+	case QUERY_EVENT:
+		/* thread id, execution time, schema length, error code */
+		b.skip(8)
+		schemaLen := int(b.uint8())
+		b.skip(2)
+		statusLen := int(b.uint16())
+		b.skip(statusLen + schemaLen + 1)
+		ev.Query = string(b.rest())
+	case XID_EVENT:
+		ev.Commit = true
+	case TABLE_MAP_EVENT:
+		tm, err := parseTableMap(b)
+		if err != nil {
+			return nil, err
+		}
+		p.tables[tm.Id] = tm
+		ev.TableMap = tm
+	case WRITE_ROWS_EVENTv1, UPDATE_ROWS_EVENTv1, DELETE_ROWS_EVENTv1,
+		WRITE_ROWS_EVENTv2, UPDATE_ROWS_EVENTv2, DELETE_ROWS_EVENTv2:
+		rows, err := p.parseRows(h.Type, b)
+		if err != nil {
+			return nil, err
+		}
+		ev.Rows = rows
+	case PARTIAL_UPDATE_ROWS:
+		return nil, fmt.Errorf("binlog: partial JSON updates are not supported, set binlog_row_value_options to ''")
+	case TRANSACTION_PAYLOAD:
+		return nil, fmt.Errorf("binlog: compressed transactions are not supported, turn off binlog_transaction_compression")
+	}
+
+	if b.err != nil {
+		return nil, fmt.Errorf("binlog: could not decode event of type %v: %v", h.Type, b.err)
+	}
+	return ev, nil
+}
+
+/* the format description event ends in the checksum algorithm (and a
+ * checksum) since MySQL 5.6.1, 0 is none and 1 is CRC32 */
+func formatChecksum(body []byte) bool {
+	if len(body) < 52+checksumLen+1 {
+		return false
+	}
+
+	version := string(bytes.TrimRight(body[2:52], "\x00"))
+	parts := strings.SplitN(version, ".", 3)
+	nums := make([]int, 3)
+	for i := 0; i < len(parts) && i < 3; i++ {
+		/* e.g. 5.7.44-log */
+		digits := parts[i]
+		if end := strings.IndexFunc(digits, func(r rune) bool { return r < '0' || r > '9' }); end != -1 {
+			digits = digits[:end]
+		}
+		nums[i], _ = strconv.Atoi(digits)
+	}
+	if nums[0]*10000+nums[1]*100+nums[2] < 50601 {
+		return false
+	}
+
+	return body[len(body)-checksumLen-1] == 1
+}
+
+func parseTableMap(b *buf) (*TableMap, error) {
+	tm := &TableMap{Id: b.uintN(6)}
+	b.skip(2) /* flags */
+
+	tm.Schema = string(b.bytes(int(b.uint8())))
+	b.skip(1)
+	tm.Table = string(b.bytes(int(b.uint8())))
+	b.skip(1)
+
+	count := int(b.lenenc())
+	tm.Types = append([]byte(nil), b.bytes(count)...)
+
+	meta := &buf{data: b.bytes(int(b.lenenc()))}
+	tm.Meta = make([]uint16, count)
+	for i, t := range tm.Types {
+		switch t {
+		case TypeFloat, TypeDouble, TypeBlob, TypeGeometry, TypeJson,
+			TypeTime2, TypeDatetime2, TypeTimestamp2:
+			tm.Meta[i] = uint16(meta.uint8())
+		case TypeVarchar, TypeVarString, TypeBit:
+			tm.Meta[i] = meta.uint16()
+		case TypeNewDecimal, TypeString, TypeEnum, TypeSet:
+			/* these are big endian */
+			tm.Meta[i] = uint16(meta.beUintN(2))
+		}
+	}
+	if meta.err != nil {
+		return nil, fmt.Errorf("binlog: column metadata of table %v.%v is corrupt", tm.Schema, tm.Table)
+	}
+
+	/* what follows are the nullability of the columns and (since MySQL
+	 * 8.0) optional metadata, none of which is needed */
+	return tm, b.err
+}
+
+func (p *Parser) parseRows(t EventType, b *buf) (*RowsEvent, error) {
+	ev := &RowsEvent{}
+	switch t {
+	case WRITE_ROWS_EVENTv1, WRITE_ROWS_EVENTv2:
+		ev.Kind = RowsInsert
+	case UPDATE_ROWS_EVENTv1, UPDATE_ROWS_EVENTv2:
+		ev.Kind = RowsUpdate
+	default:
+		ev.Kind = RowsDelete
+	}
+
+	id := b.uintN(6)
+	b.skip(2) /* flags */
+	if t >= WRITE_ROWS_EVENTv2 {
+		/* the length includes itself */
+		b.skip(int(b.uint16()) - 2)
+	}
+
+	count := int(b.lenenc())
+	present := b.bitmap(count)
+	presentAfter := present
+	if ev.Kind == RowsUpdate {
+		presentAfter = b.bitmap(count)
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	tm, ok := p.tables[id]
+	if !ok {
+		return nil, fmt.Errorf("binlog: rows event for unknown table id %v", id)
+	}
+	ev.Table = tm
+	if count != len(tm.Types) {
+		return nil, fmt.Errorf("binlog: rows event for %v.%v has %v columns, its table map %v",
+			tm.Schema, tm.Table, count, len(tm.Types))
+	}
+
+	info := make([]ColumnInfo, count)
+	if p.Columns != nil {
+		cols, ok := p.Columns(tm.Schema, tm.Table)
+		if !ok {
+			return ev, nil
+		}
+		copy(info, cols)
+	}
+
+	ev.Rows = make([]Row, 0, 1)
+	for b.left() > 0 && b.err == nil {
+		var (
+			row Row
+			err error
+		)
+		switch ev.Kind {
+		case RowsInsert:
+			row.After, err = p.decodeRow(b, tm, info, present)
+		case RowsDelete:
+			row.Before, err = p.decodeRow(b, tm, info, present)
+		case RowsUpdate:
+			row.Before, err = p.decodeRow(b, tm, info, present)
+			if err == nil {
+				row.After, err = p.decodeRow(b, tm, info, presentAfter)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		ev.Rows = append(ev.Rows, row)
+	}
+
+	return ev, b.err
+}
+
+/* only full row images are supported (binlog_row_image = FULL), with a
+ * minimal image there would be no telling a NULL from a missing value */
+func (p *Parser) decodeRow(b *buf, tm *TableMap, info []ColumnInfo, present []bool) ([][]byte, error) {
+	for _, ok := range present {
+		if !ok {
+			return nil, fmt.Errorf("binlog: row of %v.%v is missing columns, binlog_row_image has to be FULL",
+				tm.Schema, tm.Table)
+		}
+	}
+
+	nulls := b.bitmap(len(present))
+	row := make([][]byte, len(present))
+	for i := range row {
+		if nulls[i] {
+			continue
+		}
+
+		val, err := p.decodeValue(b, tm.Types[i], tm.Meta[i], info[i])
+		if err != nil {
+			return nil, fmt.Errorf("binlog: column %v of %v.%v: %v", i+1, tm.Schema, tm.Table, err)
+		}
+		row[i] = val
+	}
+
+	return row, b.err
+}
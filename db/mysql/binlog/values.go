@@ -0,0 +1,331 @@
+package binlog
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* the column types, as they appear in the table map */
+const (
+	TypeDecimal    = 0
+	TypeTiny       = 1
+	TypeShort      = 2
+	TypeLong       = 3
+	TypeFloat      = 4
+	TypeDouble     = 5
+	TypeNull       = 6
+	TypeTimestamp  = 7
+	TypeLonglong   = 8
+	TypeInt24      = 9
+	TypeDate       = 10
+	TypeTime       = 11
+	TypeDatetime   = 12
+	TypeYear       = 13
+	TypeNewDate    = 14
+	TypeVarchar    = 15
+	TypeBit        = 16
+	TypeTimestamp2 = 17
+	TypeDatetime2  = 18
+	TypeTime2      = 19
+	TypeJson       = 245
+	TypeNewDecimal = 246
+	TypeEnum       = 247
+	TypeSet        = 248
+	TypeTinyBlob   = 249
+	TypeMediumBlob = 250
+	TypeLongBlob   = 251
+	TypeBlob       = 252
+	TypeVarString  = 253
+	TypeString     = 254
+	TypeGeometry   = 255
+)
+
+const zeroDatetime = "0000-00-00 00:00:00"
+
+/* decodes a value in its binary row format into the format of the MySQL
+ * text protocol, so that it looks the same as when the row is SELECTed */
+func (p *Parser) decodeValue(b *buf, t byte, meta uint16, info ColumnInfo) ([]byte, error) {
+	switch t {
+	case TypeTiny:
+		return integer(b.uintN(1), 8, info.Unsigned), nil
+	case TypeShort:
+		return integer(b.uintN(2), 16, info.Unsigned), nil
+	case TypeInt24:
+		return integer(b.uintN(3), 24, info.Unsigned), nil
+	case TypeLong:
+		return integer(b.uintN(4), 32, info.Unsigned), nil
+	case TypeLonglong:
+		return integer(b.uintN(8), 64, info.Unsigned), nil
+	case TypeFloat:
+		f := math.Float32frombits(b.uint32())
+		return []byte(strconv.FormatFloat(float64(f), 'g', -1, 32)), nil
+	case TypeDouble:
+		f := math.Float64frombits(b.uint64())
+		return []byte(strconv.FormatFloat(f, 'g', -1, 64)), nil
+	case TypeNewDecimal:
+		return []byte(decodeDecimal(b, int(meta>>8), int(meta&0xff))), nil
+	case TypeYear:
+		if y := b.uint8(); y != 0 {
+			return []byte(strconv.Itoa(1900 + int(y))), nil
+		}
+		return []byte("0000"), nil
+	case TypeDate:
+		v := b.uintN(3)
+		return []byte(fmt.Sprintf("%04d-%02d-%02d", v>>9, (v>>5)&15, v&31)), nil
+	case TypeTime:
+		v := b.uintN(3)
+		return []byte(fmt.Sprintf("%02d:%02d:%02d", v/10000, v%10000/100, v%100)), nil
+	case TypeDatetime:
+		v := b.uint64()
+		if v == 0 {
+			return []byte(zeroDatetime), nil
+		}
+		d, t := v/1000000, v%1000000
+		return []byte(fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d",
+			d/10000, d%10000/100, d%100, t/10000, t%10000/100, t%100)), nil
+	case TypeTimestamp:
+		sec := b.uint32()
+		if sec == 0 {
+			return []byte(zeroDatetime), nil
+		}
+		return []byte(time.Unix(int64(sec), 0).In(p.Location).Format("2006-01-02 15:04:05")), nil
+	case TypeTimestamp2:
+		sec := b.beUintN(4)
+		usec := fraction(b, meta)
+		if sec == 0 && usec == 0 {
+			return []byte(zeroDatetime + formatFraction(0, meta)), nil
+		}
+		ts := time.Unix(int64(sec), 0).In(p.Location).Format("2006-01-02 15:04:05")
+		return []byte(ts + formatFraction(usec, meta)), nil
+	case TypeDatetime2:
+		v := int64(b.beUintN(5)) - 0x8000000000
+		usec := fraction(b, meta)
+		return []byte(packedDatetime(v) + formatFraction(usec, meta)), nil
+	case TypeTime2:
+		return []byte(decodeTime2(b, meta)), nil
+	case TypeVarchar, TypeVarString:
+		if meta < 256 {
+			return copyBytes(b.bytes(int(b.uint8()))), nil
+		}
+		return copyBytes(b.bytes(int(b.uint16()))), nil
+	case TypeString, TypeEnum, TypeSet:
+		return decodeString(b, t, meta, info), nil
+	case TypeBlob, TypeTinyBlob, TypeMediumBlob, TypeLongBlob, TypeGeometry:
+		return copyBytes(b.bytes(int(b.uintN(int(meta))))), nil
+	case TypeJson:
+		data := b.bytes(int(b.uintN(int(meta))))
+		if b.err != nil {
+			return nil, b.err
+		}
+		return decodeJson(data)
+	case TypeBit:
+		nbits := int(meta>>8)*8 + int(meta&0xff)
+		return copyBytes(b.bytes((nbits + 7) / 8)), nil
+	default:
+		return nil, fmt.Errorf("unsupported column type %v", t)
+	}
+}
+
+func copyBytes(p []byte) []byte {
+	return append(make([]byte, 0, len(p)), p...)
+}
+
+/* integers are logged without their signedness, as bits-wide two's
+ * complement */
+func integer(v uint64, bits uint, unsigned bool) []byte {
+	if unsigned {
+		return []byte(strconv.FormatUint(v, 10))
+	}
+	signed := int64(v<<(64-bits)) >> (64 - bits)
+	return []byte(strconv.FormatInt(signed, 10))
+}
+
+/* the fractional seconds of the temporal types, in microseconds. They take
+ * one byte per two digits of precision. */
+func fraction(b *buf, fsp uint16) int64 {
+	switch (fsp + 1) / 2 {
+	case 1:
+		return int64(b.beUintN(1)) * 10000
+	case 2:
+		return int64(b.beUintN(2)) * 100
+	case 3:
+		return int64(b.beUintN(3))
+	default:
+		return 0
+	}
+}
+
+func formatFraction(usec int64, fsp uint16) string {
+	if fsp == 0 {
+		return ""
+	}
+	return "." + fmt.Sprintf("%06d", usec)[:fsp]
+}
+
+/* year*13+month, day, hour, minute and second, packed into 40 bits */
+func packedDatetime(v int64) string {
+	if v == 0 {
+		return zeroDatetime
+	}
+	if v < 0 {
+		v = -v
+	}
+
+	ymd, hms := v>>17, v%(1<<17)
+	ym := ymd >> 5
+	return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d",
+		ym/13, ym%13, ymd%(1<<5), hms>>12, (hms>>6)%(1<<6), hms%(1<<6))
+}
+
+/* a TIME with fractional seconds: hours, minutes and seconds packed into
+ * 24 bits, with the fraction after it. Negative times are stored as the
+ * two's complement of the whole, so the fraction has to borrow from the
+ * integer part. */
+func decodeTime2(b *buf, fsp uint16) string {
+	var v int64
+	switch (fsp + 1) / 2 {
+	case 0:
+		v = (int64(b.beUintN(3)) - 0x800000) << 24
+	case 1:
+		i, f := int64(b.beUintN(3))-0x800000, int64(b.beUintN(1))
+		if i < 0 && f > 0 {
+			i++
+			f -= 0x100
+		}
+		v = i<<24 + f*10000
+	case 2:
+		i, f := int64(b.beUintN(3))-0x800000, int64(b.beUintN(2))
+		if i < 0 && f > 0 {
+			i++
+			f -= 0x10000
+		}
+		v = i<<24 + f*100
+	default:
+		v = int64(b.beUintN(6)) - 0x800000000000
+	}
+
+	return packedTime(v, fsp)
+}
+
+/* hours, minutes and seconds in the upper bits, microseconds in the lower
+ * 24 bits */
+func packedTime(v int64, fsp uint16) string {
+	sign := ""
+	if v < 0 {
+		v = -v
+		sign = "-"
+	}
+
+	hms, usec := v>>24, v%(1<<24)
+	return fmt.Sprintf("%v%02d:%02d:%02d", sign, (hms>>12)%(1<<10), (hms>>6)%(1<<6), hms%(1<<6)) +
+		formatFraction(usec, fsp)
+}
+
+/* CHAR, BINARY, ENUM and SET all show up as STRING in the table map, the
+ * real type is in the metadata. So is the maximum length, some bits of which
+ * are stored in the type byte. */
+func decodeString(b *buf, t byte, meta uint16, info ColumnInfo) []byte {
+	length := int(meta & 0xff)
+	if t == TypeString {
+		if realType := byte(meta >> 8); realType&0x30 != 0x30 {
+			length |= int((realType&0x30)^0x30) << 4
+			t = realType | 0x30
+		} else {
+			t = realType
+		}
+	}
+
+	switch t {
+	case TypeEnum:
+		idx := int(b.uintN(length))
+		switch {
+		case idx == 0:
+			/* the value for an invalid member */
+			return []byte{}
+		case idx <= len(info.Values):
+			return []byte(info.Values[idx-1])
+		default:
+			return []byte(strconv.Itoa(idx))
+		}
+	case TypeSet:
+		bits := b.uintN(length)
+		if info.Values == nil {
+			return []byte(strconv.FormatUint(bits, 10))
+		}
+		members := make([]string, 0, 4)
+		for i, member := range info.Values {
+			if bits&(1<<uint(i)) != 0 {
+				members = append(members, member)
+			}
+		}
+		return []byte(strings.Join(members, ","))
+	default:
+		if length < 256 {
+			return copyBytes(b.bytes(int(b.uint8())))
+		}
+		return copyBytes(b.bytes(int(b.uint16())))
+	}
+}
+
+/* the number of bytes the leftover digits (less than 9) of a decimal take */
+var decimalBytes = [10]int{0, 1, 1, 2, 2, 3, 3, 4, 4, 4}
+
+/* DECIMAL is stored as groups of 9 digits in 4 bytes, big endian, with the
+ * leftover digits in as few bytes as they need. The integral part's
+ * leftover digits come first, the fractional part's last. The sign is the
+ * inverted first bit, and negative numbers have all their bits inverted. */
+func decodeDecimal(b *buf, precision, scale int) string {
+	integral := precision - scale
+	intFull, intLeft := integral/9, integral%9
+	fracFull, fracLeft := scale/9, scale%9
+
+	size := intFull*4 + decimalBytes[intLeft] + fracFull*4 + decimalBytes[fracLeft]
+	data := copyBytes(b.bytes(size))
+	if len(data) == 0 {
+		return "0"
+	}
+
+	negative := data[0]&0x80 == 0
+	data[0] ^= 0x80
+	if negative {
+		for i := range data {
+			data[i] ^= 0xff
+		}
+	}
+
+	d := &buf{data: data}
+	group := func(n, digits int) string {
+		return fmt.Sprintf("%0*d", digits, d.beUintN(n))
+	}
+
+	var intPart, fracPart string
+	if intLeft > 0 {
+		intPart += group(decimalBytes[intLeft], intLeft)
+	}
+	for i := 0; i < intFull; i++ {
+		intPart += group(4, 9)
+	}
+	for i := 0; i < fracFull; i++ {
+		fracPart += group(4, 9)
+	}
+	if fracLeft > 0 {
+		fracPart += group(decimalBytes[fracLeft], fracLeft)
+	}
+
+	intPart = strings.TrimLeft(intPart, "0")
+	if intPart == "" {
+		intPart = "0"
+	}
+
+	s := intPart
+	if scale > 0 {
+		s += "." + fracPart
+	}
+	if negative {
+		s = "-" + s
+	}
+	return s
+}
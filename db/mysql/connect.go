@@ -4,24 +4,40 @@ import (
 	"database/sql"
 	"fmt"
 	. "github.com/aktau/gomig/db/common"
+	"github.com/aktau/gomig/db/mysql/binlog"
 	_ "github.com/go-sql-driver/mysql"
+	"net/url"
+	"strings"
 )
 
-func openDB(conf *Config) (*sql.DB, error) {
-	protocol := "unix"
-	address := conf.Socket
-	if address == "" {
-		protocol = "tcp"
-		port := 3306
-		if conf.Port != 0 {
-			port = conf.Port
-		}
-		address = fmt.Sprintf("%v:%v", conf.Hostname, port)
+/* the socket if there is one, TCP otherwise */
+func address(conf *Config) (protocol string, address string) {
+	if conf.Socket != "" {
+		return "unix", conf.Socket
+	}
+
+	port := 3306
+	if conf.Port != 0 {
+		port = conf.Port
 	}
+	return "tcp", fmt.Sprintf("%v:%v", conf.Hostname, port)
+}
+
+func openDB(conf *Config) (*sql.DB, error) {
+	protocol, address := address(conf)
 
 	/* root:pw@unix(/tmp/mysql.sock)/myDatabase?loc=Local */
 	uri := fmt.Sprintf("%v:%v@%v(%v)/%v", conf.Username, conf.Password,
 		protocol, address, conf.Database)
+
+	params := make([]string, 0, len(conf.Options))
+	for _, key := range conf.OptionKeys() {
+		params = append(params, key+"="+url.QueryEscape(conf.Options[key]))
+	}
+	if len(params) > 0 {
+		uri += "?" + strings.Join(params, "&")
+	}
+
 	db, err := sql.Open("mysql", uri)
 	if err != nil {
 		return nil, err
@@ -35,3 +51,15 @@ func openDB(conf *Config) (*sql.DB, error) {
 
 	return db, nil
 }
+
+/* the connection parameters for streaming the binlog of the server */
+func ReplicationConfig(conf *Config, serverId uint32) *binlog.ClientConfig {
+	protocol, address := address(conf)
+	return &binlog.ClientConfig{
+		Network:  protocol,
+		Address:  address,
+		Username: conf.Username,
+		Password: conf.Password,
+		ServerId: serverId,
+	}
+}
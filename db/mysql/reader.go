@@ -4,8 +4,11 @@ import (
 	"database/sql"
 	"fmt"
 	. "github.com/aktau/gomig/db/common"
+	"github.com/aktau/gomig/db/mysql/binlog"
 	"log"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -14,11 +17,58 @@ var (
 
 var (
 	mysqlInit = []string{
-		"SET collation_connection = utf8_general_ci",
-		"SET NAMES utf8",
+		"SET NAMES " + charset + " COLLATE " + collation,
 	}
 )
 
+const (
+	foreignKeysQuery = `
+SELECT kcu.CONSTRAINT_NAME, kcu.COLUMN_NAME,
+       kcu.REFERENCED_TABLE_NAME, kcu.REFERENCED_COLUMN_NAME,
+       rc.UPDATE_RULE, rc.DELETE_RULE
+FROM   information_schema.KEY_COLUMN_USAGE kcu
+JOIN   information_schema.REFERENTIAL_CONSTRAINTS rc ON (
+       rc.CONSTRAINT_SCHEMA = kcu.CONSTRAINT_SCHEMA
+AND    rc.CONSTRAINT_NAME = kcu.CONSTRAINT_NAME
+AND    rc.TABLE_NAME = kcu.TABLE_NAME
+)
+WHERE  kcu.TABLE_SCHEMA = DATABASE()
+AND    kcu.TABLE_NAME = ?
+AND    kcu.REFERENCED_TABLE_NAME IS NOT NULL
+ORDER BY kcu.CONSTRAINT_NAME, kcu.ORDINAL_POSITION;`
+
+	/* the same information SHOW INDEX gives, but with a fixed set of
+	 * columns across MySQL versions */
+	indicesQuery = `
+SELECT INDEX_NAME, NON_UNIQUE, COLUMN_NAME, INDEX_TYPE
+FROM   information_schema.STATISTICS
+WHERE  TABLE_SCHEMA = DATABASE()
+AND    TABLE_NAME = ?
+AND    INDEX_NAME <> 'PRIMARY'
+ORDER BY INDEX_NAME, SEQ_IN_INDEX;`
+
+	/* the comment of the table (with an empty column name) and those of
+	 * its columns */
+	commentsQuery = `
+SELECT '', TABLE_COMMENT
+FROM   information_schema.TABLES
+WHERE  TABLE_SCHEMA = DATABASE()
+AND    TABLE_NAME = ?
+AND    TABLE_COMMENT <> ''
+UNION ALL
+SELECT COLUMN_NAME, COLUMN_COMMENT
+FROM   information_schema.COLUMNS
+WHERE  TABLE_SCHEMA = DATABASE()
+AND    TABLE_NAME = ?
+AND    COLUMN_COMMENT <> '';`
+)
+
+/* for chunking */
+var dialect = Dialect{
+	Quote:       quote,
+	Placeholder: func(n int) string { return "?" },
+}
+
 type MysqlReader struct {
 	*sql.DB
 }
@@ -88,8 +138,23 @@ func (r *MysqlReader) FilteredTables(incl, excl map[string]bool) []*Table {
 			log.Println("mysql: could not fetch columns of table", tableName, "error:", err)
 		}
 
+		indices, uniqueKeys, err := r.indices(tableName)
+		if err != nil {
+			log.Println("mysql: could not fetch indices of table", tableName, "error:", err)
+		}
+
+		foreignKeys, err := r.foreignKeys(tableName)
+		if err != nil {
+			log.Println("mysql: could not fetch foreign keys of table", tableName, "error:", err)
+		}
+
 		/* create table struct */
-		table := &Table{Name: tableName, DbType: "mysql", Columns: columns}
+		table := &Table{Name: tableName, DbType: "mysql", Columns: columns,
+			Indices: indices, UniqueKeys: uniqueKeys, ForeignKeys: foreignKeys}
+
+		if err := ReadComments(r, table, commentsQuery, tableName, tableName); err != nil {
+			log.Println("mysql: could not fetch comments of table", tableName, "error:", err)
+		}
 
 		tables = append(tables, table)
 	}
@@ -155,9 +220,109 @@ func (r *MysqlReader) processCol(table string, rc *rawCol) (*Column, error) {
 	}, nil
 }
 
+/* FULLTEXT and SPATIAL indices, and indices on expressions, have no
+ * portable equivalent and are skipped */
+func (r *MysqlReader) indices(table string) ([]*Index, []*UniqueKey, error) {
+	rows, err := r.Query(indicesQuery, table)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	type rawIndex struct {
+		name    string
+		unique  bool
+		columns []string
+		skip    bool
+	}
+	raw := make([]*rawIndex, 0, 4)
+
+	var (
+		name, indexType string
+		nonUnique       int
+		col             sql.NullString
+		idx             *rawIndex
+	)
+	for rows.Next() {
+		err = rows.Scan(&name, &nonUnique, &col, &indexType)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		/* multi-column indices span multiple rows */
+		if idx == nil || idx.name != name {
+			idx = &rawIndex{name: name, unique: nonUnique == 0}
+			raw = append(raw, idx)
+		}
+		if !col.Valid || (indexType != "BTREE" && indexType != "HASH") {
+			idx.skip = true
+		}
+		idx.columns = append(idx.columns, col.String)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	indices := make([]*Index, 0, len(raw))
+	uniqueKeys := make([]*UniqueKey, 0, len(raw))
+	for _, idx := range raw {
+		switch {
+		case idx.skip:
+			log.Printf("mysql: skipping index %v of table %v, it can't be migrated\n", idx.name, table)
+		case idx.unique:
+			uniqueKeys = append(uniqueKeys, &UniqueKey{Name: idx.name, Columns: idx.columns})
+		default:
+			indices = append(indices, &Index{Name: idx.name, Columns: idx.columns})
+		}
+	}
+
+	return indices, uniqueKeys, nil
+}
+
+func (r *MysqlReader) foreignKeys(table string) ([]*ForeignKey, error) {
+	rows, err := r.Query(foreignKeysQuery, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fks := make([]*ForeignKey, 0, 2)
+
+	var (
+		name, col, refTable, refCol string
+		onUpdate, onDelete          string
+		fk                          *ForeignKey
+	)
+	for rows.Next() {
+		err = rows.Scan(&name, &col, &refTable, &refCol, &onUpdate, &onDelete)
+		if err != nil {
+			return nil, err
+		}
+
+		/* multi-column keys span multiple rows */
+		if fk == nil || fk.Name != name {
+			fk = &ForeignKey{Name: name, RefTable: refTable,
+				OnUpdate: onUpdate, OnDelete: onDelete}
+			fks = append(fks, fk)
+		}
+		fk.Columns = append(fk.Columns, col)
+		fk.RefColumns = append(fk.RefColumns, refCol)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return fks, nil
+}
+
 /* caller is responsible for cleaning up the sql.Rows object */
 func (r *MysqlReader) Read(table *Table) (*sql.Rows, error) {
-	rows, err := r.Query(fmt.Sprintf("SELECT * FROM %v;", table.Name))
+	query, args := SelectQuery(dialect, table, nil)
+	rows, err := r.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -175,6 +340,29 @@ func (r *MysqlReader) Read(table *Table) (*sql.Rows, error) {
 	return rows, nil
 }
 
+func (r *MysqlReader) Chunks(table *Table, size int) ([]*Chunk, error) {
+	return ChunkTable(r, dialect, table, size)
+}
+
+/* caller is responsible for cleaning up the sql.Rows object */
+func (r *MysqlReader) ReadChunk(table *Table, c *Chunk) (*sql.Rows, error) {
+	query, args := SelectQuery(dialect, table, c)
+	return r.Query(query, args...)
+}
+
+func (r *MysqlReader) Max(table *Table, column string) (string, error) {
+	return ColumnMax(r, dialect, table, column)
+}
+
+/* the row count of InnoDB tables in information_schema is an estimate,
+ * views have none */
+func (r *MysqlReader) EstimateRows(table *Table) (int64, error) {
+	var n sql.NullInt64
+	err := r.QueryRow(`SELECT TABLE_ROWS FROM information_schema.TABLES
+WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?`, table.Name).Scan(&n)
+	return n.Int64, err
+}
+
 func (r *MysqlReader) CreateView(name string, body string) error {
 	stmt := fmt.Sprintf("CREATE VIEW %v AS %v;", name, body)
 
@@ -203,10 +391,8 @@ func (r *MysqlReader) CreateProjection(name string, body string, engine string,
 		engineSQL = " ENGINE=" + strings.ToUpper(engine)
 	}
 
-	collation := " CHARACTER SET utf8 COLLATE utf8_general_ci"
-
-	stmt := fmt.Sprintf("CREATE TABLE %v%v%v%v AS (\n%v\n);",
-		name, createPk, engineSQL, collation, body)
+	stmt := fmt.Sprintf("CREATE TABLE %v%v%v CHARACTER SET %v COLLATE %v AS (\n%v\n);",
+		name, createPk, engineSQL, charset, collation, body)
 
 	if READER_VERBOSE {
 		log.Printf("mysql: creating projection:\n%v\n", stmt)
@@ -221,3 +407,60 @@ func (r *MysqlReader) DropProjection(name string) error {
 	_, err := r.Exec(stmt)
 	return err
 }
+
+/* the position the binlog is at now, changes made after this are logged
+ * after it. MySQL 8.4 renamed the statement. */
+func (r *MysqlReader) BinlogPosition() (binlog.Position, error) {
+	var pos binlog.Position
+
+	rows, err := r.Query("SHOW MASTER STATUS;")
+	if err != nil {
+		rows, err = r.Query("SHOW BINARY LOG STATUS;")
+	}
+	if err != nil {
+		return pos, err
+	}
+	defer rows.Close()
+
+	/* the number of columns differs between versions, the first two are
+	 * the file and position */
+	cols, err := rows.Columns()
+	if err != nil {
+		return pos, err
+	}
+	vals := make([]sql.RawBytes, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return pos, err
+		}
+		return pos, fmt.Errorf("mysql: the binlog is disabled (log_bin is OFF)")
+	}
+	if err = rows.Scan(ptrs...); err != nil {
+		return pos, err
+	}
+
+	offset, err := strconv.ParseUint(string(vals[1]), 10, 32)
+	if err != nil {
+		return pos, err
+	}
+	pos.File = string(vals[0])
+	pos.Pos = uint32(offset)
+
+	return pos, rows.Err()
+}
+
+/* the time zone of the session, which TIMESTAMP columns are shown in. It's
+ * the current offset from UTC, daylight saving time is not accounted for. */
+func (r *MysqlReader) TimeZone() (*time.Location, error) {
+	var offset int
+	err := r.QueryRow("SELECT TIMESTAMPDIFF(SECOND, UTC_TIMESTAMP(), NOW());").Scan(&offset)
+	if err != nil {
+		return nil, err
+	}
+	return time.FixedZone("", offset), nil
+}
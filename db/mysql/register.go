@@ -0,0 +1,34 @@
+package mysql
+
+import (
+	"io"
+
+	"github.com/aktau/gomig/db"
+	. "github.com/aktau/gomig/db/common"
+)
+
+func init() {
+	db.RegisterReader("mysql", func(conf *Config) (ReadCloser, error) {
+		r, err := OpenReader(conf)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	})
+
+	db.RegisterWriter("mysql", func(conf *Config) (WriteCloser, error) {
+		w, err := NewMysqlWriter(conf)
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	})
+
+	db.RegisterFileWriter("mysql", func(out io.Writer) (WriteCloser, error) {
+		w, err := NewMysqlFileWriter(out)
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	})
+}
@@ -1,11 +1,23 @@
 package mysql
 
 import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
 	. "github.com/aktau/gomig/db/common"
 	"log"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
+)
+
+/* the character set of the connections and the tables gomig creates. utf8
+ * is utf8mb3 in MySQL, which can't hold the characters outside of the Basic
+ * Multilingual Plane (like emoji) */
+const (
+	charset   = "utf8mb4"
+	collation = "utf8mb4_unicode_ci"
 )
 
 func MysqlToGenericType(mysqlType string) *Type {
@@ -89,3 +101,149 @@ func ExtractPrecisionAndScale(mysqlType string) (uint, uint) {
 
 	return uint(precision), uint(scale)
 }
+
+func GenericToMysqlType(genericType *Type) string {
+	gen := genericType
+	name := gen.Name
+	max := gen.Max
+	precision := gen.Precision
+	scale := gen.Scale
+	modifier := gen.Modifier
+
+	switch name {
+	case TypeText:
+		/* VARCHAR's are limited to 65535 bytes, which is 16383 characters
+		 * in the worst case */
+		if gen.HasMax() && max <= 16383 {
+			return fmt.Sprintf("varchar(%v)", max)
+		}
+		return "longtext"
+	case TypeChar:
+		if !gen.HasMax() {
+			return "char"
+		}
+		if max > 255 {
+			return fmt.Sprintf("varchar(%v)", max)
+		}
+		return fmt.Sprintf("char(%v)", max)
+	case TypeFloat:
+		return "float"
+	case TypeDouble:
+		return "double"
+	case TypeNumeric:
+		/* an unconstrained numeric, use the largest decimal there is */
+		if precision == 0 {
+			return "decimal(65, 30)"
+		}
+		return fmt.Sprintf("decimal(%v, %v)", precision, scale)
+	case TypeBit:
+		if !gen.HasMax() || max > 64 {
+			return "bit(64)"
+		}
+		return fmt.Sprintf("bit(%v)", max)
+	case TypeBlob:
+		return "longblob"
+	case TypeBool:
+		return "tinyint(1)"
+	case TypeInteger:
+		switch modifier {
+		case TypeSmall:
+			return "smallint"
+		case TypeNormal:
+			return "int"
+		case TypeLarge:
+			return "bigint"
+		case TypeHuge:
+			return "bigint unsigned"
+		default:
+			return "int"
+		}
+	case TypeDate:
+		return "date"
+	case TypeTime:
+		return "time"
+	case TypeTimeStamp:
+		return "datetime(6)"
+	case TypeSet:
+		/* the members of the set are not known anymore */
+		return "text"
+	case TypeJson:
+		return "json"
+	default:
+		return name
+	}
+}
+
+/* converts a RawBytes field into something you can put into a regular
+ * insert statement */
+func RawToMysql(val []byte, origType *Type) (string, error) {
+	if val == nil {
+		return "NULL", nil
+	}
+
+	switch origType.Name {
+	case TypeBool:
+		switch string(val) {
+		case "0", "f", "false":
+			return "0", nil
+		case "1", "t", "true":
+			return "1", nil
+		default:
+			return "", fmt.Errorf("mysql: did not recognize bool value: %v", string(val))
+		}
+	case TypeNumeric, TypeInteger, TypeFloat, TypeDouble:
+		return string(val), nil
+	case TypeBit:
+		/* postgres hands out bit strings as text ("0101"), MySQL as the
+		 * bytes that hold the bits */
+		if IsBitText(val, origType.Max) {
+			return "b'" + string(val) + "'", nil
+		}
+		return "X'" + hex.EncodeToString(val) + "'", nil
+	case TypeBlob:
+		return "X'" + hex.EncodeToString(val) + "'", nil
+	case TypeTimeStamp:
+		return "'" + normalizeTime(string(val), "2006-01-02 15:04:05.999999") + "'", nil
+	case TypeDate:
+		return "'" + normalizeTime(string(val), "2006-01-02") + "'", nil
+	default:
+		return "'" + escapeString(string(val)) + "'", nil
+	}
+}
+
+/* some drivers (e.g. lib/pq) hand out timestamps as time.Time, which
+ * database/sql formats as RFC 3339 when scanning into RawBytes. MySQL
+ * doesn't understand the timezone part of that. */
+func normalizeTime(val string, layout string) string {
+	t, err := time.Parse(time.RFC3339Nano, val)
+	if err != nil {
+		return val
+	}
+	return t.Format(layout)
+}
+
+/* escapes a string the same way mysql_real_escape_string() does */
+func escapeString(str string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(str); i++ {
+		switch c := str[i]; c {
+		case 0:
+			buf.WriteString(`\0`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\'':
+			buf.WriteString(`\'`)
+		case '"':
+			buf.WriteString(`\"`)
+		case '\032':
+			buf.WriteString(`\Z`)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
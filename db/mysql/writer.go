@@ -0,0 +1,781 @@
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	. "github.com/aktau/gomig/db/common"
+)
+
+var MYSQL_W_VERBOSE = true
+
+var (
+	mysqlWriterInit = []string{
+		"SET NAMES " + charset + " COLLATE " + collation + ";",
+		"SET FOREIGN_KEY_CHECKS = 0;",
+		"SET SQL_MODE = 'NO_AUTO_VALUE_ON_ZERO';",
+	}
+)
+
+type genericMysqlWriter struct {
+	e               Executor
+	insertBulkLimit int
+
+	/* whether a destination table has a unique index on the columns it's
+	 * merged on, by table name */
+	uniqueKeys map[string]bool
+}
+
+/* MySQL doesn't have anything like postgres' COPY FROM that works
+ * everywhere (LOAD DATA LOCAL INFILE is usually disabled server-side), so
+ * the data is sent as multi-row INSERT statements */
+func (w *genericMysqlWriter) transferTable(src *Table, dstName string, r Reader, c *Chunk) (int64, error) {
+	rows, err := ReadRows(r, src, c)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	if MYSQL_W_VERBOSE {
+		log.Print("mysql: query done, scanning rows...")
+	}
+
+	colnames := make([]string, 0, len(src.Columns))
+	for _, col := range src.Columns {
+		colnames = append(colnames, quote(col.Name))
+	}
+	insertQ := fmt.Sprintf("INSERT INTO %v (%v) VALUES\n\t",
+		quote(dstName), strings.Join(colnames, ", "))
+
+	pointers := make([]interface{}, len(src.Columns))
+	containers := make([]sql.RawBytes, len(src.Columns))
+	for i, _ := range pointers {
+		pointers[i] = &containers[i]
+	}
+	stringrep := make([]string, 0, len(src.Columns))
+	insertLines := make([]string, 0, 32)
+	var n int64
+	for rows.Next() {
+		err := rows.Scan(pointers...)
+		if err != nil {
+			log.Println("mysql: error while reading from source:", err)
+			return n, err
+		}
+
+		for idx, val := range containers {
+			str, err := RawToMysql(val, src.Columns[idx].Type)
+			if err != nil {
+				return n, err
+			}
+			stringrep = append(stringrep, str)
+		}
+
+		insertLines = append(insertLines, "("+strings.Join(stringrep, ",")+")")
+		stringrep = stringrep[:0]
+		n++
+
+		if len(insertLines) >= w.insertBulkLimit {
+			err = w.e.Submit(insertQ + strings.Join(insertLines, ",\n\t") + ";\n")
+			if err != nil {
+				return n, err
+			}
+
+			insertLines = insertLines[:0]
+		}
+	}
+
+	if len(insertLines) > 0 {
+		err := w.e.Submit(insertQ + strings.Join(insertLines, ",\n\t") + ";\n")
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, rows.Err()
+}
+
+/* MySQL requires an auto-incrementing column to be part of a key when the
+ * table is created, so unlike with postgres the primary key is not
+ * deferred until after the load */
+func (w *genericMysqlWriter) CreateTable(src *Table, dstName string) error {
+	options := fmt.Sprintf("DEFAULT CHARSET=%v COLLATE=%v", charset, collation)
+	if src.Comment != "" {
+		options += fmt.Sprintf(" COMMENT='%v'", escapeString(src.Comment))
+	}
+	createQ := fmt.Sprintf("CREATE TABLE %v (\n\t%v\n) %v;",
+		quote(dstName), ColumnsSql(src), options)
+
+	return w.e.Transaction(fmt.Sprintf("create table %v", dstName), []string{
+		fmt.Sprintf("DROP TABLE IF EXISTS %v;", quote(dstName)),
+		createQ,
+	})
+}
+
+/* the columns are added without NOT NULL, the rows that are already there
+ * have no value for them */
+func (w *genericMysqlWriter) EvolveTable(src, dst *Table, dstName string, drop bool) (*SchemaDiff, error) {
+	d := DiffColumns(src, dst, GenericToMysqlType)
+
+	stmts := make([]string, 0, len(d.Added)+len(d.Changed)+len(d.Dropped))
+	for _, col := range d.Added {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %v ADD COLUMN %v %v;",
+			quote(dstName), quote(col.Name), GenericToMysqlType(col.Type)))
+	}
+	for _, c := range d.Changed {
+		/* MODIFY takes the whole definition, so it changes both */
+		def := fmt.Sprintf("%v %v", quote(c.Column.Name), GenericToMysqlType(c.Column.Type))
+		if !c.Column.Null || c.Column.PrimaryKey {
+			def += " NOT NULL"
+		}
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %v MODIFY COLUMN %v;", quote(dstName), def))
+	}
+	if drop {
+		for _, col := range d.Dropped {
+			stmts = append(stmts, fmt.Sprintf("ALTER TABLE %v DROP COLUMN %v;",
+				quote(dstName), quote(col.Name)))
+		}
+	}
+
+	if len(stmts) == 0 {
+		return d, nil
+	}
+	return d, w.e.Transaction(fmt.Sprintf("evolve table %v", dstName), stmts)
+}
+
+func (w *genericMysqlWriter) Truncate(dstName string) error {
+	return w.e.Transaction(fmt.Sprintf("truncate table %v", dstName),
+		[]string{fmt.Sprintf("TRUNCATE TABLE %v;", quote(dstName))})
+}
+
+/* the rows are bulk loaded into a table that was just created (or
+ * truncated), so the unique indices are only checked once the load is
+ * done. The checks are turned back on afterwards, they stay off for the
+ * rest of the session otherwise, rollback or not. */
+func (w *genericMysqlWriter) WriteTable(src *Table, dstName string, r Reader, c *Chunk) error {
+	writeTableI := fmt.Sprintf("write table %v into table %v", src.Name, dstName)
+	if c != nil {
+		writeTableI += ", " + c.String()
+	}
+	if err := w.e.Begin(writeTableI); err != nil {
+		return err
+	}
+
+	if err := w.e.Submit("SET UNIQUE_CHECKS = 0;"); err != nil {
+		w.e.Rollback()
+		return err
+	}
+
+	if _, err := w.transferTable(src, dstName, r, c); err != nil {
+		w.e.Rollback()
+		w.e.Submit("SET UNIQUE_CHECKS = 1;")
+		return err
+	}
+
+	if err := w.e.Submit("SET UNIQUE_CHECKS = 1;"); err != nil {
+		w.e.Rollback()
+		return err
+	}
+
+	return w.e.Commit()
+}
+
+/* the rows are loaded into a temporary staging table first, from which
+ * they are upserted with INSERT ... ON DUPLICATE KEY UPDATE. MySQL leaves
+ * the rows alone that wouldn't change. That needs a unique index on the
+ * merge key, without one the rows are updated with UPDATE ... JOIN and
+ * inserted with INSERT ... WHERE NOT EXISTS instead. That's also done with
+ * a destination condition: only the rows that satisfy it are inserted, and
+ * only the destination rows that satisfy it are updated or deleted, which
+ * ON DUPLICATE KEY UPDATE can't check. */
+func (w *genericMysqlWriter) MergeTable(src *Table, dstName string, opts *MergeOptions, r Reader, c *Chunk) (*MergeStats, error) {
+	tmpName := "gomig_tmp"
+
+	if len(src.PrimaryKey()) == 0 {
+		return nil, fmt.Errorf("mysql: table %v has no key to merge on", src.Name)
+	}
+
+	mergeTableI := fmt.Sprintf("merge table %v into table %v",
+		src.Name, dstName)
+	if c != nil {
+		mergeTableI += ", " + c.String()
+	}
+	if err := w.e.Begin(mergeTableI); err != nil {
+		return nil, err
+	}
+
+	/* create temporary table, MySQL doesn't implicitly commit for
+	 * temporary tables. They do survive a rollback though, so a previous
+	 * failed merge might have left one behind. */
+	tempTableQ := fmt.Sprintf("CREATE TEMPORARY TABLE %v (\n\t%v\n) DEFAULT CHARSET=%v COLLATE=%v;\n",
+		tmpName, ColumnsSql(src), charset, collation)
+	for _, stmt := range []string{"DROP TEMPORARY TABLE IF EXISTS " + tmpName + ";", tempTableQ} {
+		if err := w.e.Submit(stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	n, err := w.transferTable(src, tmpName, r, c)
+	if err != nil {
+		w.e.Rollback()
+		return nil, err
+	}
+
+	if MYSQL_W_VERBOSE {
+		log.Print("mysql: rowscan done, creating merge statements")
+	}
+
+	unique, err := w.hasUniqueIndex(dstName, src.PrimaryKey())
+	if err != nil {
+		w.e.Rollback()
+		return nil, err
+	}
+
+	scope, err := opts.Scope()
+	if err != nil {
+		w.e.Rollback()
+		return nil, fmt.Errorf("mysql: can't merge table %v: %v", dstName, err)
+	}
+
+	/* the number of affected rows MySQL reports for an upsert depends
+	 * on the client flags, so the rows are counted beforehand */
+	counting := w.e.HasCapability(CapResults)
+	stats := &MergeStats{}
+	if counting {
+		countQ := countSql(src, dstName, tmpName, scope)
+		if err := w.e.QueryRow(countQ, &stats.Inserted, &stats.Updated); err != nil {
+			return nil, err
+		}
+		stats.Unchanged = n - stats.Inserted - stats.Updated
+	}
+
+	mergeQs := []string{upsertSql(src, dstName, tmpName)}
+	if !unique || scope != "" {
+		mergeQs = joinMergeSql(src, dstName, tmpName, scope)
+	}
+	for _, mergeQ := range mergeQs {
+		if err := w.e.Submit(mergeQ); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.DeleteMissing {
+		deleteQ, err := deleteMissingSql(src, dstName, tmpName, scope, opts, c)
+		if err != nil {
+			w.e.Rollback()
+			return nil, fmt.Errorf("mysql: can't delete the missing rows of table %v: %v", dstName, err)
+		}
+		if stats.Deleted, err = w.e.SubmitCount(deleteQ); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := w.e.Submit(fmt.Sprintf("DROP TEMPORARY TABLE %v;", tmpName)); err != nil {
+		return nil, err
+	}
+
+	if err := w.e.Commit(); err != nil {
+		return nil, err
+	}
+	if !counting {
+		return nil, nil
+	}
+	return stats, nil
+}
+
+/* whether the destination table has a unique index on exactly the given
+ * columns, which ON DUPLICATE KEY UPDATE relies on. The indices of the
+ * table a file will be loaded into aren't known, so there it's assumed to
+ * have none. */
+func (w *genericMysqlWriter) hasUniqueIndex(dstName string, cols []string) (bool, error) {
+	if !w.e.HasCapability(CapResults) {
+		return false, nil
+	}
+	if unique, ok := w.uniqueKeys[dstName]; ok {
+		return unique, nil
+	}
+
+	names := make([]string, 0, len(cols))
+	for _, col := range cols {
+		names = append(names, "'"+escapeString(col)+"'")
+	}
+
+	var n int64
+	q := fmt.Sprintf(`
+SELECT COUNT(*)
+FROM   (SELECT INDEX_NAME
+        FROM   information_schema.STATISTICS
+        WHERE  TABLE_SCHEMA = DATABASE()
+        AND    TABLE_NAME = '%[1]v'
+        AND    NON_UNIQUE = 0
+        GROUP BY INDEX_NAME
+        HAVING COUNT(*) = %[3]v
+        AND    SUM(COLUMN_NAME IN (%[2]v)) = %[3]v) AS idx;`,
+		escapeString(dstName), strings.Join(names, ", "), len(cols))
+	if err := w.e.QueryRow(q, &n); err != nil {
+		return false, fmt.Errorf("mysql: could not look up the unique indices of %v: %v", dstName, err)
+	}
+
+	if n == 0 {
+		log.Printf("mysql: table %v has no unique index on (%v), merging with UPDATE and INSERT",
+			dstName, strings.Join(cols, ", "))
+	}
+	w.uniqueKeys[dstName] = n > 0
+	return n > 0, nil
+}
+
+/* if the table is all primary key (as far as we know), the existing rows
+ * are left alone */
+func upsertSql(src *Table, dstName, tmpName string) string {
+	colnames := make([]string, 0, len(src.Columns))
+	srccol := make([]string, 0, len(src.Columns))
+	colassign := make([]string, 0, len(src.Columns))
+	for _, col := range src.Columns {
+		colnames = append(colnames, quote(col.Name))
+		srccol = append(srccol, "src."+quote(col.Name))
+		if !col.PrimaryKey {
+			colassign = append(colassign, fmt.Sprintf("%[1]v = VALUES(%[1]v)", quote(col.Name)))
+		}
+	}
+
+	insert := "INSERT"
+	onDuplicate := ""
+	if len(colassign) == 0 {
+		insert = "INSERT IGNORE"
+	} else {
+		onDuplicate = "\nON DUPLICATE KEY UPDATE\n       " +
+			strings.Join(colassign, ",\n       ")
+	}
+
+	return fmt.Sprintf(`
+%v INTO %v (%v)
+SELECT %v
+FROM   %v AS src%v;`, insert, quote(dstName), strings.Join(colnames, ", "),
+		strings.Join(srccol, ",\n       "), tmpName, onDuplicate)
+}
+
+/* updates the rows that differ and inserts the new ones, without relying
+ * on a unique index. The temporary table can only be referred to once per
+ * statement, so the scope of the rows goes into a derived table. */
+func joinMergeSql(src *Table, dstName, tmpName, scope string) []string {
+	srcRows := scopedRowsSql(tmpName, scope)
+
+	colnames := make([]string, 0, len(src.Columns))
+	srccol := make([]string, 0, len(src.Columns))
+	pkWhere := make([]string, 0, 2)
+	dstcmp := make([]string, 0, len(src.Columns))
+	srccmp := make([]string, 0, len(src.Columns))
+	colassign := make([]string, 0, len(src.Columns))
+	for _, col := range src.Columns {
+		colnames = append(colnames, quote(col.Name))
+		srccol = append(srccol, "src."+quote(col.Name))
+		if col.PrimaryKey {
+			pkWhere = append(pkWhere, fmt.Sprintf("dst.%[1]v = src.%[1]v", quote(col.Name)))
+		} else {
+			dstcmp = append(dstcmp, "dst."+quote(col.Name))
+			srccmp = append(srccmp, "src."+quote(col.Name))
+			colassign = append(colassign, fmt.Sprintf("dst.%[1]v = src.%[1]v", quote(col.Name)))
+		}
+	}
+	pkWherePart := strings.Join(pkWhere, " AND ")
+
+	insertQ := fmt.Sprintf(`
+INSERT INTO %[1]v (%[2]v)
+SELECT %[3]v
+FROM   %[4]v AS src
+WHERE  NOT EXISTS (SELECT 1 FROM %[1]v AS dst WHERE %[5]v);`, quote(dstName),
+		strings.Join(colnames, ", "), strings.Join(srccol, ",\n       "), srcRows, pkWherePart)
+	if len(colassign) == 0 {
+		return []string{insertQ}
+	}
+
+	/* the update goes first, so it doesn't compare the inserted rows */
+	updateQ := fmt.Sprintf(`
+UPDATE %v AS dst
+JOIN   %v AS src ON %v
+SET    %v
+WHERE  NOT ((%v) <=> (%v))%v;`, quote(dstName), srcRows, pkWherePart,
+		strings.Join(colassign, ",\n       "), strings.Join(dstcmp, ", "),
+		strings.Join(srccmp, ", "), scopeSql(scope))
+	return []string{updateQ, insertQ}
+}
+
+/* counts the rows of the temp table that will be inserted, and those that
+ * will be updated because they differ from the destination row */
+func countSql(src *Table, dstName, tmpName, scope string) string {
+	pkWhere := make([]string, 0, 2)
+	dstcol := make([]string, 0, len(src.Columns))
+	srccol := make([]string, 0, len(src.Columns))
+	for _, col := range src.Columns {
+		if col.PrimaryKey {
+			pkWhere = append(pkWhere, fmt.Sprintf("dst.%[1]v = src.%[1]v", quote(col.Name)))
+		} else {
+			dstcol = append(dstcol, "dst."+quote(col.Name))
+			srccol = append(srccol, "src."+quote(col.Name))
+		}
+	}
+	pkWherePart := strings.Join(pkWhere, " AND ")
+
+	/* only the destination rows in the scope are updated */
+	updateWhere := pkWherePart
+	if scope != "" {
+		updateWhere += " AND (" + scope + ")"
+	}
+	changed := "0"
+	if len(dstcol) != 0 {
+		changed = fmt.Sprintf("COALESCE(SUM(EXISTS (SELECT 1 FROM %v AS dst WHERE %v AND NOT ((%v) <=> (%v)))), 0)",
+			quote(dstName), updateWhere, strings.Join(dstcol, ", "), strings.Join(srccol, ", "))
+	}
+
+	return fmt.Sprintf(`
+SELECT COALESCE(SUM(NOT EXISTS (SELECT 1 FROM %v AS dst WHERE %v)), 0),
+       %v
+FROM   %v AS src;`, quote(dstName), pkWherePart, changed, scopedRowsSql(tmpName, scope))
+}
+
+/* deletes the destination rows whose primary key isn't in the temp table,
+ * or marks them as deleted. Only the rows in the range of the chunk (if
+ * any) are in the temp table, the others are left alone. */
+func deleteMissingSql(src *Table, dstName, tmpName, scope string, opts *MergeOptions, c *Chunk) (string, error) {
+	dstCol := func(name string) string { return "dst." + quote(name) }
+
+	pkWhere := make([]string, 0, 2)
+	for _, col := range src.Columns {
+		if col.PrimaryKey {
+			pkWhere = append(pkWhere, fmt.Sprintf("src.%v = %v", quote(col.Name), dstCol(col.Name)))
+		}
+	}
+	if len(pkWhere) == 0 {
+		return "", fmt.Errorf("it has no primary key")
+	}
+
+	conds := []string{fmt.Sprintf("NOT EXISTS (SELECT 1 FROM %v AS src WHERE %v)",
+		tmpName, strings.Join(pkWhere, " AND "))}
+	if c != nil {
+		cond, err := ChunkLiteralCondition(dstCol, src, c, RawToMysql)
+		if err != nil {
+			return "", err
+		}
+		if cond != "" {
+			conds = append(conds, cond)
+		}
+	}
+	if scope != "" {
+		conds = append(conds, "("+scope+")")
+	}
+
+	if sd := opts.SoftDelete; sd != nil {
+		return fmt.Sprintf(`
+UPDATE %[1]v AS dst
+SET    %[2]v = %[3]v
+WHERE  NOT (%[2]v <=> %[3]v)
+AND    %[4]v;`, quote(dstName), dstCol(sd.Column), sd.Value, strings.Join(conds, "\nAND    ")), nil
+	}
+
+	return fmt.Sprintf(`
+DELETE dst FROM %v AS dst
+WHERE  %v;`, quote(dstName), strings.Join(conds, "\nAND    ")), nil
+}
+
+/* the primary key is already created together with the table, the
+ * secondary indices are added in one go so the table is only rebuilt
+ * once */
+func (w *genericMysqlWriter) CreateIndices(src *Table, dstName string) error {
+	if len(src.Indices) == 0 {
+		return nil
+	}
+
+	adds := make([]string, 0, len(src.Indices))
+	for _, idx := range src.Indices {
+		name := idx.Name
+		if name == "" {
+			name = strings.Join(idx.Columns, "_") + "_idx"
+		}
+		adds = append(adds, fmt.Sprintf("ADD INDEX %v (%v)",
+			quote(name), keyColumnsSql(src, idx.Columns)))
+	}
+
+	return w.e.Transaction(fmt.Sprintf("create indices of table %v", dstName), []string{
+		fmt.Sprintf("ALTER TABLE %v\n\t%v;", quote(dstName), strings.Join(adds, ",\n\t")),
+	})
+}
+
+/* foreign key names have to be unique in the whole database in MySQL,
+ * unique key names only per table */
+func (w *genericMysqlWriter) CreateConstraints(src *Table, dstName string) error {
+	adds := make([]string, 0, len(src.UniqueKeys)+len(src.ForeignKeys))
+
+	for _, uk := range src.UniqueKeys {
+		name := uk.Name
+		if name == "" {
+			name = strings.Join(uk.Columns, "_") + "_key"
+		}
+		adds = append(adds, fmt.Sprintf("ADD UNIQUE KEY %v (%v)",
+			quote(name), keyColumnsSql(src, uk.Columns)))
+	}
+	for _, fk := range src.ForeignKeys {
+		adds = append(adds, fmt.Sprintf(
+			"ADD CONSTRAINT %v FOREIGN KEY (%v) REFERENCES %v (%v) ON DELETE %v ON UPDATE %v",
+			quote(KeyName(dstName, fk.Name, fk.Columns, "fkey")),
+			quoteAll(fk.Columns), quote(fk.RefTable), quoteAll(fk.RefColumns),
+			ReferentialAction(fk.OnDelete), ReferentialAction(fk.OnUpdate)))
+	}
+
+	if len(adds) == 0 {
+		return nil
+	}
+
+	return w.e.Transaction(fmt.Sprintf("create constraints of table %v", dstName), []string{
+		fmt.Sprintf("ALTER TABLE %v\n\t%v;", quote(dstName), strings.Join(adds, ",\n\t")),
+	})
+}
+
+/* inserts and updates are upserts, so replaying a change is harmless. The
+ * foreign key checks are off for the connection, so deleting the old row of
+ * an update that changed the key doesn't cascade. A table without a unique
+ * index on its key gets an UPDATE and an INSERT ... WHERE NOT EXISTS
+ * instead of an INSERT ... ON DUPLICATE KEY UPDATE. */
+func (w *genericMysqlWriter) ApplyChanges(changes []*Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	if err := w.e.Begin(fmt.Sprintf("apply %v change(s)", len(changes))); err != nil {
+		return err
+	}
+
+	for _, c := range changes {
+		key := make([]string, 0, 2)
+		for _, idx := range c.KeyColumns() {
+			key = append(key, c.Table.Columns[idx].Name)
+		}
+		unique, err := w.hasUniqueIndex(c.DstName, key)
+		if err != nil {
+			w.e.Rollback()
+			return err
+		}
+
+		stmts, err := changeStatements(c, unique)
+		if err != nil {
+			w.e.Rollback()
+			return fmt.Errorf("mysql: %v: %v", c, err)
+		}
+
+		for _, stmt := range stmts {
+			if err := w.e.Submit(stmt); err != nil {
+				return err
+			}
+		}
+	}
+
+	return w.e.Commit()
+}
+
+func changeStatements(c *Change, unique bool) ([]string, error) {
+	stmts := make([]string, 0, 2)
+
+	/* the LIMIT is for tables without a primary key, which might have
+	 * duplicate rows */
+	if c.Kind == ChangeDelete || c.KeyChanged() {
+		cond, err := RowCondition(c, c.Before, quote, RawToMysql)
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, fmt.Sprintf("DELETE FROM %v WHERE %v LIMIT 1;", quote(c.DstName), cond))
+	}
+	if c.Kind == ChangeDelete {
+		return stmts, nil
+	}
+
+	lits, err := RowLiterals(c.Table, c.After, RawToMysql)
+	if err != nil {
+		return nil, err
+	}
+
+	colnames := make([]string, 0, len(lits))
+	colassign := make([]string, 0, len(lits))
+	for _, col := range c.Table.Columns {
+		colnames = append(colnames, quote(col.Name))
+		if !col.PrimaryKey {
+			colassign = append(colassign, fmt.Sprintf("%[1]v = VALUES(%[1]v)", quote(col.Name)))
+		}
+	}
+
+	if !unique {
+		cond, err := RowCondition(c, c.After, quote, RawToMysql)
+		if err != nil {
+			return nil, err
+		}
+
+		/* a table without a primary key is keyed on all of its
+		 * columns, there's nothing to update then */
+		inKey := make(map[int]bool)
+		for _, idx := range c.KeyColumns() {
+			inKey[idx] = true
+		}
+		assign := make([]string, 0, len(lits))
+		for idx, col := range c.Table.Columns {
+			if !inKey[idx] {
+				assign = append(assign, fmt.Sprintf("%v = %v", quote(col.Name), lits[idx]))
+			}
+		}
+		if len(assign) != 0 {
+			stmts = append(stmts, fmt.Sprintf("UPDATE %v SET %v WHERE %v LIMIT 1;",
+				quote(c.DstName), strings.Join(assign, ", "), cond))
+		}
+		return append(stmts, fmt.Sprintf("INSERT INTO %[1]v (%[2]v) SELECT %[3]v FROM DUAL WHERE NOT EXISTS (SELECT 1 FROM %[1]v WHERE %[4]v);",
+			quote(c.DstName), strings.Join(colnames, ", "), strings.Join(lits, ", "), cond)), nil
+	}
+
+	insert, onDuplicate := "INSERT IGNORE", ""
+	if len(colassign) != 0 {
+		insert, onDuplicate = "INSERT", " ON DUPLICATE KEY UPDATE "+strings.Join(colassign, ", ")
+	}
+
+	return append(stmts, fmt.Sprintf("%v INTO %v (%v) VALUES (%v)%v;", insert, quote(c.DstName),
+		strings.Join(colnames, ", "), strings.Join(lits, ", "), onDuplicate)), nil
+}
+
+func (w *genericMysqlWriter) Close() error {
+	return w.e.Close()
+}
+
+type MysqlWriter struct {
+	genericMysqlWriter
+}
+
+func NewMysqlWriter(conf *Config) (*MysqlWriter, error) {
+	db, err := openDB(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	/* both the session variables set below and the temporary tables used
+	 * for merging are only visible on the connection that created them */
+	db.SetMaxOpenConns(1)
+
+	executor, err := NewDbExecutor(db, nil)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	errors := executor.Multiple("initializing DB connection", mysqlWriterInit)
+	if len(errors) > 0 {
+		executor.Close()
+		for _, err := range errors {
+			log.Println("mysql error:", err)
+		}
+		return nil, errors[0]
+	}
+
+	return &MysqlWriter{genericMysqlWriter{executor, 64, make(map[string]bool)}}, nil
+}
+
+type MysqlFileWriter struct {
+	genericMysqlWriter
+}
+
+/* writes the statements to out, which is closed together with the writer
+ * if it's an io.Closer */
+func NewMysqlFileWriter(out io.Writer) (*MysqlFileWriter, error) {
+	executor := NewFileExecutor(out)
+
+	errors := executor.Multiple("initializing DB connection", mysqlWriterInit)
+	if len(errors) > 0 {
+		executor.Close()
+		for _, err := range errors {
+			log.Println("mysql error:", err)
+		}
+		return nil, errors[0]
+	}
+
+	return &MysqlFileWriter{genericMysqlWriter{executor, 256, make(map[string]bool)}}, nil
+}
+
+func ColumnsSql(table *Table) string {
+	colSql := make([]string, 0, len(table.Columns))
+	pkCols := make([]string, 0, len(table.Columns))
+
+	for _, col := range table.Columns {
+		def := fmt.Sprintf("%v %v", quote(col.Name), GenericToMysqlType(col.Type))
+
+		/* (LONG)TEXT columns can't be part of a key without a prefix
+		 * length, fall back to the longest VARCHAR that fits in an index */
+		if col.PrimaryKey && col.Type.Name == TypeText && !col.Type.HasMax() {
+			def = fmt.Sprintf("%v varchar(255)", quote(col.Name))
+		}
+
+		if !col.Null || col.PrimaryKey {
+			def += " NOT NULL"
+		}
+		if col.AutoIncr {
+			def += " AUTO_INCREMENT"
+		}
+		if col.Comment != "" {
+			def += fmt.Sprintf(" COMMENT '%v'", escapeString(col.Comment))
+		}
+		colSql = append(colSql, def)
+
+		if col.PrimaryKey {
+			pkCols = append(pkCols, quote(col.Name))
+		}
+	}
+
+	if len(pkCols) > 0 {
+		colSql = append(colSql, fmt.Sprintf("PRIMARY KEY (%v)",
+			strings.Join(pkCols, ", ")))
+	}
+
+	return strings.Join(colSql, ",\n\t")
+}
+
+/* (LONG)TEXT and BLOB columns can only be indexed on a prefix */
+func keyColumnsSql(table *Table, names []string) string {
+	types := make(map[string]*Type, len(table.Columns))
+	for _, col := range table.Columns {
+		types[col.Name] = col.Type
+	}
+
+	cols := make([]string, 0, len(names))
+	for _, name := range names {
+		t, ok := types[name]
+		if ok && (t.Name == TypeText || t.Name == TypeBlob) && !t.HasMax() {
+			cols = append(cols, quote(name)+"(255)")
+		} else {
+			cols = append(cols, quote(name))
+		}
+	}
+	return strings.Join(cols, ", ")
+}
+
+/* the rows of the temp table that are in the scope of the merge, the
+ * scope refers to them as dst like it does to the destination rows */
+func scopedRowsSql(tmpName, scope string) string {
+	if scope == "" {
+		return tmpName
+	}
+	return fmt.Sprintf("(SELECT * FROM %v AS dst WHERE %v)", tmpName, scope)
+}
+
+/* the scope of the merge as a condition on the destination row dst */
+func scopeSql(scope string) string {
+	if scope == "" {
+		return ""
+	}
+	return "\nAND    (" + scope + ")"
+}
+
+func quote(name string) string {
+	return "`" + name + "`"
+}
+
+func quoteAll(names []string) string {
+	quoted := make([]string, 0, len(names))
+	for _, name := range names {
+		quoted = append(quoted, quote(name))
+	}
+	return strings.Join(quoted, ", ")
+}
@@ -3,33 +3,158 @@ package db
 import (
 	"fmt"
 	. "github.com/aktau/gomig/db/common"
-	"github.com/aktau/gomig/db/mysql"
-	"github.com/aktau/gomig/db/postgres"
+	"io"
+	"sort"
+	"sync"
 )
 
+/* backends make themselves available by registering their constructors
+ * from an init() function, just like database/sql drivers do. The main
+ * package then only has to import them for their side effects. */
+type ReaderOpener func(conf *Config) (ReadCloser, error)
+type WriterOpener func(conf *Config) (WriteCloser, error)
+type FileWriterOpener func(out io.Writer) (WriteCloser, error)
+
+var (
+	registryMu  sync.Mutex
+	readers     = make(map[string]ReaderOpener)
+	writers     = make(map[string]WriterOpener)
+	fileWriters = make(map[string]FileWriterOpener)
+)
+
+func RegisterReader(driverName string, open ReaderOpener) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if open == nil {
+		panic("db: RegisterReader: opener is nil")
+	}
+	if _, dup := readers[driverName]; dup {
+		panic("db: RegisterReader called twice for driver " + driverName)
+	}
+	readers[driverName] = open
+}
+
+func RegisterWriter(driverName string, open WriterOpener) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if open == nil {
+		panic("db: RegisterWriter: opener is nil")
+	}
+	if _, dup := writers[driverName]; dup {
+		panic("db: RegisterWriter called twice for driver " + driverName)
+	}
+	writers[driverName] = open
+}
+
+func RegisterFileWriter(driverName string, open FileWriterOpener) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if open == nil {
+		panic("db: RegisterFileWriter: opener is nil")
+	}
+	if _, dup := fileWriters[driverName]; dup {
+		panic("db: RegisterFileWriter called twice for driver " + driverName)
+	}
+	fileWriters[driverName] = open
+}
+
+/* the names of the registered readers, sorted */
+func Readers() []string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	names := make([]string, 0, len(readers))
+	for name := range readers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/* the names of the registered writers (database and file), sorted */
+func Writers() []string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	set := make(map[string]bool)
+	for name := range writers {
+		set[name] = true
+	}
+	for name := range fileWriters {
+		set[name] = true
+	}
+
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func OpenReader(driverName string, conf *Config) (ReadCloser, error) {
-	switch driverName {
-	case "mysql":
-		return mysql.OpenReader(conf)
+	registryMu.Lock()
+	open, ok := readers[driverName]
+	registryMu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("db: OpenReader: unknown driver type: %v", driverName)
 	}
 
-	return nil, fmt.Errorf("db: OpenReader: unknown driver type: %v", driverName)
+	return open(conf)
 }
 
+/* the filename can be "-" for the standard output, a name that ends in
+ * .gz or .zst is compressed */
 func OpenFileWriter(driverName string, filename string) (WriteCloser, error) {
-	switch driverName {
-	case "postgres":
-		return postgres.NewPostgresFileWriter(filename)
+	registryMu.Lock()
+	_, ok := fileWriters[driverName]
+	registryMu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("db: OpenFileWriter: unknown driver type: %v", driverName)
+	}
+
+	out, err := createOutput(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := OpenStreamWriter(driverName, out)
+	if err != nil {
+		if c, ok := out.(io.Closer); ok {
+			c.Close()
+		}
+		return nil, err
 	}
+	return w, nil
+}
+
+/* like OpenFileWriter(), but writes the statements to out, which is
+ * closed together with the writer if it's an io.Closer */
+func OpenStreamWriter(driverName string, out io.Writer) (WriteCloser, error) {
+	registryMu.Lock()
+	open, ok := fileWriters[driverName]
+	registryMu.Unlock()
 
-	return nil, fmt.Errorf("db: OpenFileWriter: unknown driver type: %v", driverName)
+	if !ok {
+		return nil, fmt.Errorf("db: OpenStreamWriter: unknown driver type: %v", driverName)
+	}
+
+	return open(out)
 }
 
 func OpenWriter(driverName string, conf *Config) (WriteCloser, error) {
-	switch driverName {
-	case "postgres":
-		return postgres.NewPostgresWriter(conf)
+	registryMu.Lock()
+	open, ok := writers[driverName]
+	registryMu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("db: OpenWriter: unknown driver type: %v", driverName)
 	}
 
-	return nil, fmt.Errorf("db: OpenWriter: unknown driver type: %v", driverName)
+	return open(conf)
 }
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+/* opens what a file writer writes to: "-" is the standard output, and a
+ * file whose name ends in .gz or .zst is compressed with gzip or zstd. The
+ * output is an io.Closer unless it's the standard output, which is left
+ * open. */
+func createOutput(path string) (io.Writer, error) {
+	if path == "-" {
+		return struct{ io.Writer }{os.Stdout}, nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		return &compressedOutput{gzip.NewWriter(f), f}, nil
+	case strings.HasSuffix(path, ".zst"):
+		enc, err := zstd.NewWriter(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &compressedOutput{enc, f}, nil
+	}
+
+	return f, nil
+}
+
+/* closing it flushes the compressor before closing the file */
+type compressedOutput struct {
+	io.WriteCloser
+	f *os.File
+}
+
+func (c *compressedOutput) Close() error {
+	err := c.WriteCloser.Close()
+	if ferr := c.f.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
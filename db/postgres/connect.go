@@ -21,7 +21,7 @@ func openDB(conf *Config) (*sql.DB, error) {
 		params = append(params, fmt.Sprintf("host='%v'", conf.Socket))
 		params = append(params, "sslmode=disable")
 	} else {
-		port := 3306
+		port := 5432
 		if conf.Port != 0 {
 			port = conf.Port
 		}
@@ -32,6 +32,9 @@ func openDB(conf *Config) (*sql.DB, error) {
 	if conf.Database != "" {
 		params = append(params, "dbname="+conf.Database)
 	}
+	for _, key := range conf.OptionKeys() {
+		params = append(params, fmt.Sprintf("%v='%v'", key, conf.Options[key]))
+	}
 
 	uri := strings.Join(params, " ")
 	db, err := sql.Open("postgres", uri)
@@ -88,5 +88,5 @@ func (e *PgDbExecutor) BulkFinish() (err error) {
 }
 
 func (e *PgDbExecutor) HasCapability(capability int) bool {
-	return capability == common.CapBulkTransfer
+	return capability == common.CapBulkTransfer || e.DbExecutor.HasCapability(capability)
 }
@@ -0,0 +1,109 @@
+package postgres
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aktau/gomig/db/common"
+)
+
+/* writes a bulk transfer as a COPY ... FROM stdin block, like pg_dump
+ * does, which psql loads a lot faster than INSERT statements */
+type PgFileExecutor struct {
+	common.FileExecutor
+	bulkInProgress bool
+}
+
+func NewPgFileExecutor(out io.Writer) *PgFileExecutor {
+	return &PgFileExecutor{*common.NewFileExecutor(out), false}
+}
+
+func (e *PgFileExecutor) BulkInit(table string, columns ...string) error {
+	if e.bulkInProgress {
+		return errors.New("a bulk statement is already in progress")
+	}
+	e.bulkInProgress = true
+
+	return e.Submit(fmt.Sprintf("COPY %v (%v) FROM stdin;", table, strings.Join(columns, ", ")))
+}
+
+/* the arguments are the fields of the record, formatted by copyField() */
+func (e *PgFileExecutor) BulkAddRecord(args ...interface{}) error {
+	if !e.bulkInProgress {
+		return errors.New("no bulk statement in progress")
+	}
+
+	fields := make([]string, 0, len(args))
+	for _, arg := range args {
+		field, ok := arg.(string)
+		if !ok {
+			return fmt.Errorf("postgres: a COPY field has to be formatted already, got a %T", arg)
+		}
+		fields = append(fields, field)
+	}
+
+	return e.Submit(strings.Join(fields, "\t"))
+}
+
+func (e *PgFileExecutor) BulkFinish() error {
+	if !e.bulkInProgress {
+		return errors.New("no bulk statement in progress")
+	}
+	e.bulkInProgress = false
+
+	return e.Submit(`\.` + "\n")
+}
+
+func (e *PgFileExecutor) HasCapability(capability int) bool {
+	return capability == common.CapBulkTransfer || e.FileExecutor.HasCapability(capability)
+}
+
+var copyEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+/* formats a raw value in the text format of COPY, the way RawToPostgres()
+ * makes a literal of it: NULL is \N, and backslashes, tabs and line breaks
+ * are escaped */
+func copyField(val []byte, t *common.Type) (string, error) {
+	if val == nil {
+		return `\N`, nil
+	}
+
+	var field string
+	switch t.Name {
+	case common.TypeBool:
+		switch strings.ToLower(string(val)) {
+		case "0", "f", "false":
+			field = "f"
+		case "1", "t", "true":
+			field = "t"
+		default:
+			return "", fmt.Errorf("did not recognize bool value: %v", string(val))
+		}
+	case common.TypeBlob:
+		/* the hex format of bytea */
+		field = `\x` + hex.EncodeToString(val)
+	case common.TypeSet:
+		/* an array literal of the comma separated members */
+		field = "{}"
+		if len(val) > 0 {
+			members := strings.Split(string(val), ",")
+			for i, member := range members {
+				members[i] = `"` + arrayEscaper.Replace(member) + `"`
+			}
+			field = "{" + strings.Join(members, ",") + "}"
+		}
+	case common.TypeBit:
+		field = common.BitString(val, t.Max)
+	default:
+		/* numbers are kept as the source wrote them, so no digits are
+		 * lost */
+		field = string(val)
+	}
+
+	return copyEscaper.Replace(field), nil
+}
+
+var arrayEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
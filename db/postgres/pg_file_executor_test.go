@@ -0,0 +1,48 @@
+package postgres
+
+import (
+	"testing"
+
+	"github.com/aktau/gomig/db/common"
+)
+
+func TestCopyField(t *testing.T) {
+	tests := []struct {
+		val      []byte
+		t        *common.Type
+		expected string
+	}{
+		{nil, common.TextType(), `\N`},
+		{nil, common.IntType(common.TypeNormal), `\N`},
+		{[]byte(""), common.TextType(), ``},
+		{[]byte("a\tb\nc\\d\re"), common.TextType(), `a\tb\nc\\d\re`},
+		{[]byte(`\N`), common.TextType(), `\\N`},
+		{[]byte("12345678901234567.8901"), common.NumericType(30, 4), "12345678901234567.8901"},
+		{[]byte("18446744073709551615"), common.IntType(common.TypeHuge), "18446744073709551615"},
+		{[]byte("1"), common.BoolType(), "t"},
+		{[]byte("false"), common.BoolType(), "f"},
+		{[]byte{0x00, 0x5c, 0xff}, common.BlobType(), `\\x005cff`},
+		{[]byte{}, common.BlobType(), `\\x`},
+		{[]byte("a,b"), common.SetType(), `{"a","b"}`},
+		{[]byte(""), common.SetType(), `{}`},
+		{[]byte(`q"u\o`), common.SetType(), `{"q\\"u\\\\o"}`},
+		/* MySQL hands out the bytes that hold the bits, postgres text */
+		{[]byte{0x05}, common.BitType(4), "0101"},
+		{[]byte{0x01, 0x00}, common.BitType(10), "0100000000"},
+		{[]byte("0101"), common.BitType(4), "0101"},
+	}
+	for _, test := range tests {
+		got, err := copyField(test.val, test.t)
+		if err != nil {
+			t.Errorf("%q as %v: %v", test.val, test.t.Name, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("%q as %v: %v, expected %v", test.val, test.t.Name, got, test.expected)
+		}
+	}
+
+	if _, err := copyField([]byte("maybe"), common.BoolType()); err == nil {
+		t.Errorf("a bool of maybe doesn't fail")
+	}
+}
@@ -0,0 +1,446 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	. "github.com/aktau/gomig/db/common"
+)
+
+var PG_R_VERBOSE = false
+
+var (
+	postgresReaderInit = []string{
+		"SET client_encoding = 'UTF8';",
+	}
+)
+
+const (
+	/* returns rows shaped like the output of MySQL's EXPLAIN, the table
+	 * name is resolved through the search path, so temporary tables are
+	 * found as well. The names are those of pg_class, so they're quoted
+	 * before the cast to regclass, which would fold them to lower case. */
+	explainQuery = `
+SELECT a.attname AS field,
+       pg_catalog.format_type(a.atttypid, a.atttypmod) AS type,
+       CASE
+        WHEN a.attnotnull THEN 'NO'
+        ELSE 'YES'
+       END AS null,
+       CASE
+        WHEN EXISTS (
+            SELECT 1
+            FROM   pg_catalog.pg_index i
+            WHERE  i.indrelid = a.attrelid
+            AND    i.indisprimary
+            AND    a.attnum = ANY (i.indkey)
+        ) THEN 'PRI'
+        ELSE ''
+       END AS key,
+       pg_catalog.pg_get_expr(d.adbin, d.adrelid) AS default,
+       CASE
+        WHEN pg_catalog.pg_get_expr(d.adbin, d.adrelid) LIKE 'nextval(%' THEN 'auto_increment'
+        ELSE ''
+       END AS extra
+FROM   pg_catalog.pg_attribute a
+LEFT JOIN pg_catalog.pg_attrdef d ON (d.adrelid = a.attrelid AND d.adnum = a.attnum)
+WHERE  a.attrelid = quote_ident($1)::regclass
+AND    a.attnum > 0
+AND    NOT a.attisdropped
+ORDER BY a.attnum;`
+
+	/* one row per column of each foreign key, in order */
+	foreignKeysQuery = `
+SELECT c.conname, a.attname, fc.relname, fa.attname,
+       c.confupdtype, c.confdeltype
+FROM   pg_catalog.pg_constraint c
+JOIN   pg_catalog.pg_class fc ON (fc.oid = c.confrelid)
+CROSS JOIN LATERAL unnest(c.conkey, c.confkey) WITH ORDINALITY AS k(attnum, fattnum, pos)
+JOIN   pg_catalog.pg_attribute a ON (a.attrelid = c.conrelid AND a.attnum = k.attnum)
+JOIN   pg_catalog.pg_attribute fa ON (fa.attrelid = c.confrelid AND fa.attnum = k.fattnum)
+WHERE  c.contype = 'f'
+AND    c.conrelid = quote_ident($1)::regclass
+ORDER BY c.conname, k.pos;`
+
+	/* one row per column of each index except the primary key, indices on
+	 * expressions and partial indices are left out */
+	indicesQuery = `
+SELECT i.relname, x.indisunique, a.attname
+FROM   pg_catalog.pg_index x
+JOIN   pg_catalog.pg_class i ON (i.oid = x.indexrelid)
+CROSS JOIN LATERAL unnest(x.indkey::int2[]) WITH ORDINALITY AS k(attnum, pos)
+JOIN   pg_catalog.pg_attribute a ON (a.attrelid = x.indrelid AND a.attnum = k.attnum)
+WHERE  x.indrelid = quote_ident($1)::regclass
+AND    NOT x.indisprimary
+AND    x.indexprs IS NULL
+AND    x.indpred IS NULL
+ORDER BY i.relname, k.pos;`
+
+	/* the comment of the table (with an empty column name) and those of
+	 * its columns */
+	commentsQuery = `
+SELECT '', d.description
+FROM   pg_catalog.pg_description d
+WHERE  d.objoid = quote_ident($1)::regclass
+AND    d.classoid = 'pg_catalog.pg_class'::regclass
+AND    d.objsubid = 0
+UNION ALL
+SELECT a.attname, d.description
+FROM   pg_catalog.pg_description d
+JOIN   pg_catalog.pg_attribute a ON (a.attrelid = d.objoid AND a.attnum = d.objsubid)
+WHERE  d.objoid = quote_ident($1)::regclass
+AND    d.classoid = 'pg_catalog.pg_class'::regclass
+AND    d.objsubid > 0;`
+
+	/* all tables and views visible through the search path (including
+	 * temporary ones), except for the system catalogs */
+	tablesQuery = `
+SELECT c.relname
+FROM   pg_catalog.pg_class c
+JOIN   pg_catalog.pg_namespace n ON (n.oid = c.relnamespace)
+WHERE  c.relkind IN ('r', 'v', 'm')
+AND    n.nspname NOT IN ('pg_catalog', 'information_schema')
+AND    pg_catalog.pg_table_is_visible(c.oid)
+ORDER BY c.relname;`
+)
+
+/* for chunking */
+var dialect = Dialect{
+	Quote:       quote,
+	Placeholder: func(n int) string { return fmt.Sprintf("$%v", n) },
+}
+
+type PostgresReader struct {
+	*sql.DB
+}
+
+func OpenReader(conf *Config) (*PostgresReader, error) {
+	db, err := openDB(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	/* views and projections are created as temporary objects, which only
+	 * exist in the session that created them, so we can't let database/sql
+	 * spread our queries over multiple connections. This does mean that
+	 * the rows returned by Read() have to be closed before issuing another
+	 * query. */
+	db.SetMaxOpenConns(1)
+
+	log.Printf("postgres/openreader: initializing")
+	for _, stmt := range postgresReaderInit {
+		log.Printf("%v", stmt)
+		if _, err := db.Exec(stmt); err != nil {
+			defer db.Close()
+			return nil, err
+		}
+	}
+
+	return &PostgresReader{db}, nil
+}
+
+func (r *PostgresReader) TableNames() []string {
+	rows, err := r.Query(tablesQuery)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	tables := make([]string, 0, 8)
+
+	var name string
+	for rows.Next() {
+		err = rows.Scan(&name)
+		if err != nil {
+			panic(err)
+		}
+
+		tables = append(tables, name)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+
+	return tables
+}
+
+func (r *PostgresReader) Tables() []*Table {
+	return r.FilteredTables(nil, nil)
+}
+
+func (r *PostgresReader) FilteredTables(incl, excl map[string]bool) []*Table {
+	tableNames := r.TableNames()
+	filteredTableNames := FilterInclExcl(tableNames, incl, excl)
+	tables := make([]*Table, 0, len(filteredTableNames))
+
+	if PG_R_VERBOSE {
+		log.Printf("postgres: all tables = %v, filtered = %v\n", tableNames, filteredTableNames)
+	}
+
+	for _, tableName := range filteredTableNames {
+		/* query table information */
+		columns, err := r.columns(tableName)
+		if err != nil {
+			log.Println("postgres: could not fetch columns of table", tableName, "error:", err)
+		}
+
+		indices, uniqueKeys, err := r.indices(tableName)
+		if err != nil {
+			log.Println("postgres: could not fetch indices of table", tableName, "error:", err)
+		}
+
+		foreignKeys, err := r.foreignKeys(tableName)
+		if err != nil {
+			log.Println("postgres: could not fetch foreign keys of table", tableName, "error:", err)
+		}
+
+		/* create table struct */
+		table := &Table{Name: tableName, DbType: "postgres", Columns: columns,
+			Indices: indices, UniqueKeys: uniqueKeys, ForeignKeys: foreignKeys}
+
+		if err := ReadComments(r, table, commentsQuery, tableName); err != nil {
+			log.Println("postgres: could not fetch comments of table", tableName, "error:", err)
+		}
+
+		tables = append(tables, table)
+	}
+
+	return tables
+}
+
+type rawCol struct {
+	name    string
+	rawtype string
+	null    string
+	key     string
+	defval  sql.NullString
+	extra   string
+}
+
+func (r *PostgresReader) columns(table string) ([]*Column, error) {
+	rows, err := r.Query(explainQuery, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols := make([]*Column, 0, 8)
+
+	var rc rawCol
+	for rows.Next() {
+		err = rows.Scan(&rc.name, &rc.rawtype, &rc.null, &rc.key, &rc.defval, &rc.extra)
+		if err != nil {
+			return nil, err
+		}
+
+		cols = append(cols, processCol(table, &rc))
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return cols, nil
+}
+
+func processCol(table string, rc *rawCol) *Column {
+	t := rc.rawtype
+
+	return &Column{
+		TableName:    table,
+		Name:         rc.name,
+		Type:         PostgresToGenericType(t),
+		RawType:      t,
+		Length:       255,
+		Null:         rc.null == "YES",
+		PrimaryKey:   rc.key == "PRI",
+		AutoIncr:     rc.extra == "auto_increment",
+		Default:      rc.defval,
+		NeedsQuoting: strings.HasPrefix(t, "character") || t == "text",
+	}
+}
+
+func (r *PostgresReader) indices(table string) ([]*Index, []*UniqueKey, error) {
+	rows, err := r.Query(indicesQuery, table)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	indices := make([]*Index, 0, 4)
+	uniqueKeys := make([]*UniqueKey, 0, 2)
+
+	var (
+		name, col string
+		unique    bool
+		idx       *Index
+		uk        *UniqueKey
+	)
+	for rows.Next() {
+		err = rows.Scan(&name, &unique, &col)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		/* multi-column indices span multiple rows */
+		switch {
+		case unique && (uk == nil || uk.Name != name):
+			uk = &UniqueKey{Name: name}
+			uniqueKeys = append(uniqueKeys, uk)
+		case !unique && (idx == nil || idx.Name != name):
+			idx = &Index{Name: name}
+			indices = append(indices, idx)
+		}
+		if unique {
+			uk.Columns = append(uk.Columns, col)
+		} else {
+			idx.Columns = append(idx.Columns, col)
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return indices, uniqueKeys, nil
+}
+
+func (r *PostgresReader) foreignKeys(table string) ([]*ForeignKey, error) {
+	rows, err := r.Query(foreignKeysQuery, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fks := make([]*ForeignKey, 0, 2)
+
+	var (
+		name, col, refTable, refCol string
+		onUpdate, onDelete          string
+		fk                          *ForeignKey
+	)
+	for rows.Next() {
+		err = rows.Scan(&name, &col, &refTable, &refCol, &onUpdate, &onDelete)
+		if err != nil {
+			return nil, err
+		}
+
+		/* multi-column keys span multiple rows */
+		if fk == nil || fk.Name != name {
+			fk = &ForeignKey{Name: name, RefTable: refTable,
+				OnUpdate: actionFromCode(onUpdate),
+				OnDelete: actionFromCode(onDelete)}
+			fks = append(fks, fk)
+		}
+		fk.Columns = append(fk.Columns, col)
+		fk.RefColumns = append(fk.RefColumns, refCol)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return fks, nil
+}
+
+/* translates the action codes of pg_constraint */
+func actionFromCode(code string) string {
+	switch code {
+	case "r":
+		return "RESTRICT"
+	case "c":
+		return "CASCADE"
+	case "n":
+		return "SET NULL"
+	case "d":
+		return "SET DEFAULT"
+	default:
+		return "NO ACTION"
+	}
+}
+
+/* caller is responsible for cleaning up the sql.Rows object */
+func (r *PostgresReader) Read(table *Table) (*sql.Rows, error) {
+	query, args := SelectQuery(dialect, table, nil)
+	return r.Query(query, args...)
+}
+
+func (r *PostgresReader) Chunks(table *Table, size int) ([]*Chunk, error) {
+	return ChunkTable(r, dialect, table, size)
+}
+
+/* caller is responsible for cleaning up the sql.Rows object */
+func (r *PostgresReader) ReadChunk(table *Table, c *Chunk) (*sql.Rows, error) {
+	query, args := SelectQuery(dialect, table, c)
+	return r.Query(query, args...)
+}
+
+func (r *PostgresReader) Max(table *Table, column string) (string, error) {
+	return ColumnMax(r, dialect, table, column)
+}
+
+/* reltuples is what the last VACUUM or ANALYZE found, it's -1 (or 0 on
+ * older versions) if the table was never analyzed */
+func (r *PostgresReader) EstimateRows(table *Table) (int64, error) {
+	var n int64
+	err := r.QueryRow("SELECT GREATEST(reltuples, 0)::bigint FROM pg_catalog.pg_class WHERE oid = quote_ident($1)::regclass",
+		table.Name).Scan(&n)
+	return n, err
+}
+
+func (r *PostgresReader) CreateView(name string, body string) error {
+	stmt := fmt.Sprintf("CREATE TEMPORARY VIEW %v AS %v;", name, body)
+
+	_, err := r.Exec(stmt)
+	return err
+}
+
+func (r *PostgresReader) DropView(name string) error {
+	stmt := fmt.Sprintf("DROP VIEW %v;", name)
+
+	_, err := r.Exec(stmt)
+	return err
+}
+
+/* projections are temporary tables, the storage engine is a MySQL concept
+ * and is ignored */
+func (r *PostgresReader) CreateProjection(name string, body string, engine string, pk []string, uks [][]string) error {
+	constraints := make([]string, 0, 1+len(uks))
+	if len(pk) > 0 {
+		constraints = append(constraints, "ADD PRIMARY KEY ("+strings.Join(pk, ", ")+")")
+	}
+	for _, uk := range uks {
+		constraints = append(constraints, "ADD UNIQUE ("+strings.Join(uk, ", ")+")")
+	}
+
+	stmts := []string{fmt.Sprintf("CREATE TEMPORARY TABLE %v AS (\n%v\n);", name, body)}
+	if len(constraints) > 0 {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %v %v;",
+			name, strings.Join(constraints, ", ")))
+	}
+
+	for _, stmt := range stmts {
+		if PG_R_VERBOSE {
+			log.Printf("postgres: creating projection:\n%v\n", stmt)
+		}
+		if _, err := r.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *PostgresReader) DropProjection(name string) error {
+	stmt := fmt.Sprintf("DROP TABLE %v;", name)
+
+	_, err := r.Exec(stmt)
+	return err
+}
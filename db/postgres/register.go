@@ -0,0 +1,34 @@
+package postgres
+
+import (
+	"io"
+
+	"github.com/aktau/gomig/db"
+	. "github.com/aktau/gomig/db/common"
+)
+
+func init() {
+	db.RegisterReader("postgres", func(conf *Config) (ReadCloser, error) {
+		r, err := OpenReader(conf)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	})
+
+	db.RegisterWriter("postgres", func(conf *Config) (WriteCloser, error) {
+		w, err := NewPostgresWriter(conf)
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	})
+
+	db.RegisterFileWriter("postgres", func(out io.Writer) (WriteCloser, error) {
+		w, err := NewPostgresFileWriter(out)
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	})
+}
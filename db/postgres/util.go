@@ -1,13 +1,100 @@
 package postgres
 
 import (
-	"database/sql"
+	"encoding/hex"
 	"fmt"
 	"github.com/aktau/gomig/db/common"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
-func PostgresToGenericType(postgresType string) string {
-	return postgresType
+/* converts the output of format_type() to a generic type */
+func PostgresToGenericType(postgresType string) *common.Type {
+	pt := postgresType
+	switch {
+	case strings.HasSuffix(pt, "[]"):
+		/* arrays have no generic counterpart, pass them through */
+		return common.SimpleType(pt)
+	case pt == "smallint":
+		return common.IntType(common.TypeSmall)
+	case pt == "integer":
+		return common.IntType(common.TypeNormal)
+	case pt == "bigint":
+		return common.IntType(common.TypeLarge)
+	case pt == "real":
+		return common.FloatType()
+	case pt == "double precision":
+		return common.DoubleType()
+	case strings.HasPrefix(pt, "numeric"):
+		return common.NumericType(extractPrecisionAndScale(pt))
+	case pt == "boolean":
+		return common.BoolType()
+	case strings.HasPrefix(pt, "character varying"):
+		t := common.TextType()
+		t.Max = extractLength(pt)
+		return t
+	case strings.HasPrefix(pt, "character"):
+		t := common.PaddedTextType()
+		t.Max = extractLength(pt)
+		return t
+	case pt == "text":
+		return common.TextType()
+	case pt == "bytea":
+		return common.BlobType()
+	case pt == "date":
+		return common.DateType()
+	case strings.HasPrefix(pt, "timestamp"):
+		return common.TimestampType()
+	case strings.HasPrefix(pt, "time"):
+		return common.TimeType()
+	case strings.HasPrefix(pt, "bit"):
+		return common.BitType(extractLength(pt))
+	case pt == "json", pt == "jsonb":
+		return common.SimpleType(common.TypeJson)
+	default:
+		log.Println("WARNING: postgres: encountered an unknown type, ", pt)
+		return common.SimpleType(pt)
+	}
+}
+
+/* returns 0 if no length could be determined */
+func extractLength(postgresType string) uint {
+	/* matches should be: [postgresType, length] */
+	matches := regexp.MustCompile(`\w+\((\d+)\)`).FindStringSubmatch(postgresType)
+
+	if len(matches) != 2 {
+		return 0
+	}
+
+	i, err := strconv.Atoi(matches[1])
+	if err != nil {
+		return 0
+	}
+
+	return uint(i)
+}
+
+/* returns a precision, scale tuple */
+func extractPrecisionAndScale(postgresType string) (uint, uint) {
+	/* matches should be: [postgresType, precision, scale] */
+	matches := regexp.MustCompile(`\w+\(\s*(\d+)\s*,\s*(\d+)\s*\)`).FindStringSubmatch(postgresType)
+
+	if len(matches) != 3 {
+		return 0, 0
+	}
+
+	precision, err := strconv.Atoi(matches[1])
+	if err != nil {
+		return 0, 0
+	}
+	scale, err := strconv.Atoi(matches[2])
+	if err != nil {
+		return 0, 0
+	}
+
+	return uint(precision), uint(scale)
 }
 
 func GenericToPostgresType(genericType *common.Type) string {
@@ -29,14 +116,24 @@ func GenericToPostgresType(genericType *common.Type) string {
 		/* if the text type has no maximum (or a maximum above 200, we assume text) */
 		return "text"
 	case common.TypeChar:
+		if !gen.HasMax() {
+			return "character"
+		}
 		return fmt.Sprintf("character(%v)", max)
 	case common.TypeFloat:
 		return "real"
 	case common.TypeDouble:
 		return "double precision"
 	case common.TypeNumeric:
+		/* an unconstrained numeric */
+		if precision == 0 {
+			return "numeric"
+		}
 		return fmt.Sprintf("numeric(%v, %v)", precision, scale)
 	case common.TypeBit:
+		if !gen.HasMax() {
+			return "bit varying"
+		}
 		return fmt.Sprintf("bit varying(%v)", max)
 	case common.TypeBlob:
 		return "bytea"
@@ -64,15 +161,23 @@ func GenericToPostgresType(genericType *common.Type) string {
 }
 
 /* converts a RawBytes field into something you can
- * put into a regular insert statement (wrapping strings in $$
- * et cetera) */
+ * put into a regular insert statement (escaping strings,
+ * hex encoding blobs et cetera) */
 func RawToPostgres(val []byte, origType *common.Type) (string, error) {
 	if val == nil {
 		return "NULL", nil
 	} else {
 		switch origType.Name {
 		case common.TypeText, common.TypeChar, common.TypeJson:
-			return "$$" + string(val) + "$$", nil
+			return stringLiteral(string(val)), nil
+		case common.TypeBlob:
+			/* the hex format of bytea, with its backslash escaped */
+			return `E'\\x` + hex.EncodeToString(val) + "'::bytea", nil
+		case common.TypeSet:
+			/* a set is a comma separated list of its members */
+			return "string_to_array(" + stringLiteral(string(val)) + ", ',')", nil
+		case common.TypeBit:
+			return "B'" + common.BitString(val, origType.Max) + "'", nil
 		case common.TypeBool:
 			/* ascii(48) = "0" and ascii(49) = "1" */
 			switch val[0] {
@@ -86,47 +191,20 @@ func RawToPostgres(val []byte, origType *common.Type) (string, error) {
 		case common.TypeNumeric, common.TypeInteger, common.TypeFloat, common.TypeDouble:
 			return string(val), nil
 		case common.TypeTimeStamp, common.TypeTime, common.TypeDate:
-			return "'" + string(val) + "'", nil
+			return stringLiteral(string(val)), nil
 		default:
 			return string(val), nil
 		}
 	}
 }
 
-func NewTypedSlice(src *common.Table) []interface{} {
-	vals := make([]interface{}, len(src.Columns))
-	for i, col := range src.Columns {
-		switch col.Type.Name {
-		case common.TypeBool:
-			if col.Null {
-				vals[i] = new(sql.NullBool)
-			} else {
-				vals[i] = new(bool)
-			}
-		case common.TypeNumeric, common.TypeFloat, common.TypeDouble:
-			if col.Null {
-				vals[i] = new(sql.NullFloat64)
-			} else {
-				vals[i] = new(float64)
-			}
-		case common.TypeInteger:
-			if col.Null {
-				vals[i] = new(sql.NullInt64)
-			} else {
-				vals[i] = new(int64)
-			}
-		case common.TypeBlob:
-			/* do we have a suitable NullBlob or NullByte somewhere? I bet
-			 * this gives problems somehow with NULLable blob fields... */
-			vals[i] = new([]byte)
-		default:
-			if col.Null {
-				vals[i] = new(sql.NullString)
-			} else {
-				vals[i] = new(string)
-			}
-		}
-	}
+/* an escape string constant, which means the same whatever
+ * standard_conforming_strings is set to */
+func stringLiteral(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return "E'" + strings.Replace(s, "'", "''", -1) + "'"
+}
 
-	return vals
+func quote(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
 }
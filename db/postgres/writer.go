@@ -3,6 +3,7 @@ package postgres
 import (
 	"database/sql"
 	"fmt"
+	"io"
 	"log"
 	"strings"
 
@@ -20,36 +21,19 @@ var (
 	}
 )
 
-const (
-	explainQuery = `
-SELECT col.column_name AS field,
-       CASE
-        WHEN col.character_maximum_length IS NOT NULL THEN col.data_type || '(' || col.character_maximum_length || ')'
-        ELSE col.data_type
-       END AS type,
-       col.is_nullable AS null,
-       CASE
-        WHEN tc.constraint_type = 'PRIMARY KEY' THEN 'PRI'
-        ELSE ''
-       END AS key,
-       '' AS default,
-       '' AS extra
-       --kcu.constraint_name AS constraint_name
-       --kcu.*,
-       --tc.*
-FROM   information_schema.columns col
-LEFT JOIN   information_schema.key_column_usage kcu ON (kcu.table_name = col.table_name AND kcu.column_name = col.column_name)
-LEFT JOIN   information_schema.table_constraints AS tc ON (kcu.constraint_name = tc.constraint_name)
-WHERE  col.table_name = '%v'
-ORDER BY col.ordinal_position;`
-)
-
 type genericPostgresWriter struct {
 	e               Executor
 	insertBulkLimit int
+
+	/* as in server_version_num, 0 if unknown */
+	serverVersion int
+
+	/* whether a destination table has a unique index on the columns it's
+	 * merged on, by table name */
+	uniqueKeys map[string]bool
 }
 
-func (w *genericPostgresWriter) bulkTransfer(src *Table, dstName string, rows *sql.Rows) (err error) {
+func (w *genericPostgresWriter) bulkTransfer(src *Table, dstName string, rows *sql.Rows) (n int64, err error) {
 	ex := w.e
 
 	colnames := make([]string, 0, len(src.Columns))
@@ -68,24 +52,62 @@ func (w *genericPostgresWriter) bulkTransfer(src *Table, dstName string, rows *s
 		}
 	}()
 
+	/* a file gets the raw values, formatted as COPY text by the type of
+	 * their column, so nothing is lost in a conversion to a Go type */
+	if _, ok := ex.(*PgFileExecutor); ok {
+		return w.copyTransfer(src, rows)
+	}
+
 	/* create a slice with the right types to extract into, and let the SQL
 	 * driver take care of the conversion */
 	vals := NewTypedSlice(src)
 
 	for rows.Next() {
 		if err = rows.Scan(vals...); err != nil {
-			return fmt.Errorf("postgres: error while reading from source: %v", err)
+			return n, fmt.Errorf("postgres: error while reading from source: %v", err)
 		}
 
 		if err = ex.BulkAddRecord(vals...); err != nil {
-			return fmt.Errorf("postgres: error during bulk insert: %v", err)
+			return n, fmt.Errorf("postgres: error during bulk insert: %v", err)
 		}
+		n++
 	}
 
 	return
 }
 
-func (w *genericPostgresWriter) normalTransfer(src *Table, dstName string, rows *sql.Rows) error {
+func (w *genericPostgresWriter) copyTransfer(src *Table, rows *sql.Rows) (int64, error) {
+	pointers := make([]interface{}, len(src.Columns))
+	containers := make([]sql.RawBytes, len(src.Columns))
+	for i := range pointers {
+		pointers[i] = &containers[i]
+	}
+	fields := make([]interface{}, len(src.Columns))
+
+	var n int64
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return n, fmt.Errorf("postgres: error while reading from source: %v", err)
+		}
+
+		for idx, val := range containers {
+			field, err := copyField(val, src.Columns[idx].Type)
+			if err != nil {
+				return n, fmt.Errorf("postgres: column %v: %v", src.Columns[idx].Name, err)
+			}
+			fields[idx] = field
+		}
+
+		if err := w.e.BulkAddRecord(fields...); err != nil {
+			return n, fmt.Errorf("postgres: error during bulk insert: %v", err)
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+func (w *genericPostgresWriter) normalTransfer(src *Table, dstName string, rows *sql.Rows) (int64, error) {
 	/* an alternate way to do this, with type assertions
 	 * but possibly less accurately: http://go-database-sql.org/varcols.html */
 	pointers := make([]interface{}, len(src.Columns))
@@ -95,29 +117,31 @@ func (w *genericPostgresWriter) normalTransfer(src *Table, dstName string, rows
 	}
 	stringrep := make([]string, 0, len(src.Columns))
 	insertLines := make([]string, 0, 32)
+	var n int64
 	for rows.Next() {
 		err := rows.Scan(pointers...)
 		if err != nil {
 			log.Println("postgres: error while reading from source:", err)
-			return err
+			return n, err
 		}
 
 		for idx, val := range containers {
 			str, err := RawToPostgres(val, src.Columns[idx].Type)
 			if err != nil {
-				return err
+				return n, err
 			}
 			stringrep = append(stringrep, str)
 		}
 
 		insertLines = append(insertLines, "("+strings.Join(stringrep, ",")+")")
 		stringrep = stringrep[:0]
+		n++
 
 		if len(insertLines) >= w.insertBulkLimit {
 			err = w.e.Submit(fmt.Sprintf("INSERT INTO %v VALUES\n\t%v;\n",
 				dstName, strings.Join(insertLines, ",\n\t")))
 			if err != nil {
-				return err
+				return n, err
 			}
 
 			insertLines = insertLines[:0]
@@ -128,18 +152,19 @@ func (w *genericPostgresWriter) normalTransfer(src *Table, dstName string, rows
 		err := w.e.Submit(fmt.Sprintf("INSERT INTO %v VALUES\n\t%v;\n",
 			dstName, strings.Join(insertLines, ",\n\t")))
 		if err != nil {
-			return err
+			return n, err
 		}
 	}
 
-	return nil
+	return n, nil
 }
 
-func (w *genericPostgresWriter) transferTable(src *Table, dstName string, r Reader) error {
+/* returns the number of rows that were transferred */
+func (w *genericPostgresWriter) transferTable(src *Table, dstName string, r Reader, c *Chunk) (int64, error) {
 	/* bulk insert values */
-	rows, err := r.Read(src)
+	rows, err := ReadRows(r, src, c)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer rows.Close()
 
@@ -147,49 +172,74 @@ func (w *genericPostgresWriter) transferTable(src *Table, dstName string, r Read
 		log.Print("postgres: query done, scanning rows...")
 	}
 
+	var n int64
+
 	if w.e.HasCapability(CapBulkTransfer) {
 		if PG_W_VERBOSE {
 			log.Print("postgres: bulk capability detected, performing bulk transfer...")
 		}
 
-		err = w.bulkTransfer(src, dstName, rows)
+		n, err = w.bulkTransfer(src, dstName, rows)
 	} else {
 		if PG_W_VERBOSE {
 			log.Print("postgres: no bulk capability detected, performing normal transfer...")
 		}
 
-		err = w.normalTransfer(src, dstName, rows)
+		n, err = w.normalTransfer(src, dstName, rows)
 	}
 	if err != nil {
-		return err
+		return n, err
 	}
 
-	return rows.Err()
+	return n, rows.Err()
 }
 
 /* how to do an UPSERT/MERGE in PostgreSQL
- * http://stackoverflow.com/questions/17267417/how-do-i-do-an-upsert-merge-insert-on-duplicate-update-in-postgresq */
-func (w *genericPostgresWriter) MergeTable(src *Table, dstName, extraDstCond string, r Reader) error {
+ * http://stackoverflow.com/questions/17267417/how-do-i-do-an-upsert-merge-insert-on-duplicate-update-in-postgresq
+ * Only the rows that differ are updated, rewriting the others would leave
+ * dead tuples behind and fire the triggers for nothing. With a destination
+ * condition, only the rows that satisfy it are inserted, and only the
+ * destination rows that satisfy it are updated or deleted. */
+func (w *genericPostgresWriter) MergeTable(src *Table, dstName string, opts *MergeOptions, r Reader, c *Chunk) (*MergeStats, error) {
 	tmpName := "gomig_tmp"
 
+	if len(src.PrimaryKey()) == 0 {
+		return nil, fmt.Errorf("postgres: table %v has no key to merge on", src.Name)
+	}
+
 	mergeTableI := fmt.Sprintf("merge table %v into table %v",
 		src.Name, dstName)
+	if c != nil {
+		mergeTableI += ", " + c.String()
+	}
 	if err := w.e.Begin(mergeTableI); err != nil {
-		return err
+		return nil, err
+	}
+
+	/* foreign keys that are declared DEFERRABLE are only checked at the
+	 * end of the transaction, so rows of the table that reference each
+	 * other can be merged in any order. gomig doesn't create them that
+	 * way, this is for the ones that were. Every table is merged in a
+	 * transaction of its own, so it doesn't help tables that reference
+	 * each other in a cycle. */
+	if err := w.e.Submit("SET CONSTRAINTS ALL DEFERRED;\n"); err != nil {
+		return nil, err
 	}
 
 	/* create temporary table */
 	tempTableQ := fmt.Sprintf("CREATE TEMPORARY TABLE %v (\n\t%v\n)\nON COMMIT DROP;\n", tmpName, ColumnsSql(src))
 	if err := w.e.Submit(tempTableQ); err != nil {
-		return err
+		return nil, err
 	}
 
 	if PG_W_VERBOSE {
 		log.Println("postgres: preparing to read values from source db")
 	}
 
-	if err := w.transferTable(src, tmpName, r); err != nil {
-		return err
+	n, err := w.transferTable(src, tmpName, r, c)
+	if err != nil {
+		w.e.Rollback()
+		return nil, err
 	}
 
 	if PG_W_VERBOSE {
@@ -198,31 +248,205 @@ func (w *genericPostgresWriter) MergeTable(src *Table, dstName, extraDstCond str
 
 	/* analyze the temp table, for performance */
 	if err := w.e.Submit(fmt.Sprintf("ANALYZE %v;\n", tmpName)); err != nil {
-		return err
+		return nil, err
 	}
 
-	/* lock the target table */
-	lockTableQ := fmt.Sprintf("LOCK TABLE %v IN EXCLUSIVE MODE;", dstName)
-	if err := w.e.Submit(lockTableQ); err != nil {
-		return err
+	strategy, err := w.mergeStrategy(opts.Strategy)
+	if err != nil {
+		w.e.Rollback()
+		return nil, err
+	}
+
+	scope, err := opts.Scope()
+	if err != nil {
+		w.e.Rollback()
+		return nil, fmt.Errorf("postgres: can't merge table %v: %v", dstName, err)
+	}
+
+	if PG_W_VERBOSE {
+		log.Println("postgres: merging with the", strategy, "strategy")
+	}
+
+	pkCols := make([]string, 0, len(src.Columns))
+	pkWhere := make([]string, 0, len(src.Columns))
+	for _, col := range src.Columns {
+		if col.PrimaryKey {
+			pkCols = append(pkCols, col.Name)
+			pkWhere = append(pkWhere, fmt.Sprintf("dst.%[1]v = src.%[1]v", col.Name))
+		}
+	}
+	pkWherePart := strings.Join(pkWhere, "\nAND    ")
+
+	/* ON CONFLICT needs a unique index on the merge key, which a table
+	 * merged on a merge_key might not have */
+	if strategy == MergeUpsert {
+		unique, err := w.hasUniqueIndex(dstName, pkCols)
+		if err != nil {
+			w.e.Rollback()
+			return nil, err
+		}
+		if !unique {
+			strategy = MergeLegacy
+			if w.serverVersion >= mergeVersion {
+				strategy = MergeStatement
+			}
+		}
+	}
+
+	counting := w.e.HasCapability(CapResults)
+	stats := &MergeStats{}
+	switch strategy {
+	case MergeUpsert, MergeStatement:
+		/* both statements report the inserted and updated rows
+		 * together, so the rows that will be inserted are counted
+		 * first */
+		if counting {
+			newQ := newRowsSql(dstName, tmpName, pkWherePart, scope)
+			if err := w.e.QueryRow(newQ, &stats.Inserted); err != nil {
+				return nil, err
+			}
+		}
+
+		mergeQ := upsertSql(src, dstName, tmpName, pkCols, scope)
+		if strategy == MergeStatement {
+			mergeQ = mergeStatementSql(src, dstName, tmpName, pkWherePart, scope)
+		}
+		merged, err := w.e.SubmitCount(mergeQ)
+		if err != nil {
+			return nil, err
+		}
+		stats.Updated = merged - stats.Inserted
+	default:
+		lockQ, updateQ, insertQ := legacyMergeSql(src, dstName, tmpName, pkWherePart, scope)
+		if err := w.e.Submit(lockQ); err != nil {
+			return nil, err
+		}
+		if updateQ != "" {
+			if stats.Updated, err = w.e.SubmitCount(updateQ); err != nil {
+				return nil, err
+			}
+		}
+		if stats.Inserted, err = w.e.SubmitCount(insertQ); err != nil {
+			return nil, err
+		}
+	}
+	stats.Unchanged = n - stats.Inserted - stats.Updated
+
+	if opts.DeleteMissing {
+		deleteQ, err := deleteMissingSql(src, dstName, tmpName, pkWherePart, scope, opts, c)
+		if err != nil {
+			w.e.Rollback()
+			return nil, fmt.Errorf("postgres: can't delete the missing rows of table %v: %v", dstName, err)
+		}
+		if stats.Deleted, err = w.e.SubmitCount(deleteQ); err != nil {
+			return nil, err
+		}
+	}
+
+	if PG_W_VERBOSE {
+		log.Print("postgres: statements completed, executing transaction")
+	}
+
+	if err := w.e.Commit(); err != nil {
+		return nil, err
+	}
+	if !counting {
+		return nil, nil
+	}
+	return stats, nil
+}
+
+/* whether the destination table has a unique index on exactly the given
+ * columns, which INSERT ... ON CONFLICT can use. The statements of a file
+ * are run by someone else, so there it's assumed to have one. */
+func (w *genericPostgresWriter) hasUniqueIndex(dstName string, cols []string) (bool, error) {
+	if !w.e.HasCapability(CapResults) {
+		return true, nil
+	}
+	if unique, ok := w.uniqueKeys[dstName]; ok {
+		return unique, nil
+	}
+
+	names := make([]string, 0, len(cols))
+	for _, col := range cols {
+		names = append(names, stringLiteral(col))
+	}
+	keyCols := "ARRAY[" + strings.Join(names, ", ") + "]::text[]"
+
+	var unique bool
+	q := fmt.Sprintf(`
+SELECT EXISTS (
+	SELECT 1
+	FROM   pg_index i
+	WHERE  i.indrelid = %v::regclass
+	AND    i.indisunique
+	AND    i.indimmediate
+	AND    i.indpred IS NULL
+	AND    i.indexprs IS NULL
+	AND    (SELECT array_agg(a.attname::text)
+	        FROM   pg_attribute a
+	        WHERE  a.attrelid = i.indrelid
+	        AND    a.attnum = ANY(i.indkey)) <@ %[2]v
+	AND    i.indnatts = %[3]v
+);`, stringLiteral(dstName), keyCols, len(cols))
+	if err := w.e.QueryRow(q, &unique); err != nil {
+		return false, fmt.Errorf("postgres: could not look up the unique indices of %v: %v", dstName, err)
+	}
+
+	if !unique {
+		log.Printf("postgres: table %v has no unique index on (%v), it can't be merged with the upsert strategy",
+			dstName, strings.Join(cols, ", "))
+	}
+	w.uniqueKeys[dstName] = unique
+	return unique, nil
+}
+
+/* the oldest server versions (as in server_version_num) that support
+ * INSERT ... ON CONFLICT and MERGE */
+const (
+	upsertVersion = 90500
+	mergeVersion  = 150000
+)
+
+/* resolves auto to the best strategy the server supports. The version of
+ * the server that will run the statements of a file isn't known, so auto
+ * means legacy there. */
+func (w *genericPostgresWriter) mergeStrategy(strategy MergeStrategy) (MergeStrategy, error) {
+	switch {
+	case strategy == MergeUpsert && w.serverVersion != 0 && w.serverVersion < upsertVersion,
+		strategy == MergeStatement && w.serverVersion != 0 && w.serverVersion < mergeVersion:
+		return "", fmt.Errorf("postgres: the server (version %v) doesn't support the %v merge strategy",
+			w.serverVersion, strategy)
+	case strategy != MergeAuto && strategy != "":
+		return strategy, nil
+	case w.serverVersion >= mergeVersion:
+		return MergeStatement, nil
+	case w.serverVersion >= upsertVersion:
+		return MergeUpsert, nil
+	default:
+		return MergeLegacy, nil
 	}
+}
+
+/* takes an EXCLUSIVE lock so no rows can be inserted between the UPDATE
+ * and the INSERT, which join the temp table with the destination table
+ * separately */
+func legacyMergeSql(src *Table, dstName, tmpName, pkWherePart, scope string) (lockQ, updateQ, insertQ string) {
+	lockQ = fmt.Sprintf("LOCK TABLE %v IN EXCLUSIVE MODE;", dstName)
 
 	colnames := make([]string, 0, len(src.Columns))
 	srccol := make([]string, 0, len(src.Columns))
-	pkWhere := make([]string, 0, len(src.Columns))
 	pkIsNull := make([]string, 0, len(src.Columns))
 	colassign := make([]string, 0, len(src.Columns))
 	for _, col := range src.Columns {
 		colnames = append(colnames, col.Name)
 		srccol = append(srccol, "src."+col.Name)
 		if col.PrimaryKey {
-			pkWhere = append(pkWhere, fmt.Sprintf("dst.%[1]v = src.%[1]v", col.Name))
 			pkIsNull = append(pkIsNull, fmt.Sprintf("dst.%[1]v IS NULL", col.Name))
 		} else {
 			colassign = append(colassign, fmt.Sprintf("%[1]v = src.%[1]v", col.Name))
 		}
 	}
-	pkWherePart := strings.Join(pkWhere, "\nAND    ")
 	pkIsNullPart := strings.Join(pkIsNull, "\nAND    ")
 	srccolPart := strings.Join(srccol, ",\n       ")
 
@@ -230,50 +454,421 @@ func (w *genericPostgresWriter) MergeTable(src *Table, dstName, extraDstCond str
 	 * in which case we don't need the update part */
 	if len(colassign) != 0 {
 		/* UPDATE from temp table to target table based on PK */
-		updateQ := fmt.Sprintf(`
+		updateQ = fmt.Sprintf(`
 UPDATE %v AS dst
 SET    %v
 FROM   %v AS src
-WHERE  %v;`, dstName, strings.Join(colassign, ",\n       "), tmpName, pkWherePart)
-		if err := w.e.Submit(updateQ); err != nil {
-			return err
-		}
-	}
-
-	/* if there is an extra condition, make sure it attaches cleanly to the
-	 * rest of the query. */
-	if extraDstCond != "" {
-		extraDstCond = strings.TrimSpace(extraDstCond)
-		if !strings.HasPrefix(extraDstCond, "and") &&
-			!strings.HasPrefix(extraDstCond, "AND") &&
-			!strings.HasPrefix(extraDstCond, "or") &&
-			!strings.HasPrefix(extraDstCond, "OR") {
-			extraDstCond = "AND " + extraDstCond
-		}
-		extraDstCond = "\n" + extraDstCond
+WHERE  %v
+AND    %v%v;`, dstName, strings.Join(colassign, ",\n       "), scopedRowsSql(tmpName, scope),
+			pkWherePart, changedSql(src, "dst", "src"), scopeSql(scope))
 	}
 
 	/* INSERT from temp table to target table based on PK */
-	insertQ := fmt.Sprintf(`
+	insertQ = fmt.Sprintf(`
 INSERT INTO %[1]v (%[3]v)
 SELECT %[4]v
 FROM   %[2]v AS src
 LEFT OUTER JOIN %[1]v AS dst ON (
        %[5]v
 )
-WHERE  %[6]v%[7]v;`, dstName, tmpName, strings.Join(colnames, ", "), srccolPart,
-		pkWherePart, pkIsNullPart, extraDstCond)
-	if err := w.e.Submit(insertQ); err != nil {
+WHERE  %[6]v;`, dstName, scopedRowsSql(tmpName, scope), strings.Join(colnames, ", "), srccolPart,
+		pkWherePart, pkIsNullPart)
+
+	return lockQ, updateQ, insertQ
+}
+
+/* compares the non-primary key columns of two rows, NULLs are equal to
+ * each other. json has no equality operator, so json columns are compared
+ * as jsonb (which ignores whitespace and the order of the keys). */
+func changedSql(src *Table, dst, other string) string {
+	dstcol := make([]string, 0, len(src.Columns))
+	othercol := make([]string, 0, len(src.Columns))
+	for _, col := range src.Columns {
+		if !col.PrimaryKey {
+			dstcol = append(dstcol, comparableColumn(col, dst))
+			othercol = append(othercol, comparableColumn(col, other))
+		}
+	}
+
+	return fmt.Sprintf("(%v) IS DISTINCT FROM (%v)",
+		strings.Join(dstcol, ", "), strings.Join(othercol, ", "))
+}
+
+/* a column of a row, as something that can be compared with = */
+func comparableColumn(col *Column, row string) string {
+	if col.Type.Name == TypeJson {
+		return row + "." + col.Name + "::jsonb"
+	}
+	return row + "." + col.Name
+}
+
+/* counts the rows of the temp table that aren't in the destination table
+ * yet, and that the merge would insert */
+func newRowsSql(dstName, tmpName, pkWherePart, scope string) string {
+	return fmt.Sprintf(`
+SELECT COUNT(*)
+FROM   %v AS src
+WHERE  NOT EXISTS (SELECT 1 FROM %v AS dst WHERE %v);`, scopedRowsSql(tmpName, scope), dstName,
+		strings.Replace(pkWherePart, "\n", " ", -1))
+}
+
+/* INSERT ... ON CONFLICT needs a unique index on the primary key columns,
+ * which the destination table has if gomig created it (MergeTable checks
+ * that it does). Concurrent inserts are handled by the server, no lock is
+ * needed. */
+func upsertSql(src *Table, dstName, tmpName string, pkCols []string, scope string) string {
+	colnames := make([]string, 0, len(src.Columns))
+	srccol := make([]string, 0, len(src.Columns))
+	colassign := make([]string, 0, len(src.Columns))
+	for _, col := range src.Columns {
+		colnames = append(colnames, col.Name)
+		srccol = append(srccol, "src."+col.Name)
+		if !col.PrimaryKey {
+			colassign = append(colassign, fmt.Sprintf("%[1]v = EXCLUDED.%[1]v", col.Name))
+		}
+	}
+
+	/* if the table is all primary key (as far as we know), the existing
+	 * rows can be left alone */
+	action := "DO NOTHING"
+	if len(colassign) != 0 {
+		action = "DO UPDATE\nSET    " + strings.Join(colassign, ",\n       ") +
+			"\nWHERE  " + changedSql(src, "dst", "EXCLUDED") + scopeSql(scope)
+	}
+
+	return fmt.Sprintf(`
+INSERT INTO %v AS dst (%v)
+SELECT %v
+FROM   %v AS src
+ON CONFLICT (%v) %v;`, dstName, strings.Join(colnames, ", "), strings.Join(srccol, ",\n       "),
+		scopedRowsSql(tmpName, scope), strings.Join(pkCols, ", "), action)
+}
+
+/* MERGE joins the temp table with the destination table only once, and
+ * doesn't need a unique index on the primary key */
+func mergeStatementSql(src *Table, dstName, tmpName, pkWherePart, scope string) string {
+	colnames := make([]string, 0, len(src.Columns))
+	srccol := make([]string, 0, len(src.Columns))
+	colassign := make([]string, 0, len(src.Columns))
+	for _, col := range src.Columns {
+		colnames = append(colnames, col.Name)
+		srccol = append(srccol, "src."+col.Name)
+		if !col.PrimaryKey {
+			colassign = append(colassign, fmt.Sprintf("%[1]v = src.%[1]v", col.Name))
+		}
+	}
+
+	matched := ""
+	if len(colassign) != 0 {
+		cond := changedSql(src, "dst", "src")
+		if scope != "" {
+			cond += " AND (" + scope + ")"
+		}
+		matched = fmt.Sprintf("\nWHEN MATCHED AND %v THEN\n       UPDATE SET %v",
+			cond, strings.Join(colassign, ",\n                  "))
+	}
+
+	return fmt.Sprintf(`
+MERGE INTO %v AS dst
+USING  %v AS src
+ON (
+       %v
+)%v
+WHEN NOT MATCHED THEN
+       INSERT (%v)
+       VALUES (%v);`, dstName, scopedRowsSql(tmpName, scope), pkWherePart, matched,
+		strings.Join(colnames, ", "), strings.Join(srccol, ", "))
+}
+
+/* deletes the destination rows whose primary key isn't in the temp table,
+ * or marks them as deleted. Only the rows in the range of the chunk (if
+ * any) are in the temp table, the others are left alone. */
+func deleteMissingSql(src *Table, dstName, tmpName, pkWherePart, scope string, opts *MergeOptions, c *Chunk) (string, error) {
+	if pkWherePart == "" {
+		return "", fmt.Errorf("it has no primary key")
+	}
+
+	conds := []string{fmt.Sprintf("NOT EXISTS (SELECT 1 FROM %v AS src WHERE %v)",
+		tmpName, strings.Replace(pkWherePart, "\n", " ", -1))}
+	if c != nil {
+		cond, err := ChunkLiteralCondition(func(name string) string { return "dst." + name }, src, c, RawToPostgres)
+		if err != nil {
+			return "", err
+		}
+		if cond != "" {
+			conds = append(conds, cond)
+		}
+	}
+	if scope != "" {
+		conds = append(conds, "("+scope+")")
+	}
+
+	if sd := opts.SoftDelete; sd != nil {
+		return fmt.Sprintf(`
+UPDATE %[1]v AS dst
+SET    %[2]v = %[3]v
+WHERE  dst.%[2]v IS DISTINCT FROM %[3]v
+AND    %[4]v;`, dstName, sd.Column, sd.Value, strings.Join(conds, "\nAND    ")), nil
+	}
+
+	return fmt.Sprintf(`
+DELETE FROM %v AS dst
+WHERE  %v;`, dstName, strings.Join(conds, "\nAND    ")), nil
+}
+
+/* (re)creates the destination table without its primary key, which is
+ * only added after the data has been loaded, like pg_dump does. Columns
+ * that were auto-incrementing in the source get a sequence. The comments
+ * of the table and its columns are carried over. */
+func (w *genericPostgresWriter) CreateTable(src *Table, dstName string) error {
+	stmts := []string{fmt.Sprintf("DROP TABLE IF EXISTS %v CASCADE;", dstName)}
+
+	colSql := make([]string, 0, len(src.Columns))
+	seqOwners := make([]string, 0, 1)
+	for _, col := range src.Columns {
+		def := fmt.Sprintf("%v %v", col.Name, GenericToPostgresType(col.Type))
+		if col.AutoIncr {
+			seq := sequenceName(dstName, col.Name)
+			stmts = append(stmts,
+				fmt.Sprintf("DROP SEQUENCE IF EXISTS %v CASCADE;", seq),
+				fmt.Sprintf("CREATE SEQUENCE %v;", seq))
+			seqOwners = append(seqOwners,
+				fmt.Sprintf("ALTER SEQUENCE %v OWNED BY %v.%v;", seq, dstName, col.Name))
+			def += fmt.Sprintf(" DEFAULT nextval('%v')", seq)
+		}
+		if !col.Null {
+			def += " NOT NULL"
+		}
+		colSql = append(colSql, def)
+	}
+
+	stmts = append(stmts, fmt.Sprintf("CREATE TABLE %v (\n\t%v\n);",
+		dstName, strings.Join(colSql, ",\n\t")))
+	stmts = append(stmts, seqOwners...)
+
+	if src.Comment != "" {
+		stmts = append(stmts, fmt.Sprintf("COMMENT ON TABLE %v IS %v;",
+			dstName, stringLiteral(src.Comment)))
+	}
+	for _, col := range src.Columns {
+		if col.Comment != "" {
+			stmts = append(stmts, fmt.Sprintf("COMMENT ON COLUMN %v.%v IS %v;",
+				dstName, col.Name, stringLiteral(col.Comment)))
+		}
+	}
+
+	return w.e.Transaction(fmt.Sprintf("create table %v", dstName), stmts)
+}
+
+/* the columns are added without NOT NULL, the rows that are already there
+ * have no value for them */
+func (w *genericPostgresWriter) EvolveTable(src, dst *Table, dstName string, drop bool) (*SchemaDiff, error) {
+	d := DiffColumns(src, dst, GenericToPostgresType)
+
+	stmts := make([]string, 0, len(d.Added)+len(d.Changed)+len(d.Dropped))
+	for _, col := range d.Added {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %v ADD COLUMN %v %v;",
+			dstName, col.Name, GenericToPostgresType(col.Type)))
+	}
+	for _, c := range d.Changed {
+		if c.Type {
+			typ := GenericToPostgresType(c.Column.Type)
+			stmts = append(stmts, fmt.Sprintf("ALTER TABLE %v ALTER COLUMN %[2]v TYPE %[3]v USING %[2]v::%[3]v;",
+				dstName, c.Column.Name, typ))
+		}
+		if c.Null {
+			action := "SET NOT NULL"
+			if c.Column.Null {
+				action = "DROP NOT NULL"
+			}
+			stmts = append(stmts, fmt.Sprintf("ALTER TABLE %v ALTER COLUMN %v %v;",
+				dstName, c.Column.Name, action))
+		}
+	}
+	if drop {
+		for _, col := range d.Dropped {
+			stmts = append(stmts, fmt.Sprintf("ALTER TABLE %v DROP COLUMN %v;", dstName, col.Name))
+		}
+	}
+
+	if len(stmts) == 0 {
+		return d, nil
+	}
+	return d, w.e.Transaction(fmt.Sprintf("evolve table %v", dstName), stmts)
+}
+
+func (w *genericPostgresWriter) Truncate(dstName string) error {
+	return w.e.Transaction(fmt.Sprintf("truncate table %v", dstName),
+		[]string{fmt.Sprintf("TRUNCATE TABLE %v CASCADE;", dstName)})
+}
+
+/* copies the contents of the source table into the (empty) destination
+ * table, in one transaction */
+func (w *genericPostgresWriter) WriteTable(src *Table, dstName string, r Reader, c *Chunk) error {
+	writeTableI := fmt.Sprintf("write table %v into table %v", src.Name, dstName)
+	if c != nil {
+		writeTableI += ", " + c.String()
+	}
+	if err := w.e.Begin(writeTableI); err != nil {
 		return err
 	}
 
-	if PG_W_VERBOSE {
-		log.Print("postgres: statements completed, executing transaction")
+	if _, err := w.transferTable(src, dstName, r, c); err != nil {
+		w.e.Rollback()
+		return err
 	}
 
 	return w.e.Commit()
 }
 
+/* adds the primary key and the secondary indices, and advances the
+ * sequences past the loaded data */
+func (w *genericPostgresWriter) CreateIndices(src *Table, dstName string) error {
+	stmts := make([]string, 0, 2)
+
+	pkCols := make([]string, 0, len(src.Columns))
+	for _, col := range src.Columns {
+		if col.PrimaryKey {
+			pkCols = append(pkCols, col.Name)
+		}
+		if col.AutoIncr {
+			stmts = append(stmts, fmt.Sprintf(
+				"SELECT pg_catalog.setval('%v', (SELECT COALESCE(MAX(%v), 0) + 1 FROM %v), false);",
+				sequenceName(dstName, col.Name), col.Name, dstName))
+		}
+	}
+	if len(pkCols) > 0 {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %v ADD PRIMARY KEY (%v);",
+			dstName, strings.Join(pkCols, ", ")))
+	}
+	for _, idx := range src.Indices {
+		stmts = append(stmts, fmt.Sprintf("CREATE INDEX %v ON %v (%v);",
+			KeyName(dstName, idx.Name, idx.Columns, "idx"), dstName,
+			strings.Join(idx.Columns, ", ")))
+	}
+
+	if len(stmts) == 0 {
+		return nil
+	}
+
+	return w.e.Transaction(fmt.Sprintf("create indices of table %v", dstName), stmts)
+}
+
+/* adds the unique keys and foreign keys, the tables referenced by the
+ * foreign keys have to exist (and be loaded) by now */
+func (w *genericPostgresWriter) CreateConstraints(src *Table, dstName string) error {
+	stmts := make([]string, 0, len(src.UniqueKeys)+len(src.ForeignKeys))
+
+	for _, uk := range src.UniqueKeys {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %v ADD CONSTRAINT %v UNIQUE (%v);",
+			dstName, KeyName(dstName, uk.Name, uk.Columns, "key"),
+			strings.Join(uk.Columns, ", ")))
+	}
+	for _, fk := range src.ForeignKeys {
+		stmts = append(stmts, fmt.Sprintf(
+			"ALTER TABLE %v ADD CONSTRAINT %v FOREIGN KEY (%v) REFERENCES %v (%v) ON DELETE %v ON UPDATE %v;",
+			dstName, KeyName(dstName, fk.Name, fk.Columns, "fkey"),
+			strings.Join(fk.Columns, ", "), fk.RefTable, strings.Join(fk.RefColumns, ", "),
+			ReferentialAction(fk.OnDelete), ReferentialAction(fk.OnUpdate)))
+	}
+
+	if len(stmts) == 0 {
+		return nil
+	}
+
+	return w.e.Transaction(fmt.Sprintf("create constraints of table %v", dstName), stmts)
+}
+
+/* updates and inserts are done like a merge of a single row: the row is
+ * updated if it's there and inserted if it's not, which makes replaying a
+ * change harmless. Deleting and reinserting would be simpler, but would
+ * set off ON DELETE CASCADE foreign keys. */
+func (w *genericPostgresWriter) ApplyChanges(changes []*Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	if err := w.e.Begin(fmt.Sprintf("apply %v change(s)", len(changes))); err != nil {
+		return err
+	}
+	if err := w.e.Submit("SET CONSTRAINTS ALL DEFERRED;\n"); err != nil {
+		return err
+	}
+
+	for _, c := range changes {
+		stmts, err := changeStatements(c)
+		if err != nil {
+			w.e.Rollback()
+			return fmt.Errorf("postgres: %v: %v", c, err)
+		}
+
+		for _, stmt := range stmts {
+			if err := w.e.Submit(stmt); err != nil {
+				return err
+			}
+		}
+	}
+
+	return w.e.Commit()
+}
+
+func changeStatements(c *Change) ([]string, error) {
+	/* a table without a primary key is keyed on all of its columns, json
+	 * ones included, which can only be compared as jsonb */
+	types := make(map[string]*Type, len(c.Table.Columns))
+	for _, col := range c.Table.Columns {
+		types[col.Name] = col.Type
+	}
+	ident := func(name string) string {
+		if types[name].Name == TypeJson {
+			return name + "::jsonb"
+		}
+		return name
+	}
+
+	if c.Kind == ChangeDelete {
+		cond, err := RowCondition(c, c.Before, ident, RawToPostgres)
+		if err != nil {
+			return nil, err
+		}
+		return []string{fmt.Sprintf("DELETE FROM %v WHERE %v;", c.DstName, cond)}, nil
+	}
+
+	key := c.After
+	if c.Kind == ChangeUpdate {
+		key = c.Before
+	}
+	keyCond, err := RowCondition(c, key, ident, RawToPostgres)
+	if err != nil {
+		return nil, err
+	}
+	afterCond, err := RowCondition(c, c.After, ident, RawToPostgres)
+	if err != nil {
+		return nil, err
+	}
+	lits, err := RowLiterals(c.Table, c.After, RawToPostgres)
+	if err != nil {
+		return nil, err
+	}
+
+	/* the literals of the SELECT have to be cast, postgres takes quoted
+	 * ones to be text otherwise */
+	colnames := make([]string, 0, len(lits))
+	assign := make([]string, 0, len(lits))
+	casts := make([]string, 0, len(lits))
+	for idx, col := range c.Table.Columns {
+		colnames = append(colnames, col.Name)
+		assign = append(assign, fmt.Sprintf("%v = %v", col.Name, lits[idx]))
+		casts = append(casts, fmt.Sprintf("CAST(%v AS %v)", lits[idx], GenericToPostgresType(col.Type)))
+	}
+
+	return []string{
+		fmt.Sprintf("UPDATE %v SET %v WHERE %v;", c.DstName, strings.Join(assign, ", "), keyCond),
+		fmt.Sprintf("INSERT INTO %[1]v (%[2]v) SELECT %[3]v WHERE NOT EXISTS (SELECT 1 FROM %[1]v WHERE %[4]v);",
+			c.DstName, strings.Join(colnames, ", "), strings.Join(casts, ", "), afterCond),
+	}, nil
+}
+
 func (w *genericPostgresWriter) Close() error {
 	return w.e.Close()
 }
@@ -288,6 +883,12 @@ func NewPostgresWriter(conf *Config) (*PostgresWriter, error) {
 		return nil, err
 	}
 
+	var version int
+	if err := db.QueryRow("SHOW server_version_num").Scan(&version); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("postgres: could not determine the server version: %v", err)
+	}
+
 	executor, err := NewPgDbExecutor(db)
 	if err != nil {
 		db.Close()
@@ -303,18 +904,17 @@ func NewPostgresWriter(conf *Config) (*PostgresWriter, error) {
 		return nil, errors[0]
 	}
 
-	return &PostgresWriter{genericPostgresWriter{executor, 64}}, nil
+	return &PostgresWriter{genericPostgresWriter{executor, 64, version, make(map[string]bool)}}, nil
 }
 
 type PostgresFileWriter struct {
 	genericPostgresWriter
 }
 
-func NewPostgresFileWriter(filename string) (*PostgresFileWriter, error) {
-	executor, err := NewFileExecutor(filename)
-	if err != nil {
-		return nil, err
-	}
+/* writes the statements to out, which is closed together with the writer
+ * if it's an io.Closer */
+func NewPostgresFileWriter(out io.Writer) (*PostgresFileWriter, error) {
+	executor := NewPgFileExecutor(out)
 
 	errors := executor.Multiple("initializing DB connection", postgresInit)
 	if len(errors) > 0 {
@@ -325,7 +925,7 @@ func NewPostgresFileWriter(filename string) (*PostgresFileWriter, error) {
 		return nil, errors[0]
 	}
 
-	return &PostgresFileWriter{genericPostgresWriter{executor, 256}}, err
+	return &PostgresFileWriter{genericPostgresWriter{executor, 256, 0, make(map[string]bool)}}, nil
 }
 
 func ColumnsSql(table *Table) string {
@@ -342,9 +942,33 @@ func ColumnsSql(table *Table) string {
 		}
 	}
 
-	/* add the primary key */
-	colSql = append(colSql, fmt.Sprintf("PRIMARY KEY (%v)",
-		strings.Join(pkCols, ", ")))
+	/* add the primary key, if any */
+	if len(pkCols) > 0 {
+		colSql = append(colSql, fmt.Sprintf("PRIMARY KEY (%v)",
+			strings.Join(pkCols, ", ")))
+	}
 
 	return strings.Join(colSql, ",\n\t")
 }
+
+/* the rows of the temp table that are in the scope of the merge, the
+ * scope refers to them as dst like it does to the destination rows */
+func scopedRowsSql(tmpName, scope string) string {
+	if scope == "" {
+		return tmpName
+	}
+	return fmt.Sprintf("(SELECT * FROM %v AS dst WHERE %v)", tmpName, scope)
+}
+
+/* the scope of the merge as a condition on the destination row dst */
+func scopeSql(scope string) string {
+	if scope == "" {
+		return ""
+	}
+	return "\nAND    (" + scope + ")"
+}
+
+/* the name of the sequence that backs an auto-incrementing column */
+func sequenceName(table, column string) string {
+	return table + "_" + column + "_seq"
+}
@@ -0,0 +1,44 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	. "github.com/aktau/gomig/db/common"
+	_ "github.com/mattn/go-sqlite3"
+	"net/url"
+	"strings"
+)
+
+/* the database field of the config is the path of the database file */
+func openDB(conf *Config) (*sql.DB, error) {
+	if conf.Database == "" {
+		return nil, fmt.Errorf("sqlite: no database file specified")
+	}
+
+	dsn := conf.Database
+	params := make([]string, 0, len(conf.Options))
+	for _, key := range conf.OptionKeys() {
+		params = append(params, key+"="+url.QueryEscape(conf.Options[key]))
+	}
+	if len(params) > 0 {
+		dsn += "?" + strings.Join(params, "&")
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	/* temporary tables and views only exist on the connection that created
+	 * them, so we stick to one connection. This also avoids "database is
+	 * locked" errors when reading and writing at the same time. */
+	db.SetMaxOpenConns(1)
+
+	/* try to ping, let's fail fast */
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
@@ -0,0 +1,451 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	. "github.com/aktau/gomig/db/common"
+)
+
+var SQLITE_R_VERBOSE = false
+
+const (
+	/* temporary tables and views live in a separate schema */
+	tablesQuery = `
+SELECT name FROM sqlite_master
+WHERE  type IN ('table', 'view') AND name NOT LIKE 'sqlite_%'
+UNION
+SELECT name FROM sqlite_temp_master
+WHERE  type IN ('table', 'view') AND name NOT LIKE 'sqlite_%'
+ORDER BY name;`
+)
+
+/* for chunking */
+var dialect = Dialect{
+	Quote:       quote,
+	Placeholder: func(n int) string { return "?" },
+}
+
+type SqliteReader struct {
+	*sql.DB
+}
+
+func OpenReader(conf *Config) (*SqliteReader, error) {
+	db, err := openDB(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SqliteReader{db}, nil
+}
+
+func (r *SqliteReader) TableNames() []string {
+	rows, err := r.Query(tablesQuery)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	tables := make([]string, 0, 8)
+
+	var name string
+	for rows.Next() {
+		err = rows.Scan(&name)
+		if err != nil {
+			panic(err)
+		}
+
+		tables = append(tables, name)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		panic(err)
+	}
+
+	return tables
+}
+
+func (r *SqliteReader) Tables() []*Table {
+	return r.FilteredTables(nil, nil)
+}
+
+func (r *SqliteReader) FilteredTables(incl, excl map[string]bool) []*Table {
+	tableNames := r.TableNames()
+	filteredTableNames := FilterInclExcl(tableNames, incl, excl)
+	tables := make([]*Table, 0, len(filteredTableNames))
+
+	if SQLITE_R_VERBOSE {
+		log.Printf("sqlite: all tables = %v, filtered = %v\n", tableNames, filteredTableNames)
+	}
+
+	for _, tableName := range filteredTableNames {
+		/* query table information */
+		columns, err := r.columns(tableName)
+		if err != nil {
+			log.Println("sqlite: could not fetch columns of table", tableName, "error:", err)
+		}
+
+		indices, uniqueKeys, err := r.indices(tableName)
+		if err != nil {
+			log.Println("sqlite: could not fetch indices of table", tableName, "error:", err)
+		}
+
+		foreignKeys, err := r.foreignKeys(tableName)
+		if err != nil {
+			log.Println("sqlite: could not fetch foreign keys of table", tableName, "error:", err)
+		}
+
+		/* create table struct */
+		table := &Table{Name: tableName, DbType: "sqlite", Columns: columns,
+			Indices: indices, UniqueKeys: uniqueKeys, ForeignKeys: foreignKeys}
+
+		tables = append(tables, table)
+	}
+
+	return tables
+}
+
+type rawCol struct {
+	cid     int
+	name    string
+	rawtype string
+	notnull bool
+	defval  sql.NullString
+	pk      int
+}
+
+func (r *SqliteReader) columns(table string) ([]*Column, error) {
+	rows, err := r.Query(fmt.Sprintf("PRAGMA table_info(%v);", quote(table)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols := make([]*Column, 0, 8)
+	raws := make([]rawCol, 0, 8)
+	pkCount := 0
+
+	var rc rawCol
+	for rows.Next() {
+		err = rows.Scan(&rc.cid, &rc.name, &rc.rawtype, &rc.notnull, &rc.defval, &rc.pk)
+		if err != nil {
+			return nil, err
+		}
+
+		if rc.pk > 0 {
+			pkCount++
+		}
+		raws = append(raws, rc)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range raws {
+		cols = append(cols, processCol(table, &raws[i], pkCount))
+	}
+
+	return cols, nil
+}
+
+func processCol(table string, rc *rawCol, pkCount int) *Column {
+	t := rc.rawtype
+
+	/* a column declared as INTEGER PRIMARY KEY is an alias for the 64-bit
+	 * rowid, which is assigned automatically */
+	isRowid := rc.pk > 0 && pkCount == 1 && strings.ToUpper(t) == "INTEGER"
+
+	typ := SqliteToGenericType(t)
+	if isRowid {
+		typ = IntType(TypeLarge)
+	}
+
+	lower := strings.ToLower(t)
+
+	return &Column{
+		TableName:    table,
+		Name:         rc.name,
+		Type:         typ,
+		RawType:      t,
+		Length:       255,
+		Null:         !rc.notnull && rc.pk == 0,
+		PrimaryKey:   rc.pk > 0,
+		AutoIncr:     isRowid,
+		Default:      rc.defval,
+		NeedsQuoting: strings.Contains(lower, "char") || strings.Contains(lower, "text") || strings.Contains(lower, "clob"),
+	}
+}
+
+/* the index that backs the primary key, partial indices and indices on
+ * expressions are left out */
+func (r *SqliteReader) indices(table string) ([]*Index, []*UniqueKey, error) {
+	rows, err := r.Query(fmt.Sprintf("PRAGMA index_list(%v);", quote(table)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	type rawIndex struct {
+		name, internal string
+		unique         bool
+	}
+	raw := make([]rawIndex, 0, 4)
+
+	var (
+		seq, partial int
+		unique       bool
+		name, origin string
+	)
+	for rows.Next() {
+		err = rows.Scan(&seq, &name, &unique, &origin, &partial)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+
+		if origin == "pk" || partial != 0 {
+			continue
+		}
+
+		/* the indices behind UNIQUE constraints get internal names, which
+		 * can't be used for creating an index */
+		idx := rawIndex{name: name, internal: name, unique: unique}
+		if strings.HasPrefix(name, "sqlite_autoindex_") {
+			idx.name = ""
+		}
+		raw = append(raw, idx)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	indices := make([]*Index, 0, len(raw))
+	uniqueKeys := make([]*UniqueKey, 0, len(raw))
+	for _, idx := range raw {
+		columns, err := r.indexColumns(idx.internal)
+		if err != nil {
+			return nil, nil, err
+		}
+		if columns == nil {
+			continue
+		}
+
+		if idx.unique {
+			uniqueKeys = append(uniqueKeys, &UniqueKey{Name: idx.name, Columns: columns})
+		} else {
+			indices = append(indices, &Index{Name: idx.name, Columns: columns})
+		}
+	}
+
+	return indices, uniqueKeys, nil
+}
+
+/* returns nil if the index is on an expression */
+func (r *SqliteReader) indexColumns(index string) ([]string, error) {
+	rows, err := r.Query(fmt.Sprintf("PRAGMA index_info(%v);", quote(index)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make([]string, 0, 2)
+	expression := false
+
+	var (
+		seqno, cid int
+		name       sql.NullString
+	)
+	for rows.Next() {
+		err = rows.Scan(&seqno, &cid, &name)
+		if err != nil {
+			return nil, err
+		}
+		if !name.Valid {
+			expression = true
+		}
+		columns = append(columns, name.String)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	if expression {
+		return nil, nil
+	}
+	return columns, nil
+}
+
+/* SQLite doesn't require foreign keys to be named, so they're named after
+ * their table and id */
+func (r *SqliteReader) foreignKeys(table string) ([]*ForeignKey, error) {
+	rows, err := r.Query(fmt.Sprintf("PRAGMA foreign_key_list(%v);", quote(table)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fks := make([]*ForeignKey, 0, 2)
+	byId := make(map[int]*ForeignKey)
+
+	var (
+		id, seq                      int
+		refTable, col                string
+		refCol                       sql.NullString
+		onUpdate, onDelete, matching string
+	)
+	for rows.Next() {
+		err = rows.Scan(&id, &seq, &refTable, &col, &refCol, &onUpdate, &onDelete, &matching)
+		if err != nil {
+			return nil, err
+		}
+
+		fk, ok := byId[id]
+		if !ok {
+			fk = &ForeignKey{Name: fmt.Sprintf("%v_fk%v", table, id),
+				RefTable: refTable, OnUpdate: onUpdate, OnDelete: onDelete}
+			byId[id] = fk
+			fks = append(fks, fk)
+		}
+		fk.Columns = append(fk.Columns, col)
+
+		/* if the referenced columns are left out, the primary key of the
+		 * referenced table is meant */
+		fk.RefColumns = append(fk.RefColumns, refCol.String)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fk := range fks {
+		if fk.RefColumns[0] != "" {
+			continue
+		}
+		refCols, err := r.columns(fk.RefTable)
+		if err != nil {
+			return nil, err
+		}
+		fk.RefColumns = fk.RefColumns[:0]
+		for _, refCol := range refCols {
+			if refCol.PrimaryKey {
+				fk.RefColumns = append(fk.RefColumns, refCol.Name)
+			}
+		}
+	}
+
+	return fks, nil
+}
+
+/* caller is responsible for cleaning up the sql.Rows object */
+func (r *SqliteReader) Read(table *Table) (*sql.Rows, error) {
+	query, args := SelectQuery(dialect, table, nil)
+	return r.Query(query, args...)
+}
+
+func (r *SqliteReader) Chunks(table *Table, size int) ([]*Chunk, error) {
+	return ChunkTable(r, dialect, table, size)
+}
+
+/* caller is responsible for cleaning up the sql.Rows object */
+func (r *SqliteReader) ReadChunk(table *Table, c *Chunk) (*sql.Rows, error) {
+	query, args := SelectQuery(dialect, table, c)
+	return r.Query(query, args...)
+}
+
+func (r *SqliteReader) Max(table *Table, column string) (string, error) {
+	return ColumnMax(r, dialect, table, column)
+}
+
+/* SQLite keeps no row counts, so the rows are counted */
+func (r *SqliteReader) EstimateRows(table *Table) (int64, error) {
+	var n int64
+	err := r.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %v;", quote(table.Name))).Scan(&n)
+	return n, err
+}
+
+func (r *SqliteReader) CreateView(name string, body string) error {
+	stmt := fmt.Sprintf("CREATE TEMPORARY VIEW %v AS %v;", quote(name), body)
+
+	_, err := r.Exec(stmt)
+	return err
+}
+
+func (r *SqliteReader) DropView(name string) error {
+	stmt := fmt.Sprintf("DROP VIEW %v;", quote(name))
+
+	_, err := r.Exec(stmt)
+	return err
+}
+
+/* projections are temporary tables, SQLite can't add a primary key to an
+ * existing table so it is created first and then filled. The storage
+ * engine is a MySQL concept and is ignored. */
+func (r *SqliteReader) CreateProjection(name string, body string, engine string, pk []string, uks [][]string) error {
+	if len(pk) == 0 && len(uks) == 0 {
+		stmt := fmt.Sprintf("CREATE TEMPORARY TABLE %v AS %v;", quote(name), body)
+		if SQLITE_R_VERBOSE {
+			log.Printf("sqlite: creating projection:\n%v\n", stmt)
+		}
+
+		_, err := r.Exec(stmt)
+		return err
+	}
+
+	/* find out which columns (and their declared types) the body produces
+	 * by creating an empty scratch table from it */
+	scratch := name + "_gomig_scratch"
+	_, err := r.Exec(fmt.Sprintf("CREATE TEMPORARY TABLE %v AS SELECT * FROM (%v) LIMIT 0;",
+		quote(scratch), body))
+	if err != nil {
+		return err
+	}
+	cols, err := r.columns(scratch)
+	if _, derr := r.Exec(fmt.Sprintf("DROP TABLE %v;", quote(scratch))); err == nil {
+		err = derr
+	}
+	if err != nil {
+		return err
+	}
+
+	defs := make([]string, 0, len(cols)+1+len(uks))
+	for _, col := range cols {
+		defs = append(defs, strings.TrimSpace(quote(col.Name)+" "+col.RawType))
+	}
+	if len(pk) > 0 {
+		defs = append(defs, "PRIMARY KEY ("+strings.Join(pk, ", ")+")")
+	}
+	for _, uk := range uks {
+		defs = append(defs, "UNIQUE ("+strings.Join(uk, ", ")+")")
+	}
+
+	stmts := []string{
+		fmt.Sprintf("CREATE TEMPORARY TABLE %v (\n\t%v\n);", quote(name), strings.Join(defs, ",\n\t")),
+		fmt.Sprintf("INSERT INTO %v %v;", quote(name), body),
+	}
+	for _, stmt := range stmts {
+		if SQLITE_R_VERBOSE {
+			log.Printf("sqlite: creating projection:\n%v\n", stmt)
+		}
+		if _, err := r.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *SqliteReader) DropProjection(name string) error {
+	stmt := fmt.Sprintf("DROP TABLE %v;", quote(name))
+
+	_, err := r.Exec(stmt)
+	return err
+}
@@ -0,0 +1,34 @@
+package sqlite
+
+import (
+	"io"
+
+	"github.com/aktau/gomig/db"
+	. "github.com/aktau/gomig/db/common"
+)
+
+func init() {
+	db.RegisterReader("sqlite", func(conf *Config) (ReadCloser, error) {
+		r, err := OpenReader(conf)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	})
+
+	db.RegisterWriter("sqlite", func(conf *Config) (WriteCloser, error) {
+		w, err := NewSqliteWriter(conf)
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	})
+
+	db.RegisterFileWriter("sqlite", func(out io.Writer) (WriteCloser, error) {
+		w, err := NewSqliteFileWriter(out)
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	})
+}
@@ -0,0 +1,87 @@
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aktau/gomig/db/common"
+)
+
+type SqliteDbExecutor struct {
+	common.DbExecutor
+	bulkStmt *sql.Stmt
+}
+
+func NewSqliteDbExecutor(db *sql.DB) (*SqliteDbExecutor, error) {
+	base, err := common.NewDbExecutor(db, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SqliteDbExecutor{*base, nil}, nil
+}
+
+/* SQLite has no special bulk loading facilities, but a prepared INSERT
+ * statement that is executed inside of a transaction comes close */
+func (e *SqliteDbExecutor) BulkInit(table string, columns ...string) error {
+	db := e.GetDb()
+	if db == nil {
+		return errors.New("executor did not have a valid database")
+	}
+
+	quoted := make([]string, 0, len(columns))
+	params := make([]string, 0, len(columns))
+	for _, col := range columns {
+		quoted = append(quoted, quote(col))
+		params = append(params, "?")
+	}
+	insertSql := fmt.Sprintf("INSERT INTO %v (%v) VALUES (%v);", quote(table),
+		strings.Join(quoted, ", "), strings.Join(params, ", "))
+
+	var (
+		stmt *sql.Stmt
+		err  error
+	)
+	if tx := e.GetTx(); tx == nil {
+		stmt, err = db.Prepare(insertSql)
+	} else {
+		stmt, err = tx.Prepare(insertSql)
+	}
+	if err != nil {
+		return err
+	}
+	e.bulkStmt = stmt
+
+	return nil
+}
+
+func (e *SqliteDbExecutor) BulkAddRecord(args ...interface{}) error {
+	if e.bulkStmt == nil {
+		return errors.New("no bulk statement in progress")
+	}
+
+	_, err := e.bulkStmt.Exec(args...)
+	return err
+}
+
+func (e *SqliteDbExecutor) BulkFinish() error {
+	if e.bulkStmt == nil {
+		return errors.New("no bulk statement in progress")
+	}
+
+	err := e.bulkStmt.Close()
+	if err != nil {
+		log.Println("sqlite_executor: could not properly close bulk statement", err)
+	}
+
+	/* make sure to reset the bulk statement */
+	e.bulkStmt = nil
+	return err
+}
+
+func (e *SqliteDbExecutor) HasCapability(capability int) bool {
+	return capability == common.CapBulkTransfer || e.DbExecutor.HasCapability(capability)
+}
@@ -0,0 +1,189 @@
+package sqlite
+
+import (
+	"encoding/hex"
+	"fmt"
+	. "github.com/aktau/gomig/db/common"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/* SQLite doesn't enforce column types, so this looks at the declared type
+ * of the column, loosely following SQLite's own type affinity rules */
+func SqliteToGenericType(sqliteType string) *Type {
+	rt := strings.ToLower(sqliteType)
+	switch {
+	case rt == "":
+		/* no declared type means BLOB affinity */
+		return BlobType()
+	case rt == "boolean", rt == "bool":
+		return BoolType()
+	case rt == "date":
+		return DateType()
+	case rt == "time":
+		return TimeType()
+	case rt == "datetime", strings.HasPrefix(rt, "timestamp"):
+		return TimestampType()
+	case rt == "json":
+		return SimpleType(TypeJson)
+	case rt == "unsigned big int":
+		return IntType(TypeHuge)
+	case strings.Contains(rt, "tinyint"), strings.Contains(rt, "smallint"):
+		return IntType(TypeSmall)
+	case strings.Contains(rt, "bigint"):
+		return IntType(TypeLarge)
+	case strings.Contains(rt, "int"):
+		return IntType(TypeNormal)
+	case strings.Contains(rt, "varchar"), strings.Contains(rt, "varying"),
+		strings.Contains(rt, "clob"), strings.Contains(rt, "text"):
+		t := TextType()
+		t.Max = extractLength(rt)
+		return t
+	case strings.Contains(rt, "char"):
+		t := PaddedTextType()
+		t.Max = extractLength(rt)
+		return t
+	case strings.Contains(rt, "blob"):
+		return BlobType()
+	case strings.Contains(rt, "float"):
+		return FloatType()
+	case strings.Contains(rt, "real"), strings.Contains(rt, "doub"):
+		return DoubleType()
+	case rt == "num", strings.Contains(rt, "numeric"), strings.Contains(rt, "decimal"):
+		return NumericType(extractPrecisionAndScale(rt))
+	default:
+		log.Println("WARNING: sqlite: encountered an unknown type, ", rt)
+		return SimpleType(rt)
+	}
+}
+
+/* the declared types are chosen so that SqliteToGenericType() maps them
+ * back to the same generic type */
+func GenericToSqliteType(genericType *Type) string {
+	gen := genericType
+	name := gen.Name
+	max := gen.Max
+	precision := gen.Precision
+	scale := gen.Scale
+	modifier := gen.Modifier
+
+	switch name {
+	case TypeText:
+		if gen.HasMax() {
+			return fmt.Sprintf("varchar(%v)", max)
+		}
+		return "text"
+	case TypeChar:
+		if gen.HasMax() {
+			return fmt.Sprintf("character(%v)", max)
+		}
+		return "character"
+	case TypeFloat:
+		return "float"
+	case TypeDouble:
+		return "double"
+	case TypeNumeric:
+		if precision == 0 {
+			return "numeric"
+		}
+		return fmt.Sprintf("numeric(%v, %v)", precision, scale)
+	case TypeBit, TypeBlob:
+		return "blob"
+	case TypeBool:
+		return "boolean"
+	case TypeInteger:
+		switch modifier {
+		case TypeSmall:
+			return "smallint"
+		case TypeNormal:
+			return "integer"
+		case TypeLarge:
+			return "bigint"
+		case TypeHuge:
+			return "unsigned big int"
+		default:
+			return "integer"
+		}
+	case TypeDate:
+		return "date"
+	case TypeTime:
+		return "time"
+	case TypeTimeStamp:
+		return "datetime"
+	case TypeSet:
+		return "text"
+	case TypeJson:
+		return "json"
+	default:
+		return name
+	}
+}
+
+/* returns 0 if no length could be determined */
+func extractLength(sqliteType string) uint {
+	/* matches should be: [sqliteType, length] */
+	matches := regexp.MustCompile(`\w+\s*\((\d+)\)`).FindStringSubmatch(sqliteType)
+
+	if len(matches) != 2 {
+		return 0
+	}
+
+	i, err := strconv.Atoi(matches[1])
+	if err != nil {
+		return 0
+	}
+
+	return uint(i)
+}
+
+/* returns a precision, scale tuple */
+func extractPrecisionAndScale(sqliteType string) (uint, uint) {
+	/* matches should be: [sqliteType, precision, scale] */
+	matches := regexp.MustCompile(`\w+\s*\(\s*(\d+)\s*,\s*(\d+)\s*\)`).FindStringSubmatch(sqliteType)
+
+	if len(matches) != 3 {
+		return 0, 0
+	}
+
+	precision, err := strconv.Atoi(matches[1])
+	if err != nil {
+		return 0, 0
+	}
+	scale, err := strconv.Atoi(matches[2])
+	if err != nil {
+		return 0, 0
+	}
+
+	return uint(precision), uint(scale)
+}
+
+func quote(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+/* converts a RawBytes field into an SQL literal */
+func RawToSqlite(val []byte, origType *Type) (string, error) {
+	if val == nil {
+		return "NULL", nil
+	}
+
+	switch origType.Name {
+	case TypeBool:
+		switch string(val) {
+		case "0", "f", "false":
+			return "0", nil
+		case "1", "t", "true":
+			return "1", nil
+		default:
+			return "", fmt.Errorf("sqlite: did not recognize bool value: %v", string(val))
+		}
+	case TypeNumeric, TypeInteger, TypeFloat, TypeDouble:
+		return string(val), nil
+	case TypeBlob, TypeBit:
+		return "X'" + hex.EncodeToString(val) + "'", nil
+	default:
+		return "'" + strings.Replace(string(val), "'", "''", -1) + "'", nil
+	}
+}
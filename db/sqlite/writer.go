@@ -0,0 +1,613 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	. "github.com/aktau/gomig/db/common"
+)
+
+var SQLITE_W_VERBOSE = true
+
+var (
+	sqliteWriterInit = []string{
+		"PRAGMA foreign_keys = OFF;",
+	}
+)
+
+type SqliteWriter struct {
+	e               Executor
+	insertBulkLimit int
+}
+
+func NewSqliteWriter(conf *Config) (*SqliteWriter, error) {
+	db, err := openDB(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	executor, err := NewSqliteDbExecutor(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	errors := executor.Multiple("initializing DB connection", sqliteWriterInit)
+	if len(errors) > 0 {
+		executor.Close()
+		for _, err := range errors {
+			log.Println("sqlite error:", err)
+		}
+		return nil, errors[0]
+	}
+
+	return &SqliteWriter{executor, 256}, nil
+}
+
+/* writes the statements to out, which is closed together with the writer
+ * if it's an io.Closer */
+func NewSqliteFileWriter(out io.Writer) (*SqliteWriter, error) {
+	executor := NewFileExecutor(out)
+
+	errors := executor.Multiple("initializing DB connection", sqliteWriterInit)
+	if len(errors) > 0 {
+		executor.Close()
+		for _, err := range errors {
+			log.Println("sqlite error:", err)
+		}
+		return nil, errors[0]
+	}
+
+	return &SqliteWriter{executor, 256}, nil
+}
+
+/* returns the number of rows that were transferred */
+func (w *SqliteWriter) transferTable(src *Table, dstName string, r Reader, c *Chunk) (int64, error) {
+	rows, err := ReadRows(r, src, c)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	if SQLITE_W_VERBOSE {
+		log.Print("sqlite: query done, scanning rows...")
+	}
+
+	var n int64
+	if w.e.HasCapability(CapBulkTransfer) {
+		n, err = w.bulkTransfer(src, dstName, rows)
+	} else {
+		n, err = w.normalTransfer(src, dstName, rows)
+	}
+	if err != nil {
+		return n, err
+	}
+
+	return n, rows.Err()
+}
+
+func (w *SqliteWriter) bulkTransfer(src *Table, dstName string, rows *sql.Rows) (n int64, err error) {
+	colnames := make([]string, 0, len(src.Columns))
+	for _, col := range src.Columns {
+		colnames = append(colnames, col.Name)
+	}
+
+	if err = w.e.BulkInit(dstName, colnames...); err != nil {
+		return 0, err
+	}
+	defer func() {
+		berr := w.e.BulkFinish()
+		if err == nil {
+			/* if there was no earlier error, set the one from BulkFinish */
+			err = berr
+		}
+	}()
+
+	/* create a slice with the right types to extract into, and let the SQL
+	 * driver take care of the conversion */
+	vals := NewTypedSlice(src)
+
+	for rows.Next() {
+		if err = rows.Scan(vals...); err != nil {
+			return n, fmt.Errorf("sqlite: error while reading from source: %v", err)
+		}
+
+		if err = w.e.BulkAddRecord(vals...); err != nil {
+			return n, fmt.Errorf("sqlite: error during bulk insert: %v", err)
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+/* writes the rows as multi-row INSERT statements, for a file */
+func (w *SqliteWriter) normalTransfer(src *Table, dstName string, rows *sql.Rows) (int64, error) {
+	colnames := make([]string, 0, len(src.Columns))
+	for _, col := range src.Columns {
+		colnames = append(colnames, col.Name)
+	}
+	insertQ := fmt.Sprintf("INSERT INTO %v (%v) VALUES\n\t",
+		quote(dstName), quoteAll(colnames))
+
+	pointers := make([]interface{}, len(src.Columns))
+	containers := make([]sql.RawBytes, len(src.Columns))
+	for i := range pointers {
+		pointers[i] = &containers[i]
+	}
+	stringrep := make([]string, 0, len(src.Columns))
+	insertLines := make([]string, 0, 32)
+	var n int64
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return n, fmt.Errorf("sqlite: error while reading from source: %v", err)
+		}
+
+		for idx, val := range containers {
+			str, err := RawToSqlite(val, src.Columns[idx].Type)
+			if err != nil {
+				return n, err
+			}
+			stringrep = append(stringrep, str)
+		}
+
+		insertLines = append(insertLines, "("+strings.Join(stringrep, ",")+")")
+		stringrep = stringrep[:0]
+		n++
+
+		if len(insertLines) >= w.insertBulkLimit {
+			if err := w.e.Submit(insertQ + strings.Join(insertLines, ",\n\t") + ";\n"); err != nil {
+				return n, err
+			}
+			insertLines = insertLines[:0]
+		}
+	}
+
+	if len(insertLines) > 0 {
+		if err := w.e.Submit(insertQ + strings.Join(insertLines, ",\n\t") + ";\n"); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+/* SQLite can't add a primary key or foreign keys to an existing table, so
+ * they're created together with the table. The foreign keys aren't
+ * enforced during the load, as foreign key checking is turned off for the
+ * connection. */
+func (w *SqliteWriter) CreateTable(src *Table, dstName string) error {
+	defs := ColumnsSql(src)
+	for _, fk := range src.ForeignKeys {
+		defs += fmt.Sprintf(",\n\tCONSTRAINT %v FOREIGN KEY (%v) REFERENCES %v (%v) ON DELETE %v ON UPDATE %v",
+			quote(KeyName(dstName, fk.Name, fk.Columns, "fkey")), quoteAll(fk.Columns),
+			quote(fk.RefTable), quoteAll(fk.RefColumns),
+			ReferentialAction(fk.OnDelete), ReferentialAction(fk.OnUpdate))
+	}
+	createQ := fmt.Sprintf("CREATE TABLE %v (\n\t%v\n);", quote(dstName), defs)
+
+	return w.e.Transaction(fmt.Sprintf("create table %v", dstName), []string{
+		fmt.Sprintf("DROP TABLE IF EXISTS %v;", quote(dstName)),
+		createQ,
+	})
+}
+
+/* SQLite can add and (since 3.35) drop columns, but it can't change them,
+ * that takes rebuilding the table. The columns are added without NOT NULL,
+ * the rows that are already there have no value for them. */
+func (w *SqliteWriter) EvolveTable(src, dst *Table, dstName string, drop bool) (*SchemaDiff, error) {
+	d := DiffColumns(src, dst, GenericToSqliteType)
+
+	stmts := make([]string, 0, len(d.Added)+len(d.Dropped))
+	for _, col := range d.Added {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE %v ADD COLUMN %v %v;",
+			quote(dstName), quote(col.Name), GenericToSqliteType(col.Type)))
+	}
+	for _, c := range d.Changed {
+		log.Printf("sqlite: column %v of table %v differs from the source, "+
+			"SQLite can't change it without rebuilding the table\n", c.Column.Name, dstName)
+	}
+	if drop {
+		for _, col := range d.Dropped {
+			stmts = append(stmts, fmt.Sprintf("ALTER TABLE %v DROP COLUMN %v;",
+				quote(dstName), quote(col.Name)))
+		}
+	}
+
+	if len(stmts) == 0 {
+		return d, nil
+	}
+	return d, w.e.Transaction(fmt.Sprintf("evolve table %v", dstName), stmts)
+}
+
+func (w *SqliteWriter) Truncate(dstName string) error {
+	return w.e.Transaction(fmt.Sprintf("truncate table %v", dstName),
+		[]string{fmt.Sprintf("DELETE FROM %v;", quote(dstName))})
+}
+
+func (w *SqliteWriter) WriteTable(src *Table, dstName string, r Reader, c *Chunk) error {
+	writeTableI := fmt.Sprintf("write table %v into table %v", src.Name, dstName)
+	if c != nil {
+		writeTableI += ", " + c.String()
+	}
+	if err := w.e.Begin(writeTableI); err != nil {
+		return err
+	}
+
+	if _, err := w.transferTable(src, dstName, r, c); err != nil {
+		w.e.Rollback()
+		return err
+	}
+
+	return w.e.Commit()
+}
+
+/* the rows are loaded into a temporary staging table first, from which
+ * they are upserted with INSERT ... ON CONFLICT (needs SQLite >= 3.24).
+ * Only the rows that differ are updated. With a destination condition,
+ * only the rows that satisfy it are inserted, and only the destination
+ * rows that satisfy it are updated or deleted. */
+func (w *SqliteWriter) MergeTable(src *Table, dstName string, opts *MergeOptions, r Reader, c *Chunk) (*MergeStats, error) {
+	tmpName := "gomig_tmp"
+
+	if len(src.PrimaryKey()) == 0 {
+		return nil, fmt.Errorf("sqlite: table %v has no key to merge on", src.Name)
+	}
+
+	mergeTableI := fmt.Sprintf("merge table %v into table %v",
+		src.Name, dstName)
+	if c != nil {
+		mergeTableI += ", " + c.String()
+	}
+
+	scope, err := opts.Scope()
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: can't merge table %v: %v", dstName, err)
+	}
+
+	if err := w.e.Begin(mergeTableI); err != nil {
+		return nil, err
+	}
+
+	tempTableQ := fmt.Sprintf("CREATE TEMPORARY TABLE %v (\n\t%v\n);", tmpName, ColumnsSql(src))
+	for _, stmt := range []string{"DROP TABLE IF EXISTS temp." + tmpName + ";", tempTableQ} {
+		if err := w.e.Submit(stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	n, err := w.transferTable(src, tmpName, r, c)
+	if err != nil {
+		w.e.Rollback()
+		return nil, err
+	}
+
+	if SQLITE_W_VERBOSE {
+		log.Print("sqlite: rowscan done, creating merge statements")
+	}
+
+	colnames := make([]string, 0, len(src.Columns))
+	pkCols := make([]string, 0, len(src.Columns))
+	colassign := make([]string, 0, len(src.Columns))
+	dstcol := make([]string, 0, len(src.Columns))
+	excludedcol := make([]string, 0, len(src.Columns))
+	for _, col := range src.Columns {
+		colnames = append(colnames, quote(col.Name))
+		if col.PrimaryKey {
+			pkCols = append(pkCols, quote(col.Name))
+		} else {
+			colassign = append(colassign, fmt.Sprintf("%[1]v = excluded.%[1]v", quote(col.Name)))
+			dstcol = append(dstcol, "dst."+quote(col.Name))
+			excludedcol = append(excludedcol, "excluded."+quote(col.Name))
+		}
+	}
+
+	/* if the table is all primary key (as far as we know), the existing
+	 * rows can be left alone */
+	onConflict := "\nON CONFLICT DO NOTHING"
+	if len(colassign) != 0 {
+		onConflict = fmt.Sprintf("\nON CONFLICT (%v) DO UPDATE\nSET    %v\nWHERE  (%v) IS NOT (%v)%v",
+			strings.Join(pkCols, ", "), strings.Join(colassign, ",\n       "),
+			strings.Join(dstcol, ", "), strings.Join(excludedcol, ", "), scopeSql(scope))
+	}
+
+	/* the inserted and updated rows can't be told apart afterwards, so
+	 * they're counted beforehand */
+	counting := w.e.HasCapability(CapResults)
+	stats := &MergeStats{}
+	if counting {
+		countQ := countSql(src, dstName, tmpName, scope)
+		if err := w.e.QueryRow(countQ, &stats.Inserted, &stats.Updated); err != nil {
+			return nil, err
+		}
+		stats.Unchanged = n - stats.Inserted - stats.Updated
+	}
+
+	/* the WHERE clause is mandatory, otherwise SQLite's parser mistakes
+	 * the ON of ON CONFLICT for a join constraint */
+	mergeQ := fmt.Sprintf(`
+INSERT INTO %v AS dst (%v)
+SELECT %v
+FROM   %v AS src
+WHERE  1 = 1%v;`, quote(dstName), strings.Join(colnames, ", "),
+		strings.Join(colnames, ",\n       "), scopedRowsSql(tmpName, scope), onConflict)
+	if err := w.e.Submit(mergeQ); err != nil {
+		return nil, err
+	}
+
+	if opts.DeleteMissing {
+		deleteQ, err := deleteMissingSql(src, dstName, tmpName, scope, opts, c)
+		if err != nil {
+			w.e.Rollback()
+			return nil, fmt.Errorf("sqlite: can't delete the missing rows of table %v: %v", dstName, err)
+		}
+		if stats.Deleted, err = w.e.SubmitCount(deleteQ); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := w.e.Submit(fmt.Sprintf("DROP TABLE temp.%v;", tmpName)); err != nil {
+		return nil, err
+	}
+
+	if err := w.e.Commit(); err != nil {
+		return nil, err
+	}
+	if !counting {
+		return nil, nil
+	}
+	return stats, nil
+}
+
+/* counts the rows of the temp table that will be inserted, and those that
+ * will be updated because they differ from the destination row */
+func countSql(src *Table, dstName, tmpName, scope string) string {
+	pkWhere := make([]string, 0, 2)
+	dstcol := make([]string, 0, len(src.Columns))
+	srccol := make([]string, 0, len(src.Columns))
+	for _, col := range src.Columns {
+		if col.PrimaryKey {
+			pkWhere = append(pkWhere, fmt.Sprintf("dst.%[1]v = src.%[1]v", quote(col.Name)))
+		} else {
+			dstcol = append(dstcol, "dst."+quote(col.Name))
+			srccol = append(srccol, "src."+quote(col.Name))
+		}
+	}
+	pkWherePart := strings.Join(pkWhere, " AND ")
+
+	/* only the destination rows in the scope are updated */
+	updateWhere := pkWherePart
+	if scope != "" {
+		updateWhere += " AND (" + scope + ")"
+	}
+	changed := "0"
+	if len(dstcol) != 0 {
+		changed = fmt.Sprintf("COALESCE(SUM(EXISTS (SELECT 1 FROM %v AS dst WHERE %v AND (%v) IS NOT (%v))), 0)",
+			quote(dstName), updateWhere, strings.Join(dstcol, ", "), strings.Join(srccol, ", "))
+	}
+
+	return fmt.Sprintf(`
+SELECT COALESCE(SUM(NOT EXISTS (SELECT 1 FROM %v AS dst WHERE %v)), 0),
+       %v
+FROM   %v AS src;`, quote(dstName), pkWherePart, changed, scopedRowsSql(tmpName, scope))
+}
+
+/* deletes the destination rows whose primary key isn't in the temp table,
+ * or marks them as deleted. Only the rows in the range of the chunk (if
+ * any) are in the temp table, the others are left alone. SQLite doesn't
+ * allow an alias for the table of a DELETE, so the scope, which refers to
+ * the row as dst, is checked on the same row in a subquery. */
+func deleteMissingSql(src *Table, dstName, tmpName, scope string, opts *MergeOptions, c *Chunk) (string, error) {
+	dstCol := func(name string) string { return quote(dstName) + "." + quote(name) }
+
+	pkWhere := make([]string, 0, 2)
+	pkSame := make([]string, 0, 2)
+	for _, col := range src.Columns {
+		if col.PrimaryKey {
+			pkWhere = append(pkWhere, fmt.Sprintf("src.%v = %v", quote(col.Name), dstCol(col.Name)))
+			pkSame = append(pkSame, fmt.Sprintf("dst.%v = %v", quote(col.Name), dstCol(col.Name)))
+		}
+	}
+	if len(pkWhere) == 0 {
+		return "", fmt.Errorf("it has no primary key")
+	}
+
+	conds := []string{fmt.Sprintf("NOT EXISTS (SELECT 1 FROM %v AS src WHERE %v)",
+		tmpName, strings.Join(pkWhere, " AND "))}
+	if c != nil {
+		cond, err := ChunkLiteralCondition(dstCol, src, c, RawToSqlite)
+		if err != nil {
+			return "", err
+		}
+		if cond != "" {
+			conds = append(conds, cond)
+		}
+	}
+	if scope != "" {
+		conds = append(conds, fmt.Sprintf("EXISTS (SELECT 1 FROM %v AS dst WHERE %v AND (%v))",
+			quote(dstName), strings.Join(pkSame, " AND "), scope))
+	}
+
+	if sd := opts.SoftDelete; sd != nil {
+		return fmt.Sprintf(`
+UPDATE %[1]v
+SET    %[2]v = %[3]v
+WHERE  %[4]v IS NOT %[3]v
+AND    %[5]v;`, quote(dstName), quote(sd.Column), sd.Value, dstCol(sd.Column),
+			strings.Join(conds, "\nAND    ")), nil
+	}
+
+	return fmt.Sprintf(`
+DELETE FROM %v
+WHERE  %v;`, quote(dstName), strings.Join(conds, "\nAND    ")), nil
+}
+
+/* the primary key is already created together with the table, index
+ * names have to be unique in the whole database */
+func (w *SqliteWriter) CreateIndices(src *Table, dstName string) error {
+	if len(src.Indices) == 0 {
+		return nil
+	}
+
+	stmts := make([]string, 0, len(src.Indices))
+	for _, idx := range src.Indices {
+		stmts = append(stmts, fmt.Sprintf("CREATE INDEX %v ON %v (%v);",
+			quote(KeyName(dstName, idx.Name, idx.Columns, "idx")), quote(dstName),
+			quoteAll(idx.Columns)))
+	}
+
+	return w.e.Transaction(fmt.Sprintf("create indices of table %v", dstName), stmts)
+}
+
+/* unique constraints can only be added to an existing table in the form
+ * of unique indices, the foreign keys were created together with the
+ * table */
+func (w *SqliteWriter) CreateConstraints(src *Table, dstName string) error {
+	if len(src.UniqueKeys) == 0 {
+		return nil
+	}
+
+	stmts := make([]string, 0, len(src.UniqueKeys))
+	for _, uk := range src.UniqueKeys {
+		stmts = append(stmts, fmt.Sprintf("CREATE UNIQUE INDEX %v ON %v (%v);",
+			quote(KeyName(dstName, uk.Name, uk.Columns, "key")), quote(dstName),
+			quoteAll(uk.Columns)))
+	}
+
+	return w.e.Transaction(fmt.Sprintf("create constraints of table %v", dstName), stmts)
+}
+
+/* inserts and updates replace the row, so replaying a change is harmless.
+ * Foreign keys aren't enforced for the connection, so replacing a row
+ * doesn't cascade. */
+func (w *SqliteWriter) ApplyChanges(changes []*Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	if err := w.e.Begin(fmt.Sprintf("apply %v change(s)", len(changes))); err != nil {
+		return err
+	}
+
+	for _, c := range changes {
+		stmts, err := changeStatements(c)
+		if err != nil {
+			w.e.Rollback()
+			return fmt.Errorf("sqlite: %v: %v", c, err)
+		}
+
+		for _, stmt := range stmts {
+			if err := w.e.Submit(stmt); err != nil {
+				return err
+			}
+		}
+	}
+
+	return w.e.Commit()
+}
+
+func changeStatements(c *Change) ([]string, error) {
+	stmts := make([]string, 0, 2)
+
+	/* only one row is deleted (picked by its rowid), for tables without
+	 * a primary key, which might have duplicate rows */
+	if c.Kind == ChangeDelete || c.KeyChanged() {
+		cond, err := RowCondition(c, c.Before, quote, RawToSqlite)
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, fmt.Sprintf("DELETE FROM %[1]v WHERE rowid IN (SELECT rowid FROM %[1]v WHERE %[2]v LIMIT 1);",
+			quote(c.DstName), cond))
+	}
+	if c.Kind == ChangeDelete {
+		return stmts, nil
+	}
+
+	lits, err := RowLiterals(c.Table, c.After, RawToSqlite)
+	if err != nil {
+		return nil, err
+	}
+
+	colnames := make([]string, 0, len(lits))
+	for _, col := range c.Table.Columns {
+		colnames = append(colnames, quote(col.Name))
+	}
+
+	return append(stmts, fmt.Sprintf("INSERT OR REPLACE INTO %v (%v) VALUES (%v);", quote(c.DstName),
+		strings.Join(colnames, ", "), strings.Join(lits, ", "))), nil
+}
+
+func (w *SqliteWriter) Close() error {
+	return w.e.Close()
+}
+
+func ColumnsSql(table *Table) string {
+	colSql := make([]string, 0, len(table.Columns))
+	pkCols := make([]string, 0, len(table.Columns))
+	for _, col := range table.Columns {
+		if col.PrimaryKey {
+			pkCols = append(pkCols, quote(col.Name))
+		}
+	}
+
+	/* a single auto-incrementing primary key becomes an alias of the rowid,
+	 * for which the declared type has to be exactly INTEGER */
+	rowid := len(pkCols) == 1
+
+	for _, col := range table.Columns {
+		if col.PrimaryKey && col.AutoIncr && rowid {
+			colSql = append(colSql, fmt.Sprintf("%v INTEGER PRIMARY KEY", quote(col.Name)))
+			continue
+		}
+
+		def := fmt.Sprintf("%v %v", quote(col.Name), GenericToSqliteType(col.Type))
+		if !col.Null {
+			def += " NOT NULL"
+		}
+		colSql = append(colSql, def)
+	}
+
+	if len(pkCols) > 0 && !(rowid && hasAutoIncrPk(table)) {
+		colSql = append(colSql, fmt.Sprintf("PRIMARY KEY (%v)",
+			strings.Join(pkCols, ", ")))
+	}
+
+	return strings.Join(colSql, ",\n\t")
+}
+
+func hasAutoIncrPk(table *Table) bool {
+	for _, col := range table.Columns {
+		if col.PrimaryKey && col.AutoIncr {
+			return true
+		}
+	}
+	return false
+}
+
+func quoteAll(names []string) string {
+	quoted := make([]string, 0, len(names))
+	for _, name := range names {
+		quoted = append(quoted, quote(name))
+	}
+	return strings.Join(quoted, ", ")
+}
+
+/* the rows of the temp table that are in the scope of the merge, the
+ * scope refers to them as dst like it does to the destination rows */
+func scopedRowsSql(tmpName, scope string) string {
+	if scope == "" {
+		return tmpName
+	}
+	return fmt.Sprintf("(SELECT * FROM %v AS dst WHERE %v)", tmpName, scope)
+}
+
+/* the scope of the merge as a condition on the destination row dst */
+func scopeSql(scope string) string {
+	if scope == "" {
+		return ""
+	}
+	return "\nAND    (" + scope + ")"
+}
@@ -0,0 +1,148 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	. "github.com/aktau/gomig/db/common"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/* the file the constraints of all tables go to, a table of that name is
+ * refused */
+const constraintsFile = "_constraints"
+
+/* the suffix of the files if none is given */
+const DefaultTableFileSuffix = ".sql"
+
+/* writes the statements of every table to a file of its own in a
+ * directory, <table><suffix>, so the tables can be loaded in parallel. The
+ * constraints (foreign keys) can reference other tables, so they're all
+ * written to _constraints<suffix>, which is loaded after the tables. A
+ * suffix that ends in .gz or .zst compresses the files (see
+ * OpenFileWriter). */
+type tableFilesWriter struct {
+	driver string
+	dir    string
+	suffix string
+	files  map[string]WriteCloser
+}
+
+func OpenTableFilesWriter(driverName string, dir string, suffix string) (WriteCloser, error) {
+	registryMu.Lock()
+	_, ok := fileWriters[driverName]
+	registryMu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("db: OpenTableFilesWriter: unknown driver type: %v", driverName)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if suffix == "" {
+		suffix = DefaultTableFileSuffix
+	}
+
+	return &tableFilesWriter{driverName, dir, suffix, make(map[string]WriteCloser)}, nil
+}
+
+/* the writer of the file of a table, opened when it's first written to */
+func (w *tableFilesWriter) table(name string) (WriteCloser, error) {
+	/* the name becomes a file name, so it can't reach outside the
+	 * directory */
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return nil, fmt.Errorf("db: table %q can't be written to a file of its own", name)
+	}
+	if name == constraintsFile {
+		return nil, fmt.Errorf("db: table %v can't be written to a file of its own, "+
+			"the constraints are written to %v%v", name, constraintsFile, w.suffix)
+	}
+	return w.file(name)
+}
+
+func (w *tableFilesWriter) file(name string) (WriteCloser, error) {
+	if f, ok := w.files[name]; ok {
+		return f, nil
+	}
+
+	f, err := OpenFileWriter(w.driver, filepath.Join(w.dir, name+w.suffix))
+	if err != nil {
+		return nil, err
+	}
+	w.files[name] = f
+	return f, nil
+}
+
+func (w *tableFilesWriter) CreateTable(src *Table, dstName string) error {
+	f, err := w.table(dstName)
+	if err != nil {
+		return err
+	}
+	return f.CreateTable(src, dstName)
+}
+
+func (w *tableFilesWriter) Truncate(dstName string) error {
+	f, err := w.table(dstName)
+	if err != nil {
+		return err
+	}
+	return f.Truncate(dstName)
+}
+
+func (w *tableFilesWriter) WriteTable(src *Table, dstName string, r Reader, c *Chunk) error {
+	f, err := w.table(dstName)
+	if err != nil {
+		return err
+	}
+	return f.WriteTable(src, dstName, r, c)
+}
+
+func (w *tableFilesWriter) MergeTable(src *Table, dstName string, opts *MergeOptions, r Reader, c *Chunk) (*MergeStats, error) {
+	f, err := w.table(dstName)
+	if err != nil {
+		return nil, err
+	}
+	return f.MergeTable(src, dstName, opts, r, c)
+}
+
+func (w *tableFilesWriter) EvolveTable(src, dst *Table, dstName string, drop bool) (*SchemaDiff, error) {
+	f, err := w.table(dstName)
+	if err != nil {
+		return nil, err
+	}
+	return f.EvolveTable(src, dst, dstName, drop)
+}
+
+func (w *tableFilesWriter) CreateIndices(src *Table, dstName string) error {
+	f, err := w.table(dstName)
+	if err != nil {
+		return err
+	}
+	return f.CreateIndices(src, dstName)
+}
+
+func (w *tableFilesWriter) CreateConstraints(src *Table, dstName string) error {
+	f, err := w.file(constraintsFile)
+	if err != nil {
+		return err
+	}
+	return f.CreateConstraints(src, dstName)
+}
+
+/* a batch of changes can span tables, and has to be applied as a whole */
+func (w *tableFilesWriter) ApplyChanges(changes []*Change) error {
+	return errors.New("db: changes can't be written to a file per table")
+}
+
+func (w *tableFilesWriter) Close() error {
+	var err error
+	for _, f := range w.files {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
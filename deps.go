@@ -5,9 +5,9 @@ import (
 	"sort"
 )
 
-/* this file deals with trying to migrate tables in the right order, which
- * is very primitive for now. I generally like Go, but the sort interface
- * is... convoluted. */
+/* this file deals with trying to migrate tables in the right order, first
+ * by the order the user asked for and then by the foreign keys between
+ * them. I generally like Go, but the sort interface is... convoluted. */
 
 /* By is the type of a "less" function that defines the ordering of its
  * Table arguments. */
@@ -62,3 +62,153 @@ func OrderTableByNamesList(src []*common.Table, names []string) {
 
 	By(sorter).Sort(src)
 }
+
+/* Sort the src list of tables in such a way that every table comes after
+ * the tables it references through its foreign keys, so they can be loaded
+ * while the constraints are in place. Among the tables that are ready to be
+ * loaded, the current order of src is kept, so an ordering applied earlier
+ * (like the one of OrderTableByNamesList) is respected where possible.
+ * References to tables that are not in src and references of a table to
+ * itself are ignored.
+ *
+ * Tables that are part of a reference cycle can't be ordered, when no
+ * other table is ready the first table of a cycle is taken regardless of
+ * its references, which breaks the cycle. The cycles are returned, as
+ * lists of table names. */
+func OrderTablesByDependencies(src []*common.Table) [][]string {
+	if len(src) == 0 {
+		return nil
+	}
+
+	index := make(map[string]int)
+	for idx, table := range src {
+		index[table.Name] = idx
+	}
+
+	/* deps[i] lists the tables that table i references, dependents[i]
+	 * lists the tables that reference table i */
+	deps := make([][]int, len(src))
+	dependents := make([][]int, len(src))
+	pending := make([]int, len(src))
+	for idx, table := range src {
+		for _, name := range table.Dependencies() {
+			dep, ok := index[name]
+			if !ok || dep == idx {
+				continue
+			}
+			deps[idx] = append(deps[idx], dep)
+			dependents[dep] = append(dependents[dep], idx)
+			pending[idx]++
+		}
+	}
+
+	/* Kahn's algorithm, always picking the ready table that came first */
+	var (
+		cycles  [][]string
+		inCycle map[int]bool
+	)
+	done := make([]bool, len(src))
+	ordered := make([]*common.Table, 0, len(src))
+	for len(ordered) < len(src) {
+		next := -1
+		for idx := range src {
+			if !done[idx] && pending[idx] == 0 {
+				next = idx
+				break
+			}
+		}
+
+		/* only cycles (and the tables depending on them) are left */
+		if next == -1 {
+			if inCycle == nil {
+				cycles, inCycle = findCycles(src, deps, done)
+			}
+			for idx := range src {
+				if !done[idx] && inCycle[idx] {
+					next = idx
+					break
+				}
+			}
+		}
+
+		done[next] = true
+		ordered = append(ordered, src[next])
+		for _, dependent := range dependents[next] {
+			pending[dependent]--
+		}
+	}
+
+	copy(src, ordered)
+	return cycles
+}
+
+/* finds the strongly connected components (Tarjan) with more than one
+ * table among the tables that are not done yet, which are the reference
+ * cycles. Returns both the names of the tables in each cycle and the set
+ * of indices of all tables that are part of one. */
+func findCycles(src []*common.Table, deps [][]int, done []bool) ([][]string, map[int]bool) {
+	var (
+		counter int
+		stack   []int
+		cycles  [][]string
+	)
+	inCycle := make(map[int]bool)
+	order := make([]int, len(src))
+	lowlink := make([]int, len(src))
+	onStack := make([]bool, len(src))
+
+	var visit func(v int)
+	visit = func(v int) {
+		counter++
+		order[v], lowlink[v] = counter, counter
+		stack = append(stack, v)
+		onStack[v] = true
+
+		for _, w := range deps[v] {
+			if done[w] {
+				continue
+			}
+			if order[w] == 0 {
+				visit(w)
+				if lowlink[w] < lowlink[v] {
+					lowlink[v] = lowlink[w]
+				}
+			} else if onStack[w] && order[w] < lowlink[v] {
+				lowlink[v] = order[w]
+			}
+		}
+
+		if lowlink[v] != order[v] {
+			return
+		}
+
+		var component []int
+		for {
+			w := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[w] = false
+			component = append(component, w)
+			if w == v {
+				break
+			}
+		}
+
+		if len(component) > 1 {
+			sort.Ints(component)
+			names := make([]string, 0, len(component))
+			for _, idx := range component {
+				names = append(names, src[idx].Name)
+				inCycle[idx] = true
+			}
+			cycles = append(cycles, names)
+		}
+	}
+
+	for v := range src {
+		if !done[v] && order[v] == 0 {
+			visit(v)
+		}
+	}
+
+	return cycles, inCycle
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aktau/gomig/db"
+	"github.com/aktau/gomig/db/common"
+)
+
+type DiffCommand struct {
+	/* config file */
+	File string `short:"f" long:"file" description:"The path of the configuration file to use" default:"config.yml"`
+
+	Table     string `long:"table" description:"The (source) table to compare" required:"true"`
+	Format    string `long:"format" description:"How to output the rows that differ, csv or json" default:"csv"`
+	ChunkSize int    `long:"chunk-size" description:"The number of rows to compare at a time, overrides chunk_size of the config file"`
+}
+
+/* how a row differs */
+const (
+	rowMissing = "missing"
+	rowExtra   = "extra"
+	rowChanged = "changed"
+)
+
+/* a row that differs between the source and the destination, src and dst
+ * have a value for every column of the table (or are nil if the row isn't
+ * there) */
+type rowDiff struct {
+	change   string
+	key      []interface{}
+	src, dst []interface{}
+}
+
+/* outputs the rows that differ */
+type diffWriter interface {
+	Write(d *rowDiff) error
+	Flush() error
+}
+
+/* outputs the rows that differ between a table of the source and the
+ * destination. The values are scanned to their Go types before they're
+ * compared, so they are compared by meaning rather than by how a database
+ * happens to spell them. */
+func (x *DiffCommand) Execute(args []string) error {
+	verbosity := len(options.Verbose)
+
+	conf := LoadConfigOrDie(x.File)
+	if conf.Destination.IsFile() {
+		return fmt.Errorf("gomig: a destination file can't be compared")
+	}
+
+	size := verifyChunkSizeDefault
+	switch {
+	case x.ChunkSize > 0:
+		size = x.ChunkSize
+	case conf.ChunkSize > 0:
+		size = conf.ChunkSize
+	}
+
+	srcDriver, srcConf := conf.SourceDatabase()
+	if verbosity > 0 {
+		log.Println("gomig: connecting to source", srcDriver, srcConf)
+	}
+	reader, err := db.OpenReader(srcDriver, srcConf)
+	if err != nil {
+		return fmt.Errorf("gomig: error while creating reader, %v", err)
+	}
+	defer reader.Close()
+
+	if verbosity > 0 {
+		log.Println("gomig: connecting to destination", conf.Destination)
+	}
+	dstReader, err := db.OpenReader(conf.Destination.Database())
+	if err != nil {
+		return fmt.Errorf("gomig: error while reading the destination, %v", err)
+	}
+	defer dstReader.Close()
+
+	tempViews := createTempEntities(reader, conf.Views, conf.Projections)
+	defer tempViews.Erase()
+
+	tables := reader.FilteredTables(map[string]bool{x.Table: true}, nil)
+	if len(tables) == 0 {
+		return fmt.Errorf("gomig: table %v is not in the source", x.Table)
+	}
+	src := tables[0]
+
+	key := conf.Tables[src.Name].MergeKey
+	if len(key) == 0 {
+		key = src.MergeKey()
+	}
+	if len(key) == 0 {
+		return fmt.Errorf("gomig: table %v has no key to compare the rows on, set its merge_key", src.Name)
+	}
+	if src, err = src.WithKey(key); err != nil {
+		return fmt.Errorf("gomig: %v", err)
+	}
+
+	dstName := strmap(src.Name, conf.TableMap)
+	var dst *common.Table
+	if found := dstReader.FilteredTables(map[string]bool{dstName: true}, nil); len(found) > 0 {
+		dst = found[0]
+	}
+	dst, err = destinationTable(src, dst, key, conf)
+	if err != nil {
+		return fmt.Errorf("gomig: %v", err)
+	}
+	if dst == nil {
+		return fmt.Errorf("gomig: table %v is not in the destination", dstName)
+	}
+
+	var out diffWriter
+	switch x.Format {
+	case "csv":
+		out, err = newCsvDiffWriter(os.Stdout, src, key)
+	case "json":
+		out = newJsonDiffWriter(os.Stdout, src, key)
+	default:
+		err = fmt.Errorf("unknown format %q, use csv or json", x.Format)
+	}
+	if err != nil {
+		return fmt.Errorf("gomig: %v", err)
+	}
+
+	differ, err := diffTable(reader, dstReader, src, dst, key, size, out)
+	if err != nil {
+		return fmt.Errorf("gomig: could not compare table %v, %v", src.Name, err)
+	}
+	if err := out.Flush(); err != nil {
+		return fmt.Errorf("gomig: could not write the differences, %v", err)
+	}
+
+	if differ > 0 {
+		return fmt.Errorf("gomig: table %v differs in %v rows", src.Name, differ)
+	}
+	log.Println("gomig: done, table", src.Name, "matches")
+	return nil
+}
+
+/* compares src and dst chunk by chunk: the rows of a chunk of the source
+ * are kept in memory while the rows of the same chunk of the destination
+ * are read. Returns the number of rows that differ. */
+func diffTable(r, dr common.Reader, src, dst *common.Table, key []string, size int, out diffWriter) (int64, error) {
+	chunks, err := r.Chunks(src, size)
+	if err != nil {
+		log.Println("gomig: could not split table", src.Name,
+			"into chunks, comparing it whole, error:", err)
+	}
+	if len(chunks) == 0 {
+		chunks = []*common.Chunk{nil}
+	}
+
+	keyIdx := make([]int, 0, len(key))
+	for _, name := range key {
+		for i, col := range src.Columns {
+			if col.Name == name {
+				keyIdx = append(keyIdx, i)
+			}
+		}
+	}
+	keyOf := func(vals []interface{}) ([]interface{}, string) {
+		kv := make([]interface{}, 0, len(keyIdx))
+		parts := make([]string, 0, len(keyIdx))
+		for _, i := range keyIdx {
+			kv = append(kv, vals[i])
+			parts = append(parts, fmt.Sprint(vals[i]))
+		}
+		return kv, strings.Join(parts, "\x00")
+	}
+
+	var differ int64
+	for _, c := range chunks {
+		srcRows, err := readComparable(r, src, src, c)
+		if err != nil {
+			return differ, fmt.Errorf("source: %v", err)
+		}
+
+		/* the rows of the source that are left over are missing from the
+		 * destination, they're output in the order they were read */
+		pending := make(map[string][]interface{}, len(srcRows))
+		for _, vals := range srcRows {
+			_, k := keyOf(vals)
+			pending[k] = vals
+		}
+
+		dstRows, err := readComparable(dr, dst, src, c)
+		if err != nil {
+			return differ, fmt.Errorf("destination: %v", err)
+		}
+		for _, vals := range dstRows {
+			kv, k := keyOf(vals)
+			srcVals, ok := pending[k]
+			if !ok {
+				differ++
+				if err := out.Write(&rowDiff{change: rowExtra, key: kv, dst: vals}); err != nil {
+					return differ, err
+				}
+				continue
+			}
+			delete(pending, k)
+
+			if !equalRows(srcVals, vals) {
+				differ++
+				if err := out.Write(&rowDiff{change: rowChanged, key: kv, src: srcVals, dst: vals}); err != nil {
+					return differ, err
+				}
+			}
+		}
+
+		for _, vals := range srcRows {
+			kv, k := keyOf(vals)
+			if _, ok := pending[k]; !ok {
+				continue
+			}
+			differ++
+			if err := out.Write(&rowDiff{change: rowMissing, key: kv, src: vals}); err != nil {
+				return differ, err
+			}
+		}
+	}
+
+	return differ, nil
+}
+
+/* reads the rows of table (in chunk c), with the columns of src */
+func readComparable(r common.Reader, table, src *common.Table, c *common.Chunk) ([][]interface{}, error) {
+	rows, err := common.ReadRows(r, table, c)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scanner, err := common.NewRowScanner(rows, src)
+	if err != nil {
+		return nil, err
+	}
+
+	var all [][]interface{}
+	for rows.Next() {
+		vals, err := scanner.Scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, vals)
+	}
+
+	return all, rows.Err()
+}
+
+func equalRows(a, b []interface{}) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+/* one line per column that differs: the change, the key, the column and
+ * its value in the source and in the destination. The rows that are
+ * missing or extra have a line for every column, with the value of the
+ * side that doesn't have the row left empty. NULL is written as \N. */
+type csvDiffWriter struct {
+	w     *csv.Writer
+	table *common.Table
+}
+
+func newCsvDiffWriter(w io.Writer, table *common.Table, key []string) (*csvDiffWriter, error) {
+	cw := &csvDiffWriter{csv.NewWriter(w), table}
+
+	header := append([]string{"change"}, key...)
+	header = append(header, "column", "source", "destination")
+	return cw, cw.w.Write(header)
+}
+
+func (c *csvDiffWriter) Write(d *rowDiff) error {
+	for i, col := range c.table.Columns {
+		var srcVal, dstVal string
+		switch {
+		case d.src != nil && d.dst != nil:
+			if d.src[i] == d.dst[i] {
+				continue
+			}
+			srcVal, dstVal = csvValue(d.src[i]), csvValue(d.dst[i])
+		case d.src != nil:
+			srcVal = csvValue(d.src[i])
+		default:
+			dstVal = csvValue(d.dst[i])
+		}
+
+		record := []string{d.change}
+		for _, v := range d.key {
+			record = append(record, csvValue(v))
+		}
+		record = append(record, col.Name, srcVal, dstVal)
+		if err := c.w.Write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *csvDiffWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func csvValue(v interface{}) string {
+	if v == nil {
+		return `\N`
+	}
+	return fmt.Sprint(v)
+}
+
+/* one JSON object per line. A missing row has its values under "source",
+ * an extra one under "destination" and a changed one has the columns that
+ * differ under "columns", each with its "source" and "destination" value. */
+type jsonDiffWriter struct {
+	enc   *json.Encoder
+	table *common.Table
+	key   []string
+}
+
+func newJsonDiffWriter(w io.Writer, table *common.Table, key []string) *jsonDiffWriter {
+	return &jsonDiffWriter{json.NewEncoder(w), table, key}
+}
+
+type jsonColumnDiff struct {
+	Source      interface{} `json:"source"`
+	Destination interface{} `json:"destination"`
+}
+
+type jsonRowDiff struct {
+	Change      string                    `json:"change"`
+	Key         map[string]interface{}    `json:"key"`
+	Source      map[string]interface{}    `json:"source,omitempty"`
+	Destination map[string]interface{}    `json:"destination,omitempty"`
+	Columns     map[string]jsonColumnDiff `json:"columns,omitempty"`
+}
+
+func (j *jsonDiffWriter) Write(d *rowDiff) error {
+	row := jsonRowDiff{Change: d.change, Key: make(map[string]interface{}, len(j.key))}
+	for i, name := range j.key {
+		row.Key[name] = d.key[i]
+	}
+
+	switch {
+	case d.src != nil && d.dst != nil:
+		row.Columns = make(map[string]jsonColumnDiff)
+		for i, col := range j.table.Columns {
+			if d.src[i] != d.dst[i] {
+				row.Columns[col.Name] = jsonColumnDiff{d.src[i], d.dst[i]}
+			}
+		}
+	case d.src != nil:
+		row.Source = j.values(d.src)
+	default:
+		row.Destination = j.values(d.dst)
+	}
+
+	return j.enc.Encode(&row)
+}
+
+func (j *jsonDiffWriter) values(vals []interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(vals))
+	for i, col := range j.table.Columns {
+		m[col.Name] = vals[i]
+	}
+	return m
+}
+
+func (j *jsonDiffWriter) Flush() error {
+	return nil
+}
+
+func init() {
+	var cmd DiffCommand
+	parser.AddCommand("diff",
+		"Output the rows of a table that differ between the source and destination",
+		"Compare a table of the source and destination row by row, and output the rows that are missing from the destination, the extra ones and the columns that changed, as CSV or JSON",
+		&cmd)
+}
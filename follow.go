@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aktau/gomig/db"
+	"github.com/aktau/gomig/db/common"
+	"github.com/aktau/gomig/db/mysql"
+	"github.com/aktau/gomig/db/mysql/binlog"
+)
+
+/* how often the binlog position is saved while none of the followed tables
+ * change, the position is always saved after applying changes */
+const followSaveInterval = 10 * time.Second
+
+type FollowCommand struct {
+	/* config file */
+	File string `short:"f" long:"file" description:"The path of the configuration file to use" default:"config.yml"`
+
+	ServerId uint32 `long:"server-id" description:"The server id to register with as a replica, it has to differ from the ids of the source and its other replicas" default:"4242"`
+
+	BinlogFile string `long:"binlog-file" description:"Apply the changes in a binlog file instead of streaming them from the source"`
+
+	NoSnapshot bool `long:"no-snapshot" description:"Don't migrate the tables before following the source, the destination is expected to be up to date"`
+}
+
+/* what a MySQL source can tell about its binlog */
+type binlogSource interface {
+	BinlogPosition() (binlog.Position, error)
+	TimeZone() (*time.Location, error)
+}
+
+/* follows the changes of the source through its binlog and applies them to
+ * the destination. The first time, the tables are migrated first, after
+ * noting the binlog position. Changes made during that migration are
+ * applied again afterwards, which does no harm. */
+func (x *FollowCommand) Execute(args []string) error {
+	verbosity := len(options.Verbose)
+
+	conf := LoadConfigOrDie(x.File)
+	if conf.Destination.IsFile() {
+		return fmt.Errorf("gomig: following the source needs a destination database, not a file")
+	}
+
+	srcDriver, srcConf := conf.SourceDatabase()
+	if verbosity > 0 {
+		log.Println("gomig: connecting to source", srcDriver, srcConf)
+	}
+	reader, err := db.OpenReader(srcDriver, srcConf)
+	if err != nil {
+		return fmt.Errorf("gomig: error while creating reader, %v", err)
+	}
+	defer reader.Close()
+
+	/* the binlog of a file can be applied to the tables of any source
+	 * with the same schema, the server itself can only be followed if
+	 * it's MySQL */
+	source, isMysql := reader.(binlogSource)
+	if !isMysql && x.BinlogFile == "" {
+		return fmt.Errorf("gomig: only a mysql source can be followed, or a binlog file applied")
+	}
+
+	if verbosity > 0 {
+		log.Println("gomig: connecting to destination", conf.Destination)
+	}
+	writer, err := db.OpenWriter(conf.Destination.Database())
+	if err != nil {
+		return fmt.Errorf("gomig: error while creating writer: %v", err)
+	}
+	defer writer.Close()
+
+	st, err := readState(conf.StatePath())
+	switch {
+	case err == nil && st.BinlogPosition() != nil:
+	case err == nil || os.IsNotExist(err):
+		if st, err = x.snapshot(reader, writer, source, conf, verbosity); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("gomig: error while opening state file, %v", err)
+	}
+	pos := *st.BinlogPosition()
+	log.Println("gomig: following from binlog position", pos)
+
+	p := binlog.NewParser()
+	f := newFollower(reader, writer, st, conf, isMysql)
+	p.Columns = f.columns
+	if isMysql {
+		if p.Location, err = source.TimeZone(); err != nil {
+			return fmt.Errorf("gomig: could not determine the time zone of the source: %v", err)
+		}
+	}
+
+	var s binlog.Streamer
+	if x.BinlogFile != "" {
+		if pos.File != filepath.Base(x.BinlogFile) {
+			pos = binlog.Position{File: filepath.Base(x.BinlogFile)}
+		}
+		s, err = binlog.OpenFile(x.BinlogFile, pos.Pos, p)
+	} else {
+		s, err = binlog.Dial(mysql.ReplicationConfig(srcConf, x.ServerId), pos, p)
+	}
+	if err != nil {
+		return fmt.Errorf("gomig: could not read the binlog: %v", err)
+	}
+	defer s.Close()
+
+	if err := f.follow(s); err != nil {
+		return fmt.Errorf("gomig: stopped following, %v", err)
+	}
+	log.Println("gomig: done")
+	return nil
+}
+
+/* migrates the tables and records the binlog position it corresponds to,
+ * which is taken before the migration so no changes are missed */
+func (x *FollowCommand) snapshot(r common.ReadCloser, w common.WriteCloser, source binlogSource, conf *Config, verbosity int) (*State, error) {
+	var pos binlog.Position
+	if x.BinlogFile != "" {
+		pos.File = filepath.Base(x.BinlogFile)
+	} else {
+		var err error
+		if pos, err = source.BinlogPosition(); err != nil {
+			return nil, fmt.Errorf("gomig: could not determine the binlog position of the source: %v", err)
+		}
+	}
+
+	/* the position of an earlier follow is only recorded again once the
+	 * snapshot is complete, an interrupted one has to be redone */
+	st := NewState(conf.StatePath(), conf)
+	st.Binlog = nil
+	st.Save()
+
+	if !x.NoSnapshot {
+		log.Println("gomig: migrating the tables before following the source")
+		if err := Convert(r, w, connector(conf), st, conf, verbosity); err != nil {
+			return nil, fmt.Errorf("gomig: could not complete the snapshot, error: %v", err)
+		}
+	}
+
+	st.SetBinlogPosition(pos)
+	return st, nil
+}
+
+type follower struct {
+	w  common.Writer
+	st *State
+
+	/* the followed tables, by source name */
+	tables   map[string]*common.Table
+	tableMap map[string]string
+
+	/* the schema of the source, the binlog has the changes of all of
+	 * them. Empty if the source isn't the server the binlog is from. */
+	schema string
+}
+
+func newFollower(r common.Reader, w common.Writer, st *State, conf *Config, isMysql bool) *follower {
+	f := &follower{
+		w:        w,
+		st:       st,
+		tables:   make(map[string]*common.Table),
+		tableMap: conf.TableMap,
+	}
+	if isMysql {
+		f.schema = conf.Source.Database
+	}
+
+	/* views and projections don't show up in the binlog */
+	for _, table := range r.FilteredTables(conf.OnlyTables, conf.ExcludeTables) {
+		f.tables[table.Name] = table
+	}
+
+	return f
+}
+
+/* tells the parser which tables are followed, and about their columns */
+func (f *follower) columns(schema, name string) ([]binlog.ColumnInfo, bool) {
+	if f.schema != "" && schema != f.schema {
+		return nil, false
+	}
+	table, ok := f.tables[name]
+	if !ok {
+		return nil, false
+	}
+
+	info := make([]binlog.ColumnInfo, 0, len(table.Columns))
+	for _, col := range table.Columns {
+		info = append(info, binlog.ParseColumnType(col.RawType))
+	}
+	return info, true
+}
+
+/* applies the changes of every transaction once it's committed, until the
+ * end of the binlog file (a server is followed until an error occurs) */
+func (f *follower) follow(s binlog.Streamer) error {
+	changes := make([]*common.Change, 0, 16)
+	saved := time.Now()
+
+	/* the position after the last transaction, if it hasn't been saved */
+	var unsaved *binlog.Position
+
+	for {
+		ev, err := s.Next()
+		if err == io.EOF {
+			if unsaved != nil {
+				f.st.SetBinlogPosition(*unsaved)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case ev.Rows != nil:
+			rowChanges, err := f.changes(ev.Rows)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, rowChanges...)
+		case ev.Commit, ev.Query == "COMMIT":
+			/* changes to non-transactional tables end in a COMMIT
+			 * query instead */
+			if len(changes) > 0 {
+				if err := f.w.ApplyChanges(changes); err != nil {
+					return fmt.Errorf("could not apply the transaction ending at %v: %v", ev.Position, err)
+				}
+				if VERBOSE {
+					log.Printf("converter: applied %v change(s), at binlog position %v\n", len(changes), ev.Position)
+				}
+			}
+			if len(changes) > 0 || time.Since(saved) > followSaveInterval {
+				f.st.SetBinlogPosition(ev.Position)
+				saved, unsaved = time.Now(), nil
+			} else {
+				pos := ev.Position
+				unsaved = &pos
+			}
+			changes = changes[:0]
+		case ev.Query != "" && ev.Query != "BEGIN":
+			log.Println("converter: schema changes are not followed, ignoring:", ev.Query)
+		}
+	}
+}
+
+func (f *follower) changes(ev *binlog.RowsEvent) ([]*common.Change, error) {
+	if ev.Rows == nil {
+		return nil, nil
+	}
+
+	table := f.tables[ev.Table.Table]
+	if len(ev.Table.Types) != len(table.Columns) {
+		return nil, fmt.Errorf("the binlog has %v columns for table %v instead of %v, "+
+			"it has to be migrated again", len(ev.Table.Types), table.Name, len(table.Columns))
+	}
+
+	var kind common.ChangeKind
+	switch ev.Kind {
+	case binlog.RowsInsert:
+		kind = common.ChangeInsert
+	case binlog.RowsUpdate:
+		kind = common.ChangeUpdate
+	default:
+		kind = common.ChangeDelete
+	}
+
+	changes := make([]*common.Change, 0, len(ev.Rows))
+	for _, row := range ev.Rows {
+		changes = append(changes, &common.Change{
+			Kind:    kind,
+			Table:   table,
+			DstName: strmap(table.Name, f.tableMap),
+			Before:  row.Before,
+			After:   row.After,
+		})
+	}
+	return changes, nil
+}
+
+func init() {
+	var cmd FollowCommand
+	parser.AddCommand("follow",
+		"Apply the changes of a MySQL source to the destination as they happen",
+		"Migrate the tables once, then follow the binlog of the MySQL source and apply its inserts, updates and deletes to the destination, the binlog position is kept in the state file so following can be resumed",
+		&cmd)
+}
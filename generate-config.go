@@ -7,34 +7,68 @@ import (
 
 const CONFIG_SAMPLE = `# edit this file and run the application when you're done
 
-# if a socket is specified we will use that
-# if tcp is chosen you can use compression
-mysql:
+# the source database, the driver can be any of the backends listed by
+# "gomig version" (mysql, postgres, sqlite). If a socket is specified we
+# will use that. Anything driver-specific can be passed through the
+# options map.
+source:
+ driver: mysql
  hostname: 127.0.0.1
  port: 3306
  # socket: /tmp/mysql.sock
  username: someuser
  password: somepass
  database: somedb
- compress: false
-
-# if file is given, output goes to file, if postgres parameters
-# are given, output is executed straight on the db, socket is
-# prioritized if specified.
+ # options:
+ #   charset: utf8mb4
+
+# for a postgres source, views and projections are created as temporary
+# views/tables, the engine of a projection is ignored. For sqlite, the
+# database is the path of the database file.
+#source:
+# driver: sqlite
+# database: fixtures.db
+
+# if file is given, output goes to file (in the SQL dialect of the driver,
+# postgres if not given), otherwise output is executed straight on the db,
+# socket is prioritized if specified. A file named - is the standard
+# output, one ending in .gz or .zst is compressed with gzip or zstd.
+# file_per_table writes every table to <dir>/<table>.sql instead (and the
+# foreign keys to <dir>/_constraints.sql, to load last), so the tables can
+# be loaded in parallel. file_suffix replaces the .sql, e.g. with .sql.gz
+# to compress the files.
 destination:
  # file: test.sql
- postgres:
-   hostname: localhost
-   port: 5432
-   socket: /var/run/postgresql
-   username:
-   password:
-   database: somedb
+ # file_per_table: dump/
+ # file_suffix: .sql.gz
+ driver: postgres
+ hostname: localhost
+ port: 5432
+ socket: /var/run/postgresql
+ username:
+ password:
+ database: somedb
+ # options:
+ #   sslmode: disable
+
+# the py-mysql2pgsql layout, with the connection parameters in sections
+# named after the driver, is still supported:
+#mysql:
+# hostname: 127.0.0.1
+# ...
+#destination:
+# postgres:
+#   hostname: localhost
+#   ...
 
 # projections can help you align data between the source and
 # destination databases, it's basically like a view (and used to be
 # implemented as one). It will create a table that only lasts as long as the
-# session.
+# session. If the projection only corresponds to a part of the destination
+# table, destination_conditions limits a merge to that part: only the rows
+# that satisfy it are inserted, and only the destination rows that satisfy
+# it are updated or deleted (and checked by verify). It's an SQL condition
+# in the dialect of the destination, on the row aliased dst.
 projections:
     pr_players:
      engine: MEMORY
@@ -44,6 +78,7 @@ projections:
          FROM Player
          WHERE hostname LIKE '%.new.client'
          AND name IS NOT NULL
+     destination_conditions: dst.hostname LIKE '%.new.client'
 
 
 # table "a" in the source database has been renamed to table "b"
@@ -51,6 +86,32 @@ projections:
 table_map:
  pr_players: players
 
+# per table options. When merging, a table can be synced incrementally:
+# only the rows whose column is at or beyond the value it had at the end of
+# the last sync are merged. The watermarks are kept in the state file.
+# With delete_missing, the destination rows whose primary key is no longer
+# in the source are deleted (only those that match the
+# destination_conditions of a projection). With soft_delete they are kept,
+# but the column is set to the value (an SQL expression) instead.
+# Rows are merged on the primary key, or on a unique key without NULLs if
+# there is none. merge_key names the columns to merge on instead, they
+# shouldn't contain NULLs either. Except with the legacy and merge
+# strategies of postgres, the merge relies on a unique index on them in
+# the destination. Without one, postgres falls back to one of those, and
+# mysql to separate UPDATE and INSERT statements.
+#tables:
+# Player:
+#   incremental:
+#     column: updated_at
+# Score:
+#   merge_key: [player_id, match_id]
+# Team:
+#   delete_missing: true
+# Match:
+#   soft_delete:
+#     column: deleted
+#     value: true
+
 # which tables (projections defined in this file included) should be
 # synced? If not defined, all tables are synced
 only_tables:
@@ -61,10 +122,31 @@ only_tables:
 #- table3
 #- table4
 
-# the following fiels are not implemented yet, they are inherited from
-# py-mysql2pgsql, leave them as-is.
+# if merge is true, the destination tables have to exist already and the
+# source rows are merged into them (UPDATE existing rows, INSERT new ones).
+# If false, the destination tables are dropped, recreated and loaded, after
+# which the indices and constraints are added.
 merge: true
 
+# how a postgres destination merges the rows: "legacy" (LOCK TABLE, UPDATE
+# and INSERT, works on any version), "upsert" (INSERT ... ON CONFLICT, needs
+# 9.5), "merge" (MERGE, needs 15) or "auto", which picks the best one the
+# server supports. upsert needs a unique index on the merge key, a table
+# without one is merged with merge or legacy instead. A file destination
+# uses legacy unless told otherwise.
+#merge_strategy: auto
+
+# tables without a key to merge on (see merge_key) can't be merged, if
+# reload_without_key is true they're truncated and loaded again instead.
+# Otherwise merging fails.
+reload_without_key: false
+
+# when merging, auto_evolve adds the columns the source tables gained to the
+# destination tables (and the tables it lacks), and changes the columns
+# whose type or nullability differ. Columns the source lost are left alone.
+# "gomig schema-diff" shows what would change.
+auto_evolve: false
+
 # if supress_data is true, only the schema definition will be exported/migrated, and not the data
 supress_data: false
 
@@ -76,6 +158,23 @@ force_truncate: false
 
 # if timezone is true, forces to append/convert to UTC tzinfo mysql data
 timezone: false
+
+# how many tables are migrated at the same time, each on its own source and
+# destination connection. Tables are still migrated after the tables they
+# reference where that matters. Can be overridden with "migrate --jobs".
+# Ignored when the destination is a file or an sqlite database.
+parallelism: 1
+
+# tables with an integer or composite primary key can be transferred in
+# chunks of (at most) this many rows, each in its own transaction, which
+# spares the source database a single query that runs for hours. Chunks of
+# the same table can be transferred in parallel. 0 transfers whole tables.
+chunk_size: 0
+
+# the progress of a migration to a database is recorded in this file, so
+# "migrate --resume" can continue an interrupted migration where it left off
+# (with the same chunks). A migration without --resume starts over.
+state_file: gomig-state.json
 `
 
 type GenerateConfigCommand struct {
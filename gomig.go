@@ -3,6 +3,11 @@ package main
 import (
 	"github.com/jessevdk/go-flags"
 	"os"
+
+	/* the backends register themselves with the db package */
+	_ "github.com/aktau/gomig/db/mysql"
+	_ "github.com/aktau/gomig/db/postgres"
+	_ "github.com/aktau/gomig/db/sqlite"
 )
 
 type Options struct {
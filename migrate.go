@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
 
 	"github.com/aktau/gomig/db"
 	"github.com/aktau/gomig/db/common"
@@ -15,6 +16,11 @@ const (
 type MigrateCommand struct {
 	/* config file */
 	File string `short:"f" long:"file" description:"The path of the configuration file to use" default:"config.yml"`
+
+	/* overrides the parallelism option of the config file */
+	Jobs int `short:"j" long:"jobs" description:"The number of tables to migrate at the same time"`
+
+	Resume bool `short:"r" long:"resume" description:"Continue an interrupted migration, skipping the work it completed"`
 }
 
 func (x *MigrateCommand) Execute(args []string) error {
@@ -22,16 +28,32 @@ func (x *MigrateCommand) Execute(args []string) error {
 
 	conf := LoadConfigOrDie(x.File)
 
+	/* a file is written from scratch every time, so there is nothing to
+	 * resume there */
+	var st *State
+	if conf.Destination.IsFile() {
+		if x.Resume {
+			return fmt.Errorf("gomig: a migration to a file can't be resumed")
+		}
+	} else {
+		var err error
+		st, err = x.openState(conf)
+		if err != nil {
+			return fmt.Errorf("gomig: error while opening state file, %v", err)
+		}
+	}
+
 	if verbosity > 2 {
-		fmt.Println("config:", conf)
+		log.Println("config:", conf)
 	}
 
 	/* open source */
+	srcDriver, srcConf := conf.SourceDatabase()
 	if verbosity > 0 {
-		log.Println("gomig: connecting to source", conf.Mysql)
+		log.Println("gomig: connecting to source", srcDriver, srcConf)
 	}
 
-	reader, err := db.OpenReader("mysql", conf.Mysql)
+	reader, err := db.OpenReader(srcDriver, srcConf)
 	if err != nil {
 		return fmt.Errorf("gomig: error while creating reader, %v", err)
 	}
@@ -47,10 +69,14 @@ func (x *MigrateCommand) Execute(args []string) error {
 	}
 
 	var writer common.WriteCloser
-	if conf.Destination.File != "" {
-		writer, err = db.OpenFileWriter("postgres", conf.Destination.File)
-	} else {
-		writer, err = db.OpenWriter("postgres", conf.Destination.Postgres)
+	switch {
+	case conf.Destination.FilePerTable != "":
+		writer, err = db.OpenTableFilesWriter(conf.Destination.FileDriver(),
+			conf.Destination.FilePerTable, conf.Destination.FileSuffix)
+	case conf.Destination.File != "":
+		writer, err = db.OpenFileWriter(conf.Destination.FileDriver(), conf.Destination.File)
+	default:
+		writer, err = db.OpenWriter(conf.Destination.Database())
 	}
 	if err != nil {
 		return fmt.Errorf("gomig: error while creating writer: %v", err)
@@ -61,16 +87,71 @@ func (x *MigrateCommand) Execute(args []string) error {
 		log.Println("gomig: succesfully connected to destination")
 	}
 
+	if x.Jobs > 0 {
+		conf.Parallelism = x.Jobs
+	}
+
+	open := connector(conf)
+
 	log.Println("gomig: converting")
-	err = Convert(reader, writer, conf, verbosity)
-	if err != nil {
-		fmt.Println("gomig: could not complete conversion, error:", err)
-	} else {
-		log.Println("gomig: done")
+	if err := Convert(reader, writer, open, st, conf, verbosity); err != nil {
+		return fmt.Errorf("gomig: could not complete conversion, %v", err)
 	}
+	log.Println("gomig: done")
 	return nil
 }
 
+/* a fresh migration starts with an empty state, which overwrites the state
+ * of any earlier migration */
+func (x *MigrateCommand) openState(conf *Config) (*State, error) {
+	path := conf.StatePath()
+
+	if x.Resume {
+		st, err := LoadState(path, conf)
+		switch {
+		case err == nil:
+			log.Println("gomig: resuming the migration started at", st.Started)
+			return st, nil
+		case os.IsNotExist(err):
+			log.Println("gomig: no state file found at", path, "starting from scratch")
+		default:
+			return nil, err
+		}
+	}
+
+	st := NewState(path, conf)
+	st.Save()
+	return st, nil
+}
+
+/* every extra job gets its own connections, which a file can't provide
+ * and SQLite doesn't like (only one connection can write at a time) */
+func connector(conf *Config) Connector {
+	switch {
+	case conf.Parallelism <= 1:
+		return nil
+	case conf.Destination.IsFile():
+		log.Println("gomig: migrating to a file, ignoring parallelism")
+		return nil
+	case conf.Destination.Driver == "sqlite":
+		log.Println("gomig: migrating to sqlite, ignoring parallelism")
+		return nil
+	}
+
+	return func() (common.ReadCloser, common.WriteCloser, error) {
+		r, err := db.OpenReader(conf.SourceDatabase())
+		if err != nil {
+			return nil, nil, err
+		}
+		w, err := db.OpenWriter(conf.Destination.Database())
+		if err != nil {
+			r.Close()
+			return nil, nil, err
+		}
+		return r, w, nil
+	}
+}
+
 func init() {
 	var cmd MigrateCommand
 	parser.AddCommand("migrate",
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aktau/gomig/db/common"
+)
+
+/* this file deals with migrating multiple tables at the same time. Every
+ * worker gets its own source and destination connection, and if the order
+ * matters, a table is only handed to a worker once the tables it
+ * references are done. */
+
+/* opens an extra pair of source and destination connections */
+type Connector func() (common.ReadCloser, common.WriteCloser, error)
+
+type conn struct {
+	r common.ReadCloser
+	w common.WriteCloser
+
+	/* the main connection is the one the views and projections were
+	 * created on, which might not be visible to other connections */
+	main bool
+}
+
+type pool struct {
+	conns []*conn
+}
+
+/* creates a pool of (at most) jobs connections, the first of which is the
+ * main connection. If extra connections can't be opened, the pool makes do
+ * with the ones it has. */
+func newPool(r common.ReadCloser, w common.WriteCloser, open Connector, jobs int) *pool {
+	p := &pool{conns: []*conn{{r, w, true}}}
+
+	if open == nil {
+		return p
+	}
+
+	for len(p.conns) < jobs {
+		r, w, err := open()
+		if err != nil {
+			log.Printf("converter: could only open %v of %v connections, error: %v\n",
+				len(p.conns), jobs, err)
+			break
+		}
+		p.conns = append(p.conns, &conn{r, w, false})
+	}
+
+	return p
+}
+
+/* closes all connections except the main one, which belongs to the caller */
+func (p *pool) Close() {
+	for _, c := range p.conns[1:] {
+		c.w.Close()
+		c.r.Close()
+	}
+}
+
+/* the errors that occurred while migrating, per table (or chunk of a
+ * table) */
+type TableErrors map[string]error
+
+func (e TableErrors) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msgs := make([]string, 0, len(names))
+	for _, name := range names {
+		msgs = append(msgs, fmt.Sprintf("%v: %v", name, e[name]))
+	}
+
+	return fmt.Sprintf("%v table(s) failed:\n\t%v", len(names), strings.Join(msgs, "\n\t"))
+}
+
+/* adds the errors of other, keeping the first error of each table */
+func (e TableErrors) merge(other TableErrors) {
+	for name, err := range other {
+		if _, ok := e[name]; !ok {
+			e[name] = err
+		}
+	}
+}
+
+/* a unit of work: a whole table, or one chunk of it */
+type task struct {
+	table *common.Table
+	chunk *common.Chunk
+}
+
+func (t task) String() string {
+	if t.chunk == nil {
+		return t.table.Name
+	}
+	return fmt.Sprintf("%v %v", t.table.Name, t.chunk)
+}
+
+func tableTasks(tables []*common.Table) []task {
+	tasks := make([]task, 0, len(tables))
+	for _, table := range tables {
+		tasks = append(tasks, task{table, nil})
+	}
+	return tasks
+}
+
+const (
+	taskPending = iota
+	taskRunning
+	taskDone
+)
+
+type scheduler struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	tasks  []task
+	state  []int
+	deps   [][]int
+	pinned []bool
+	errors TableErrors
+}
+
+/* the tasks are expected to be ordered by the dependencies of their tables
+ * already, a task only waits for the tasks of the tables it references that
+ * come before it, which keeps tables in a reference cycle from waiting on
+ * each other forever. If ordered is false, tasks don't wait for each other
+ * at all. */
+func newScheduler(tasks []task, pinned map[string]bool, ordered bool) *scheduler {
+	s := &scheduler{
+		tasks:  tasks,
+		state:  make([]int, len(tasks)),
+		deps:   make([][]int, len(tasks)),
+		pinned: make([]bool, len(tasks)),
+		errors: make(TableErrors),
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	/* the tasks of each table, in order */
+	byTable := make(map[string][]int)
+	for idx, t := range tasks {
+		byTable[t.table.Name] = append(byTable[t.table.Name], idx)
+		s.pinned[idx] = pinned[t.table.Name]
+	}
+
+	if ordered {
+		for idx, t := range tasks {
+			for _, name := range t.table.Dependencies() {
+				deps, ok := byTable[name]
+				if !ok || deps[0] > idx {
+					continue
+				}
+				s.deps[idx] = append(s.deps[idx], deps...)
+			}
+		}
+	}
+
+	return s
+}
+
+/* blocks until there's a task the worker can take, returns -1 when there
+ * is nothing left for it */
+func (s *scheduler) next(main bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		left := false
+		for idx := range s.tasks {
+			if s.state[idx] != taskPending || (s.pinned[idx] && !main) {
+				continue
+			}
+			left = true
+
+			if s.ready(idx) {
+				s.state[idx] = taskRunning
+				return idx
+			}
+		}
+
+		if !left {
+			return -1
+		}
+		s.cond.Wait()
+	}
+}
+
+func (s *scheduler) ready(idx int) bool {
+	for _, dep := range s.deps[idx] {
+		if s.state[dep] != taskDone {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *scheduler) done(idx int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state[idx] = taskDone
+	if err != nil {
+		s.errors[s.tasks[idx].String()] = err
+	}
+	s.cond.Broadcast()
+}
+
+/* runs f for every task, spread out over the connections of the pool. A
+ * failing task doesn't stop the others, the errors are collected and
+ * returned per task (nil if there were none). The tasks of pinned tables
+ * are only handed to the main connection. If ordered is true, a task is
+ * only started once the tables its table references are done. */
+func (p *pool) Run(tasks []task, pinned map[string]bool, ordered bool, f func(c *conn, t task) error) error {
+	s := newScheduler(tasks, pinned, ordered)
+
+	var wg sync.WaitGroup
+	for _, c := range p.conns {
+		wg.Add(1)
+		go func(c *conn) {
+			defer wg.Done()
+
+			for idx := s.next(c.main); idx != -1; idx = s.next(c.main) {
+				t := tasks[idx]
+				err := f(c, t)
+				if err != nil {
+					log.Printf("converter: %v failed, error: %v\n", t, err)
+				}
+				s.done(idx, err)
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	if len(s.errors) == 0 {
+		return nil
+	}
+	return s.errors
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aktau/gomig/db"
+	"github.com/aktau/gomig/db/common"
+)
+
+type PlanCommand struct {
+	/* config file */
+	File string `short:"f" long:"file" description:"The path of the configuration file to use" default:"config.yml"`
+}
+
+/* prints what a migration with the config would do, table by table,
+ * without writing anything. Only the source is connected to, and the views
+ * and projections aren't created on it, so only the ones that already
+ * exist can be described. */
+func (x *PlanCommand) Execute(args []string) error {
+	verbosity := len(options.Verbose)
+
+	conf := LoadConfigOrDie(x.File)
+
+	srcDriver, srcConf := conf.SourceDatabase()
+	if verbosity > 0 {
+		log.Println("gomig: connecting to source", srcDriver, srcConf)
+	}
+	reader, err := db.OpenReader(srcDriver, srcConf)
+	if err != nil {
+		return fmt.Errorf("gomig: error while creating reader, %v", err)
+	}
+	defer reader.Close()
+
+	tables := reader.FilteredTables(conf.OnlyTables, conf.ExcludeTables)
+	OrderTableByNamesList(tables, conf.OnlyTablesList)
+	cycles := OrderTablesByDependencies(tables)
+	overrideTypes(tables, conf)
+
+	dstDriver := conf.Destination.FileDriver()
+	ddl, err := newDdlRenderer(dstDriver)
+	if err != nil {
+		return fmt.Errorf("gomig: %v", err)
+	}
+
+	dst := dstDriver
+	switch {
+	case conf.Destination.FilePerTable != "":
+		dst = fmt.Sprintf("%v files in %v", dstDriver, conf.Destination.FilePerTable)
+	case conf.Destination.File != "":
+		dst = fmt.Sprintf("%v file %v", dstDriver, conf.Destination.File)
+	}
+	fmt.Printf("plan: %v -> %v, %v tables\n", srcDriver, dst, len(tables))
+	for _, cycle := range cycles {
+		fmt.Printf("warning: tables %v reference each other in a cycle\n", cycle)
+	}
+
+	found := make(map[string]bool, len(tables))
+	for _, table := range tables {
+		found[table.Name] = true
+	}
+	for name := range conf.Views {
+		if !found[name] {
+			fmt.Printf("view %v: doesn't exist yet, it's only created by a migration\n", name)
+		}
+	}
+	for name := range conf.Projections {
+		if !found[name] {
+			fmt.Printf("projection %v: doesn't exist yet, it's only created by a migration\n", name)
+		}
+	}
+
+	mapped := withDestinationKeys(tables, conf)
+	for idx, table := range tables {
+		dstName := strmap(table.Name, conf.TableMap)
+
+		fmt.Println()
+		if dstName != table.Name {
+			fmt.Printf("table %v -> %v\n", table.Name, dstName)
+		} else {
+			fmt.Printf("table %v\n", table.Name)
+		}
+
+		if n, err := reader.EstimateRows(table); err != nil {
+			fmt.Println("    estimated rows: unknown,", err)
+		} else {
+			fmt.Println("    estimated rows:", n)
+		}
+
+		key := conf.Tables[table.Name].MergeKey
+		if len(key) == 0 {
+			key = table.MergeKey()
+		}
+		reload := conf.Merge && len(key) == 0
+		fmt.Println("    transfer:      ", transferMode(conf, reload))
+		if len(key) > 0 {
+			fmt.Println("    merge key:     ", strings.Join(key, ", "))
+		} else {
+			fmt.Println("    merge key:      none")
+		}
+
+		for _, warning := range typeWarnings(table, dstDriver) {
+			fmt.Println("    warning:", warning)
+		}
+
+		switch {
+		case conf.Merge:
+			fmt.Println("    ddl:            none, the table is expected to exist when merging")
+		case conf.SuppressDdl:
+			fmt.Println("    ddl:            none, suppress_ddl is set")
+		default:
+			sql, err := ddl.Render(mapped[idx], dstName)
+			if err != nil {
+				return fmt.Errorf("gomig: could not generate the DDL of table %v, %v", table.Name, err)
+			}
+			fmt.Println("    ddl:")
+			for _, line := range strings.Split(strings.TrimSpace(sql), "\n") {
+				fmt.Println(strings.TrimRight("        "+line, " \t"))
+			}
+		}
+	}
+
+	return nil
+}
+
+/* where the statements of a file destination go */
+func outputName(conf *Config) string {
+	switch {
+	case conf.Destination.FilePerTable != "":
+		return "a file of its own in " + conf.Destination.FilePerTable
+	case conf.Destination.File == "-":
+		return "the standard output"
+	}
+	return conf.Destination.File
+}
+
+/* how the rows of a table get into the destination */
+func transferMode(conf *Config, reload bool) string {
+	var load string
+	switch {
+	case conf.Destination.IsFile() && conf.Destination.FileDriver() == "postgres":
+		load = "COPY blocks written to " + outputName(conf)
+	case conf.Destination.IsFile():
+		load = "INSERT statements written to " + outputName(conf)
+	case conf.Destination.Driver == "postgres":
+		load = "COPY"
+	case conf.Destination.Driver == "sqlite":
+		load = "a prepared INSERT statement"
+	default:
+		load = "multi-row INSERT statements"
+	}
+
+	switch {
+	case reload:
+		return "truncate and reload with " + load + ", there's no key to merge on"
+	case conf.Merge:
+		strategy, _ := common.ParseMergeStrategy(conf.MergeStrategy)
+		return fmt.Sprintf("merge (%v) from a staging table loaded with %v", strategy, load)
+	}
+	return load
+}
+
+/* the column types that don't survive the trip to the destination as they
+ * are */
+func typeWarnings(table *common.Table, driver string) []string {
+	var warnings []string
+	for _, col := range table.Columns {
+		t := col.Type
+		var warning string
+
+		switch {
+		case !isGenericType(t.Name):
+			warning = fmt.Sprintf("has type %v, which has no generic equivalent, it's used as is", t.Name)
+		case driver == "postgres" && t.Name == common.TypeText && t.Max >= 200:
+			warning = fmt.Sprintf("varchar(%v) becomes text, the length limit is dropped", t.Max)
+		case driver == "postgres" && t.Name == common.TypeInteger && t.Modifier == common.TypeHuge:
+			warning = "an unsigned bigint becomes numeric(20)"
+		case driver == "mysql" && t.Name == common.TypeNumeric && t.Precision == 0:
+			warning = "a numeric without precision becomes decimal(65, 30)"
+		case driver == "mysql" && t.Name == common.TypeBit && (t.Max == 0 || t.Max > 64):
+			warning = "becomes bit(64), longer bit strings don't fit"
+		case driver != "postgres" && t.Name == common.TypeSet:
+			warning = "a set becomes text, its members are lost"
+		case driver == "sqlite" && t.Name == common.TypeInteger && t.Modifier == common.TypeHuge:
+			warning = "SQLite stores at most signed 64-bit integers, larger values become floats"
+		case driver == "sqlite" && t.Name == common.TypeBit:
+			warning = "a bit string becomes a blob"
+		}
+
+		if warning != "" {
+			warnings = append(warnings, fmt.Sprintf("column %v: %v", col.Name, warning))
+		}
+	}
+	return warnings
+}
+
+func isGenericType(name string) bool {
+	switch name {
+	case common.TypeFloat, common.TypeDouble, common.TypeNumeric, common.TypeInteger,
+		common.TypeBlob, common.TypeBool, common.TypeChar, common.TypeBit, common.TypeText,
+		common.TypeDate, common.TypeTime, common.TypeTimeStamp, common.TypeSet, common.TypeJson:
+		return true
+	}
+	return false
+}
+
+/* renders the DDL of tables with the file writer of a driver. The writers
+ * start their output with the statements that set up the session, which
+ * are the same every time, so they're left out. */
+type ddlRenderer struct {
+	driver   string
+	preamble string
+}
+
+func newDdlRenderer(driver string) (*ddlRenderer, error) {
+	r := &ddlRenderer{driver: driver}
+
+	preamble, err := r.write(func(w common.Writer) error { return nil })
+	if err != nil {
+		return nil, err
+	}
+	r.preamble = preamble
+	return r, nil
+}
+
+func (r *ddlRenderer) Render(table *common.Table, dstName string) (string, error) {
+	sql, err := r.write(func(w common.Writer) error {
+		if err := w.CreateTable(table, dstName); err != nil {
+			return err
+		}
+		if err := w.CreateIndices(table, dstName); err != nil {
+			return err
+		}
+		return w.CreateConstraints(table, dstName)
+	})
+	return strings.TrimPrefix(sql, r.preamble), err
+}
+
+func (r *ddlRenderer) write(fn func(w common.Writer) error) (string, error) {
+	var buf bytes.Buffer
+	w, err := db.OpenStreamWriter(r.driver, &buf)
+	if err != nil {
+		return "", err
+	}
+
+	if err := fn(w); err != nil {
+		w.Close()
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func init() {
+	var cmd PlanCommand
+	parser.AddCommand("plan",
+		"Print what a migration would do, without doing it",
+		"Print per table the destination name, the DDL, how the data is transferred, the merge key, the estimated row count and the types that don't map cleanly, without writing anything",
+		&cmd)
+}
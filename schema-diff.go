@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/aktau/gomig/db"
+)
+
+type SchemaDiffCommand struct {
+	/* config file */
+	File string `short:"f" long:"file" description:"The path of the configuration file to use" default:"config.yml"`
+
+	Out string `short:"o" long:"out" description:"The file to write the statements to, instead of the standard output"`
+}
+
+/* compares the tables of the source with those of the destination and
+ * writes the statements that bring the destination in line: CREATE TABLE
+ * for the missing tables, and ALTER TABLE to add, change and drop columns.
+ * Nothing is executed. */
+func (x *SchemaDiffCommand) Execute(args []string) error {
+	verbosity := len(options.Verbose)
+
+	conf := LoadConfigOrDie(x.File)
+	if conf.Destination.IsFile() {
+		return fmt.Errorf("gomig: a destination file has no schema to compare with")
+	}
+
+	srcDriver, srcConf := conf.SourceDatabase()
+	if verbosity > 0 {
+		log.Println("gomig: connecting to source", srcDriver, srcConf)
+	}
+	reader, err := db.OpenReader(srcDriver, srcConf)
+	if err != nil {
+		return fmt.Errorf("gomig: error while creating reader, %v", err)
+	}
+	defer reader.Close()
+
+	if verbosity > 0 {
+		log.Println("gomig: connecting to destination", conf.Destination)
+	}
+	dstReader, err := db.OpenReader(conf.Destination.Database())
+	if err != nil {
+		return fmt.Errorf("gomig: error while reading the destination, %v", err)
+	}
+	defer dstReader.Close()
+
+	tempViews := createTempEntities(reader, conf.Views, conf.Projections)
+	defer tempViews.Erase()
+
+	tables := reader.FilteredTables(conf.OnlyTables, conf.ExcludeTables)
+	OrderTableByNamesList(tables, conf.OnlyTablesList)
+	OrderTablesByDependencies(tables)
+	overrideTypes(tables, conf)
+
+	out := x.Out
+	if out == "" {
+		out = "-"
+	}
+	writer, err := db.OpenFileWriter(conf.Destination.Driver, out)
+	if err != nil {
+		return fmt.Errorf("gomig: error while creating writer: %v", err)
+	}
+
+	differ, err := evolveTables(tables, writer, dstReader, true, conf)
+	if cerr := writer.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("gomig: could not compare the schemas, %v", err)
+	}
+
+	if differ > 0 {
+		return fmt.Errorf("gomig: %v of %v tables differ", differ, len(tables))
+	}
+	log.Println("gomig: done, the schemas match")
+	return nil
+}
+
+func init() {
+	var cmd SchemaDiffCommand
+	parser.AddCommand("schema-diff",
+		"Output the statements that bring the destination schema in line with the source",
+		"Compare the tables of the source and destination, and output the CREATE TABLE and ALTER TABLE statements that add, change and drop columns in the destination to match the source, without executing them",
+		&cmd)
+}
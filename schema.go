@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/aktau/gomig/db"
+)
+
+type SchemaCommand struct {
+	/* config file */
+	File string `short:"f" long:"file" description:"The path of the configuration file to use" default:"config.yml"`
+
+	Out    string `short:"o" long:"out" description:"The file to write the schema to, - for the standard output" default:"schema.sql"`
+	Driver string `long:"driver" description:"The SQL dialect to write, by default that of the destination (postgres if it has no driver)"`
+	Split  bool   `long:"split" description:"Write the tables (pre-data) and the indices and constraints (post-data) to separate files, named after --out"`
+}
+
+/* writes the DDL a migration would execute for the tables in scope to a
+ * file, without touching the destination. The tables are created in the
+ * order of their dependencies, the indices and constraints come after all
+ * of them, like pg_dump's pre-data and post-data sections. */
+func (x *SchemaCommand) Execute(args []string) error {
+	verbosity := len(options.Verbose)
+
+	conf := LoadConfigOrDie(x.File)
+
+	driver := x.Driver
+	if driver == "" {
+		driver = conf.Destination.FileDriver()
+	}
+
+	srcDriver, srcConf := conf.SourceDatabase()
+	if verbosity > 0 {
+		log.Println("gomig: connecting to source", srcDriver, srcConf)
+	}
+	reader, err := db.OpenReader(srcDriver, srcConf)
+	if err != nil {
+		return fmt.Errorf("gomig: error while creating reader, %v", err)
+	}
+	defer reader.Close()
+
+	tempViews := createTempEntities(reader, conf.Views, conf.Projections)
+	defer tempViews.Erase()
+
+	tables := reader.FilteredTables(conf.OnlyTables, conf.ExcludeTables)
+	OrderTableByNamesList(tables, conf.OnlyTablesList)
+	for _, cycle := range OrderTablesByDependencies(tables) {
+		log.Printf("gomig: tables %v reference each other in a cycle, "+
+			"their foreign keys are only added in the post-data section\n", cycle)
+	}
+	overrideTypes(tables, conf)
+	tables = withDestinationKeys(tables, conf)
+
+	preOut, postOut := x.Out, x.Out
+	if x.Split && x.Out == "-" {
+		return fmt.Errorf("gomig: the sections can't be split when writing to the standard output")
+	}
+	if x.Split {
+		preOut, postOut = sectionPath(x.Out, "pre-data"), sectionPath(x.Out, "post-data")
+	}
+
+	pre, err := db.OpenFileWriter(driver, preOut)
+	if err != nil {
+		return fmt.Errorf("gomig: error while creating writer: %v", err)
+	}
+	defer pre.Close()
+
+	post := pre
+	if postOut != preOut {
+		if post, err = db.OpenFileWriter(driver, postOut); err != nil {
+			return fmt.Errorf("gomig: error while creating writer: %v", err)
+		}
+		defer post.Close()
+	}
+
+	for _, table := range tables {
+		if err := pre.CreateTable(table, strmap(table.Name, conf.TableMap)); err != nil {
+			return fmt.Errorf("gomig: could not write table %v, %v", table.Name, err)
+		}
+	}
+	for _, table := range tables {
+		if err := post.CreateIndices(table, strmap(table.Name, conf.TableMap)); err != nil {
+			return fmt.Errorf("gomig: could not write the indices of table %v, %v", table.Name, err)
+		}
+	}
+	for _, table := range tables {
+		if err := post.CreateConstraints(table, strmap(table.Name, conf.TableMap)); err != nil {
+			return fmt.Errorf("gomig: could not write the constraints of table %v, %v", table.Name, err)
+		}
+	}
+
+	if x.Split {
+		log.Printf("gomig: wrote the schema of %v tables to %v and %v\n", len(tables), preOut, postOut)
+	} else {
+		log.Printf("gomig: wrote the schema of %v tables to %v\n", len(tables), preOut)
+	}
+	return nil
+}
+
+/* schema.sql becomes schema-pre-data.sql */
+func sectionPath(path, section string) string {
+	/* keep the compression suffix: schema.sql.gz -> schema-pre-data.sql.gz */
+	var compressed string
+	if ext := filepath.Ext(path); ext == ".gz" || ext == ".zst" {
+		compressed = ext
+		path = strings.TrimSuffix(path, ext)
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + section + ext + compressed
+}
+
+func init() {
+	var cmd SchemaCommand
+	parser.AddCommand("schema",
+		"Write the schema of the destination to a file",
+		"Write the tables, sequences, comments, indices and constraints a migration would create to a file, in the order of their dependencies, without touching the destination",
+		&cmd)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aktau/gomig/db/common"
+	"github.com/aktau/gomig/db/mysql/binlog"
+)
+
+const (
+	PATH_STATE_DEFAULT = "gomig-state.json"
+)
+
+/* the steps of a migration that are checkpointed, per table */
+const (
+	stepCreate      = "create"
+	stepTruncate    = "truncate"
+	stepData        = "data"
+	stepMerge       = "merge"
+	stepIndices     = "indices"
+	stepConstraints = "constraints"
+)
+
+/* the checkpoint store, which records what parts of a migration have been
+ * committed to the destination so an interrupted migration can be resumed.
+ * It's a JSON file that is rewritten after every completed step. A nil
+ * *State records nothing and has nothing done. */
+type State struct {
+	path string
+	mu   sync.Mutex
+
+	Started time.Time `json:"started"`
+
+	/* the options a migration can only be resumed with */
+	Merge     bool `json:"merge"`
+	ChunkSize int  `json:"chunk_size,omitempty"`
+
+	/* by source table name */
+	Tables map[string]*TableState `json:"tables"`
+
+	/* the watermarks of the tables that are synced incrementally, up to
+	 * which the rows have been merged. These are carried over from one
+	 * migration to the next. */
+	Watermarks map[string]string `json:"watermarks,omitempty"`
+
+	/* where following the binlog of the source got to, the changes before
+	 * it have been applied to the destination */
+	Binlog *binlog.Position `json:"binlog,omitempty"`
+}
+
+type TableState struct {
+	Done []string `json:"done,omitempty"`
+
+	/* the chunks the table was split into, a resumed migration has to use
+	 * the same ones */
+	Chunks     []*common.Chunk `json:"chunks,omitempty"`
+	ChunksDone []int           `json:"chunks_done,omitempty"`
+
+	/* the watermark the table is synced up to in this migration, it
+	 * becomes the watermark of the table once it's merged */
+	Watermark string `json:"watermark,omitempty"`
+}
+
+/* starts a new state, for a migration with the given options. Only the
+ * watermarks of an earlier migration and the binlog position follow got to
+ * are kept, so a migration in between doesn't make the next follow start
+ * over with a snapshot. */
+func NewState(path string, options *Config) *State {
+	s := &State{
+		path:       path,
+		Started:    time.Now(),
+		Merge:      options.Merge,
+		ChunkSize:  options.ChunkSize,
+		Tables:     make(map[string]*TableState),
+		Watermarks: make(map[string]string),
+	}
+
+	if prev, err := readState(path); err == nil {
+		s.Watermarks = prev.Watermarks
+		s.Binlog = prev.Binlog
+	}
+
+	return s
+}
+
+func readState(path string) (*State, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &State{path: path}
+	if err = json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("state file %v is corrupt: %v", path, err)
+	}
+	if s.Tables == nil {
+		s.Tables = make(map[string]*TableState)
+	}
+	if s.Watermarks == nil {
+		s.Watermarks = make(map[string]string)
+	}
+
+	return s, nil
+}
+
+/* loads the state of an earlier migration, which has to have been run with
+ * the same options */
+func LoadState(path string, options *Config) (*State, error) {
+	s, err := readState(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Merge != options.Merge || s.ChunkSize != options.ChunkSize {
+		return nil, fmt.Errorf("state file %v was written by a migration with "+
+			"different merge or chunk_size options, it can't be resumed", path)
+	}
+
+	return s, nil
+}
+
+/* writes the state to a temporary file first, so a crash halfway through
+ * doesn't leave a corrupt state file behind */
+func (s *State) save() {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err == nil {
+		tmp := s.path + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, s.path)
+		}
+	}
+
+	if err != nil {
+		log.Println("state: could not save the state, resuming might redo work, error:", err)
+	}
+}
+
+func (s *State) Save() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.save()
+}
+
+func (s *State) table(name string) *TableState {
+	t, ok := s.Tables[name]
+	if !ok {
+		t = &TableState{}
+		s.Tables[name] = t
+	}
+	return t
+}
+
+func (s *State) IsDone(table, step string) bool {
+	if s == nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, done := range s.table(table).Done {
+		if done == step {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *State) MarkDone(table, step string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stepDone(table, s.table(table), step)
+	s.save()
+}
+
+/* a merged table is synced up to its watermark */
+func (s *State) stepDone(name string, t *TableState, step string) {
+	t.Done = append(t.Done, step)
+	if step == stepMerge && t.Watermark != "" {
+		s.Watermarks[name] = t.Watermark
+	}
+}
+
+/* the chunks an earlier run split the table into, nil if it didn't */
+func (s *State) Chunks(table string) []*common.Chunk {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.table(table).Chunks
+}
+
+func (s *State) SetChunks(table string, chunks []*common.Chunk) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.table(table).Chunks = chunks
+	s.save()
+}
+
+func (s *State) IsChunkDone(table string, c *common.Chunk) bool {
+	if s == nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, idx := range s.table(table).ChunksDone {
+		if idx == c.Index {
+			return true
+		}
+	}
+	return false
+}
+
+/* marks a chunk as done, once all chunks of the table are done, the step
+ * is done as well */
+func (s *State) MarkChunkDone(table string, c *common.Chunk, step string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.table(table)
+	t.ChunksDone = append(t.ChunksDone, c.Index)
+	sort.Ints(t.ChunksDone)
+	if len(t.ChunksDone) == len(t.Chunks) {
+		s.stepDone(table, t, step)
+	}
+	s.save()
+}
+
+/* the watermark a table was synced up to by an earlier migration, empty if
+ * it wasn't */
+func (s *State) Watermark(table string) string {
+	if s == nil {
+		return ""
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Watermarks[table]
+}
+
+/* the watermark the table is being synced up to, empty if it hasn't been
+ * determined yet */
+func (s *State) TargetWatermark(table string) string {
+	if s == nil {
+		return ""
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.table(table).Watermark
+}
+
+func (s *State) SetTargetWatermark(table, wm string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.table(table).Watermark = wm
+	s.save()
+}
+
+/* the binlog position to follow from, nil if the destination hasn't been
+ * following the source */
+func (s *State) BinlogPosition() *binlog.Position {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Binlog
+}
+
+func (s *State) SetBinlogPosition(pos binlog.Position) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Binlog = &pos
+	s.save()
+}
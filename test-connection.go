@@ -23,13 +23,14 @@ func (x *TestConnectionCommand) Execute(args []string) error {
 	fmt.Println("Testing connection to both source and destination db (if specified)")
 
 	/* try connecting to the source */
+	srcDriver, srcConf := conf.SourceDatabase()
 	if verbosity > 0 {
-		rawSrcParams, _ := goyaml.Marshal(conf.Mysql)
+		rawSrcParams, _ := goyaml.Marshal(srcConf)
 		srcParams := string(rawSrcParams)
-		fmt.Printf("source:\n%v\n", IndentWith(srcParams, "  "))
+		fmt.Printf("source (%v):\n%v\n", srcDriver, IndentWith(srcParams, "  "))
 	}
 	fmt.Print("connecting...")
-	reader, err := db.OpenReader("mysql", conf.Mysql)
+	reader, err := db.OpenReader(srcDriver, srcConf)
 	if err != nil {
 		fmt.Printf("ERROR (%v)\n", err)
 		haveError = true
@@ -49,10 +50,10 @@ func (x *TestConnectionCommand) Execute(args []string) error {
 		fmt.Printf("destination:\n%v\n", IndentWith(dstParams, "  "))
 	}
 	fmt.Print("connecting...")
-	if conf.Destination.File != "" {
+	if conf.Destination.IsFile() {
 		fmt.Println("IS A FILE")
 	} else {
-		writer, err := db.OpenWriter("postgres", conf.Destination.Postgres)
+		writer, err := db.OpenWriter(conf.Destination.Database())
 		if err != nil {
 			fmt.Printf("ERROR (%v)\n", err)
 			haveError = true
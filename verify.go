@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aktau/gomig/db"
+	"github.com/aktau/gomig/db/common"
+)
+
+/* how many rows a chunk has if the config has no chunk_size */
+const verifyChunkSizeDefault = 10000
+
+type VerifyCommand struct {
+	/* config file */
+	File string `short:"f" long:"file" description:"The path of the configuration file to use" default:"config.yml"`
+
+	ChunkSize int `long:"chunk-size" description:"The number of rows to compare at a time, overrides chunk_size of the config file"`
+}
+
+/* how a table compares, the chunks are the ranges of its primary key in
+ * which the rows differ */
+type tableReport struct {
+	src, dst string
+
+	/* the table isn't in the destination at all */
+	missing bool
+
+	srcSum, dstSum common.Checksum
+	chunks         []string
+}
+
+func (t *tableReport) Ok() bool {
+	return !t.missing && t.srcSum.Equal(t.dstSum) && len(t.chunks) == 0
+}
+
+func (t *tableReport) String() string {
+	name := t.src
+	if t.dst != t.src {
+		name += " -> " + t.dst
+	}
+
+	switch {
+	case t.missing:
+		return fmt.Sprintf("table %v: MISSING from the destination", name)
+	case t.Ok():
+		return fmt.Sprintf("table %v: %v rows, ok", name, t.srcSum.Rows)
+	}
+
+	lines := []string{fmt.Sprintf("table %v: DIFFERS, %v rows in the source, %v in the destination",
+		name, t.srcSum.Rows, t.dstSum.Rows)}
+	for _, chunk := range t.chunks {
+		lines = append(lines, "    "+chunk)
+	}
+	return strings.Join(lines, "\n")
+}
+
+/* compares the tables of the source with those of the destination, chunk
+ * by chunk. The values are normalized before they're checksummed, so
+ * tables can be compared across different kinds of databases. */
+func (x *VerifyCommand) Execute(args []string) error {
+	verbosity := len(options.Verbose)
+
+	conf := LoadConfigOrDie(x.File)
+	if conf.Destination.IsFile() {
+		return fmt.Errorf("gomig: a destination file can't be verified")
+	}
+
+	size := verifyChunkSizeDefault
+	switch {
+	case x.ChunkSize > 0:
+		size = x.ChunkSize
+	case conf.ChunkSize > 0:
+		size = conf.ChunkSize
+	}
+
+	srcDriver, srcConf := conf.SourceDatabase()
+	if verbosity > 0 {
+		log.Println("gomig: connecting to source", srcDriver, srcConf)
+	}
+	reader, err := db.OpenReader(srcDriver, srcConf)
+	if err != nil {
+		return fmt.Errorf("gomig: error while creating reader, %v", err)
+	}
+	defer reader.Close()
+
+	if verbosity > 0 {
+		log.Println("gomig: connecting to destination", conf.Destination)
+	}
+	dstReader, err := db.OpenReader(conf.Destination.Database())
+	if err != nil {
+		return fmt.Errorf("gomig: error while reading the destination, %v", err)
+	}
+	defer dstReader.Close()
+
+	tempViews := createTempEntities(reader, conf.Views, conf.Projections)
+	defer tempViews.Erase()
+
+	tables := reader.FilteredTables(conf.OnlyTables, conf.ExcludeTables)
+	OrderTableByNamesList(tables, conf.OnlyTablesList)
+
+	dstNames := make(map[string]bool, len(tables))
+	for _, table := range tables {
+		dstNames[strmap(table.Name, conf.TableMap)] = true
+	}
+	dstTables := make(map[string]*common.Table, len(tables))
+	for _, table := range dstReader.FilteredTables(dstNames, nil) {
+		dstTables[table.Name] = table
+	}
+
+	differ := 0
+	for _, table := range tables {
+		report, err := verifyTable(reader, dstReader, table, dstTables, size, conf)
+		if err != nil {
+			return fmt.Errorf("gomig: could not verify table %v, %v", table.Name, err)
+		}
+		if !report.Ok() {
+			differ++
+		}
+		fmt.Println(report)
+	}
+
+	if differ > 0 {
+		return fmt.Errorf("gomig: %v of %v tables differ", differ, len(tables))
+	}
+	log.Println("gomig: done, all tables match")
+	return nil
+}
+
+func verifyTable(r, dr common.Reader, src *common.Table, dstTables map[string]*common.Table, size int, conf *Config) (*tableReport, error) {
+	report := &tableReport{src: src.Name, dst: strmap(src.Name, conf.TableMap)}
+
+	dst, err := destinationTable(src, dstTables[report.dst], common.ChunkKey(src), conf)
+	if err != nil {
+		return nil, err
+	}
+	if dst == nil {
+		report.missing = true
+		return report, nil
+	}
+
+	chunks, err := r.Chunks(src, size)
+	if err != nil {
+		log.Println("gomig: could not split table", src.Name,
+			"into chunks, comparing it whole, error:", err)
+	}
+	if len(chunks) == 0 {
+		chunks = []*common.Chunk{nil}
+	}
+
+	for _, c := range chunks {
+		srcSum, err := checksum(r, src, src, c)
+		if err != nil {
+			return nil, fmt.Errorf("source: %v", err)
+		}
+		dstSum, err := checksum(dr, dst, src, c)
+		if err != nil {
+			return nil, fmt.Errorf("destination: %v", err)
+		}
+
+		report.srcSum.Rows += srcSum.Rows
+		report.srcSum.Sum += srcSum.Sum
+		report.dstSum.Rows += dstSum.Rows
+		report.dstSum.Sum += dstSum.Sum
+
+		if !srcSum.Equal(dstSum) {
+			what := "the whole table"
+			if c != nil {
+				what = c.String()
+			}
+			report.chunks = append(report.chunks, fmt.Sprintf("%v differs: %v rows in the source, %v in the destination",
+				what, srcSum.Rows, dstSum.Rows))
+		}
+	}
+
+	return report, nil
+}
+
+/* prepares the destination table that corresponds to src to be read in the
+ * same chunks (along key, if not nil) as src. For a projection only the
+ * part of the table its destination_conditions cover is read. Returns nil
+ * if there is no such table. */
+func destinationTable(src, dst *common.Table, key []string, conf *Config) (*common.Table, error) {
+	if dst == nil {
+		return nil, nil
+	}
+
+	if key != nil {
+		var err error
+		if dst, err = dst.WithKey(key); err != nil {
+			return nil, err
+		}
+	} else {
+		/* the filter is set on a copy */
+		copied := *dst
+		dst = &copied
+	}
+
+	if meta, ok := conf.Projections[src.Name]; ok {
+		scope, err := (&common.MergeOptions{DstCondition: meta.Conditions}).Scope()
+		if err != nil {
+			return nil, err
+		}
+		dst.Filter = scope
+	}
+
+	return dst, nil
+}
+
+/* the checksum of the rows of table (in chunk c), with the columns of src */
+func checksum(r common.Reader, table, src *common.Table, c *common.Chunk) (common.Checksum, error) {
+	rows, err := common.ReadRows(r, table, c)
+	if err != nil {
+		return common.Checksum{}, err
+	}
+	defer rows.Close()
+
+	return common.ChecksumRows(rows, src)
+}
+
+func init() {
+	var cmd VerifyCommand
+	parser.AddCommand("verify",
+		"Compare the data of the source and destination",
+		"Compare the row counts and checksums of the tables in the source and destination, chunk by chunk, and report the primary key ranges that differ",
+		&cmd)
+}
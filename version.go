@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"strings"
+
+	"github.com/aktau/gomig/db"
 )
 
 const (
@@ -11,26 +13,12 @@ const (
 	GOMIG_MIC_VERSION = 4
 )
 
-type Backend struct {
-	Source      string
-	Destination string
-}
-
-func (b *Backend) String() string {
-	return b.Source + " -> " + b.Destination
-}
-
 func description() string {
-	backends := []Backend{Backend{"MySQL", "Postgres"}}
-	stringized := make([]string, 0, len(backends))
-	for _, backend := range backends {
-		stringized = append(stringized, backend.String())
-	}
-
 	return fmt.Sprintf(
-		"gomig v.%v.%v.%v, sync data between SQL data sources, supported backends: %v",
+		"gomig v.%v.%v.%v, sync data between SQL data sources, supported backends: "+
+			"sources (%v), destinations (%v)",
 		GOMIG_MAJ_VERSION, GOMIG_MIN_VERSION, GOMIG_MIC_VERSION,
-		strings.Join(stringized, ", "))
+		strings.Join(db.Readers(), ", "), strings.Join(db.Writers(), ", "))
 }
 
 type VersionCommand struct{}